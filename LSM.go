@@ -5,23 +5,39 @@ import (
 	"github.com/nikita-tomilov/golsm/memt"
 	"github.com/nikita-tomilov/golsm/sst"
 	"github.com/nikita-tomilov/golsm/writer"
-	"time"
 )
 
-func InitStorage(commitlogPath string, entriesPerCommitlog int, periodBetweenFlushes time.Duration, memtPerformExpirationEvery time.Duration, memtPrefetchSeconds time.Duration, sstPath string, memtMaxEntriesPerTag int) (*StorageReader, *StorageWriter) {
-	clm := commitlog.Manager{Path: commitlogPath}
-	sstm := sst.Manager{RootDir: sstPath}
-	dw := writer.DiskWriter{SstManager: &sstm, ClManager: &clm, EntriesPerCommitlog: entriesPerCommitlog, PeriodBetweenFlushes: periodBetweenFlushes}
-	dw.Init()
+func InitStorage(options Options) (*Storage, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	options = options.WithDefaults()
 
-	memtm := memt.Manager{MaxEntriesPerTag: memtMaxEntriesPerTag, PerformExpirationEvery: memtPerformExpirationEvery}
+	memtm := memt.Manager{MaxEntriesPerTag: options.MemtMaxEntriesPerTag, PerformExpirationEvery: options.MemtPerformExpirationEvery}
 	memtm.InitStorage()
 
+	clm := commitlog.Manager{Path: options.CommitlogPath, SyncPolicy: options.SyncPolicy, SyncPeriod: options.SyncPeriod,
+		MaxSegmentSize: options.MaxCommitlogSegmentSize, MaxSegmentAge: options.MaxCommitlogSegmentAge}
+	sstm := sst.Manager{RootDir: options.SstPath, PerformCompactionEvery: options.PerformCompactionEvery, ExpiredFractionThreshold: options.ExpiredFractionThreshold,
+		PartitionWindow: options.PartitionWindow, PartitionWindowPerTag: options.PartitionWindowPerTag, Retention: options.Retention,
+		Codec: options.Codec, CodecPerTag: options.CodecPerTag, BlockSize: options.BlockSize, CompactionFanIn: options.CompactionFanIn,
+		MaxOpenFiles: options.MaxOpenFiles, MemoryMapped: options.MemoryMapped}
+	dw := writer.DiskWriter{SstManager: &sstm, ClManager: &clm, MemTable: &memtm, EntriesPerCommitlog: options.EntriesPerCommitlog,
+		PeriodBetweenFlushes: options.PeriodBetweenFlushes, MaxPendingSegments: options.MaxPendingSegments}
+	if err := dw.Init(); err != nil {
+		memtm.CloseStorage()
+		return nil, err
+	}
+
 	storageWriter := StorageWriter{MemTable: &memtm, DiskWriter: &dw}
 	storageWriter.Init()
 
-	storageReader := StorageReader{MemTable: &memtm, SSTManager: &sstm, MemtPrefetch:memtPrefetchSeconds}
-	storageReader.Init()
+	storageReader := StorageReader{MemTable: &memtm, SSTManager: &sstm, MemtPrefetch: options.MemtPrefetch}
+	if err := storageReader.Init(); err != nil {
+		dw.Close()
+		memtm.CloseStorage()
+		return nil, err
+	}
 
-	return &storageReader, &storageWriter
+	return &Storage{StorageReader: &storageReader, StorageWriter: &storageWriter, diskWriter: &dw, memTable: &memtm}, nil
 }
@@ -1,6 +1,7 @@
 package golsm
 
 import (
+	"errors"
 	"fmt"
 	"github.com/nikita-tomilov/golsm/commitlog"
 	"github.com/nikita-tomilov/golsm/dto"
@@ -9,7 +10,10 @@ import (
 	"github.com/nikita-tomilov/golsm/utils"
 	"github.com/nikita-tomilov/golsm/writer"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -39,7 +43,7 @@ func TestLSM_StorageWriterWorks(t *testing.T) {
 	storageWriter.Store(slice(dummyData, tagName, 20, 25), expiration)
 	time.Sleep(10 * time.Second)
 
-	storedDataOnDisk := sstm.SstForTag(tagName).GetAllEntries()
+	storedDataOnDisk := entriesOnDisk(&sstm, tagName)
 	storedDataInMemT := memtm.MemTableForTag(tagName).RetrieveAll()
 
 	//then
@@ -55,14 +59,15 @@ func TestLSM_StorageWriterWorks(t *testing.T) {
 }
 
 func TestLSM_StorageReaderWorks(t *testing.T) {
-	storageReader, storageWriter := InitStorage(
-		fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
-		10,
-		5*time.Second,
-		10*time.Second,
-		10*time.Second,
-		fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
-		9999)
+	storage := mustInit(InitStorage(Options{
+		CommitlogPath: fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog: 10,
+		PeriodBetweenFlushes: 5*time.Second,
+		MemtPerformExpirationEvery: 10*time.Second,
+		MemtPrefetch: 10*time.Second,
+		SstPath: fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag: 9999,
+	}))
 
 	const tagName = "whatever"
 	const expiration = 0
@@ -70,11 +75,12 @@ func TestLSM_StorageReaderWorks(t *testing.T) {
 	dummyData := buildDummyData(25)
 
 	//when
-	storageWriter.Store(slice(dummyData, tagName, 0, 25), expiration)
-	retrievedData := storageReader.Retrieve(toList(tagName), 1336, 1500)
-	availFrom, availTo := storageReader.Availability()
+	storage.Store(slice(dummyData, tagName, 0, 25), expiration)
+	retrievedData := mustRetrieve(storage.Retrieve(toList(tagName), 1336, 1500))
+	availFrom, availTo, err := storage.Availability()
 
 	//then
+	assert.Nil(t, err, "availability was not reported")
 	assert.Equal(t, 1, len(retrievedData), "weird stuff returned from StorageReader")
 	assert.Equal(t, dummyData[0].Timestamp, availFrom, "availFrom incorrect")
 	assert.Equal(t, dummyData[24].Timestamp, availTo, "availTo incorrect")
@@ -111,7 +117,7 @@ func TestLSM_StorageWriterBatchingWorks(t *testing.T) {
 	storageWriter.StoreBatch(sliceAndToBatch(dummyData, tagName, 20, 25), expiration)
 	time.Sleep(10 * time.Second)
 
-	storedDataOnDisk := sstm.SstForTag(tagName).GetAllEntries()
+	storedDataOnDisk := entriesOnDisk(&sstm, tagName)
 	storedDataInMemT := memtm.MemTableForTag(tagName).RetrieveAll()
 
 	//then
@@ -128,14 +134,15 @@ func TestLSM_StorageWriterBatchingWorks(t *testing.T) {
 
 
 func TestLSM_StorageReaderOnBigDataTest(t *testing.T) {
-	storageReader, storageWriter := InitStorage(
-		fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
-		10,
-		1*time.Second,
-		1*time.Second,
-		1*time.Second,
-		fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
-		100)
+	storage := mustInit(InitStorage(Options{
+		CommitlogPath: fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog: 10,
+		PeriodBetweenFlushes: 1*time.Second,
+		MemtPerformExpirationEvery: 1*time.Second,
+		MemtPrefetch: 1*time.Second,
+		SstPath: fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag: 100,
+	}))
 
 	dataFrom := utils.GetNowMillis()
 	dataTo := dataFrom + 60*60*1000
@@ -143,7 +150,7 @@ func TestLSM_StorageReaderOnBigDataTest(t *testing.T) {
 	data := buildDummyDataForBenchmark(tagsCount, dataFrom, dataTo)
 
 	//when
-	storageWriter.Store(data, 0)
+	storage.Store(data, 0)
 
 	for i := 0; i < 10000; i++ {
 		from := randomTs(dataFrom+20, dataFrom+(dataTo-dataFrom)/2)
@@ -151,13 +158,149 @@ func TestLSM_StorageReaderOnBigDataTest(t *testing.T) {
 		if to-from <= 10 {
 			from -= 10
 		}
-		d := storageReader.Retrieve([]string{"tag1", "tag2", "tag3"}, from, to)
+		d := mustRetrieve(storage.Retrieve([]string{"tag1", "tag2", "tag3"}, from, to))
 		if len(d) != 3 {
 			panic("tags mismatch")
 		}
 	}
 }
 
+func TestLSM_StorageWriterRejectsOversizedValues(t *testing.T) {
+	storage := mustInit(InitStorage(Options{
+		CommitlogPath: fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog: 10,
+		PeriodBetweenFlushes: 5*time.Second,
+		MemtPerformExpirationEvery: 10*time.Second,
+		MemtPrefetch: 10*time.Second,
+		SstPath: fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag: 9999,
+	}))
+
+	data := map[string][]dto.Measurement{
+		"small":     {{Timestamp: 1337, Value: make([]byte, 4)}},
+		"oversized": {{Timestamp: 1337, Value: make([]byte, commitlog.MaxValueSize+1)}},
+	}
+
+	//when
+	err := storage.Store(data, 0)
+	retrievedData := mustRetrieve(storage.Retrieve([]string{"small", "oversized"}, 1336, 1500))
+
+	//then
+	assert.True(t, errors.Is(err, commitlog.ErrValueTooLarge), "oversized value was not rejected")
+	assert.Equal(t, 0, len(retrievedData["small"]), "batch was partially stored")
+	assert.Equal(t, 0, len(retrievedData["oversized"]), "oversized value was stored")
+}
+
+func TestLSM_StorageWriterDeletesRange(t *testing.T) {
+	storage := mustInit(InitStorage(Options{
+		CommitlogPath: fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog: 10,
+		PeriodBetweenFlushes: 1*time.Second,
+		MemtPerformExpirationEvery: 10*time.Second,
+		MemtPrefetch: 10*time.Second,
+		SstPath: fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag: 9999,
+	}))
+
+	const tagName = "whatever"
+	const expiration = 0
+
+	dummyData := buildDummyData(25)
+	storage.Store(slice(dummyData, tagName, 0, 25), expiration)
+	storage.Flush()
+
+	//when
+	err := storage.Delete(tagName, dummyData[5].Timestamp, dummyData[14].Timestamp)
+	retrievedData := mustRetrieve(storage.Retrieve(toList(tagName), 1336, 1500))
+	storage.Flush()
+	_, errCompaction := storage.SSTManager.Compact()
+	sstForTag, _ := storage.SSTManager.SstForTag(tagName)
+
+	//then
+	assert.Nil(t, err, "tombstone was rejected")
+	assert.Nil(t, errCompaction, "compaction failed")
+	assert.Equal(t, 15, len(retrievedData[tagName]), "deleted range is still visible")
+	assert.Equal(t, 15, sstForTag.StoredEntriesCount(), "deleted range was not removed from SST files")
+	for _, m := range retrievedData[tagName] {
+		assert.False(t, (m.Timestamp >= dummyData[5].Timestamp) && (m.Timestamp <= dummyData[14].Timestamp), "deleted measurement returned")
+	}
+}
+
+func TestLSM_StorageWriterDropsTag(t *testing.T) {
+	clPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	sstPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	storage := mustInit(InitStorage(testOptions(clPath, sstPath)))
+
+	dummyData := buildDummyData(25)
+	storage.Store(slice(dummyData, "dropped", 0, 25), 0)
+	storage.Store(slice(dummyData, "kept", 0, 5), 0)
+	storage.Flush()
+
+	//when
+	err := storage.DropTag("dropped")
+	tagsAfterDrop := storage.GetTags()
+	storage.Close()
+	storage = mustInit(InitStorage(testOptions(clPath, sstPath)))
+	defer storage.Close()
+
+	//then
+	assert.Nil(t, err, "tag was not dropped")
+	assert.Equal(t, []string{"kept"}, tagsAfterDrop, "dropped tag is still listed")
+	assert.Equal(t, []string{"kept"}, storage.GetTags(), "dropped tag reappeared after restart")
+	assert.Equal(t, 0, len(mustRetrieve(storage.Retrieve(toList("dropped"), 1336, 1500))["dropped"]), "dropped data returned")
+}
+
+func TestLSM_StorageIsReopenedWithoutLeaks(t *testing.T) {
+	//given
+	clPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	sstPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	const tagName = "whatever"
+	dummyData := buildDummyData(25)
+	storage := mustInit(InitStorage(testOptions(clPath, sstPath)))
+	storage.Store(slice(dummyData, tagName, 0, 5), 0)
+	storage.Close()
+	goroutinesBefore := runtime.NumGoroutine()
+	filesBefore := openFilesCount()
+
+	//when
+	for i := 1; i < 5; i++ {
+		storage = mustInit(InitStorage(testOptions(clPath, sstPath)))
+		storage.Store(slice(dummyData, tagName, i*5, i*5+5), 0)
+		assert.Nil(t, storage.Close(), "storage was not closed")
+	}
+	goroutinesAfter := runtime.NumGoroutine()
+	filesAfter := openFilesCount()
+	storage = mustInit(InitStorage(testOptions(clPath, sstPath)))
+	retrievedData := mustRetrieve(storage.Retrieve(toList(tagName), 1336, 1500))
+	storage.Close()
+	storeErr := storage.Store(slice(dummyData, tagName, 0, 5), 0)
+	_, retrieveErr := storage.Retrieve(toList(tagName), 1336, 1500)
+
+	//then
+	assert.Equal(t, len(dummyData), len(retrievedData[tagName]), "data was lost between the reopenings")
+	assert.LessOrEqual(t, goroutinesAfter, goroutinesBefore, "goroutines leaked")
+	assert.LessOrEqual(t, filesAfter, filesBefore, "files leaked")
+	assert.True(t, errors.Is(storeErr, ErrClosed), "store into closed storage was not rejected")
+	assert.True(t, errors.Is(retrieveErr, ErrClosed), "retrieve from closed storage was not rejected")
+	assert.True(t, errors.Is(storage.Flush(), ErrClosed), "flush of closed storage was not rejected")
+	assert.True(t, errors.Is(storage.Close(), ErrClosed), "closed storage was closed again")
+}
+
+func TestLSM_InitStorageReportsCorruptedCommitlog(t *testing.T) {
+	//given
+	clPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	sstPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	assert.Nil(t, os.MkdirAll(clPath, os.ModePerm))
+	assert.Nil(t, ioutil.WriteFile(clPath+"/commitlog-000001.log", []byte("GLSMCLOG\x63"), 0644))
+
+	//when
+	storage, err := InitStorage(testOptions(clPath, sstPath))
+
+	//then
+	assert.True(t, errors.Is(err, ErrCorrupted), "corrupted commitlog was not reported")
+	assert.Nil(t, storage, "storage returned over corrupted commitlog")
+}
+
 func randomTs(from uint64, to uint64) uint64 {
 	return uint64(rand.Float64()*float64(to-from) + float64(from))
 }
@@ -203,8 +346,43 @@ func sliceAndToBatch(data []dto.Measurement, tag string, from int, to int) []dto
 	return ans
 }
 
+func openFilesCount() int {
+	files, _ := ioutil.ReadDir("/proc/self/fd")
+	return len(files)
+}
+
+func mustInit(storage *Storage, err error) *Storage {
+	if err != nil {
+		panic(err)
+	}
+	return storage
+}
+
+func mustRetrieve(data map[string][]dto.Measurement, err error) map[string][]dto.Measurement {
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func entriesOnDisk(sstm *sst.Manager, tag string) []sst.Entry {
+	st, err := sstm.SstForTag(tag)
+	if err != nil {
+		panic(err)
+	}
+	entries, err := st.GetAllEntries()
+	if err != nil {
+		panic(err)
+	}
+	return entries
+}
+
 func toList(tag string) []string {
 	ans := make([]string, 1)
 	ans[0] = tag
 	return ans
 }
+
+func testOptions(clPath string, sstPath string) Options {
+	return Options{CommitlogPath: clPath, SstPath: sstPath, EntriesPerCommitlog: 10, PeriodBetweenFlushes: 1 * time.Second, MemtPerformExpirationEvery: 10 * time.Second, MemtPrefetch: 10 * time.Second, MemtMaxEntriesPerTag: 9999}
+}
@@ -0,0 +1,219 @@
+package golsm
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nikita-tomilov/golsm/commitlog"
+	"github.com/nikita-tomilov/golsm/errs"
+	"github.com/nikita-tomilov/golsm/memt"
+	"github.com/nikita-tomilov/golsm/sst"
+	"github.com/nikita-tomilov/golsm/writer"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+//Options configure every component of the storage; the zero values are replaced by the defaults of the components,
+//except for MemtPrefetch and Retention, where zero disables the prefetch and the expiration on disk
+type Options struct {
+	CommitlogPath string `yaml:"commitlogPath"`
+	SstPath       string `yaml:"sstPath"`
+
+	SyncPolicy              commitlog.SyncPolicy `yaml:"syncPolicy"`
+	SyncPeriod              time.Duration        `yaml:"syncPeriod"`
+	MaxCommitlogSegmentSize int64                `yaml:"maxCommitlogSegmentSize"`
+	MaxCommitlogSegmentAge  time.Duration        `yaml:"maxCommitlogSegmentAge"`
+
+	EntriesPerCommitlog  int           `yaml:"entriesPerCommitlog"`
+	PeriodBetweenFlushes time.Duration `yaml:"periodBetweenFlushes"`
+	MaxPendingSegments   int           `yaml:"maxPendingSegments"`
+
+	MemtMaxEntriesPerTag       int           `yaml:"memtMaxEntriesPerTag"`
+	MemtPerformExpirationEvery time.Duration `yaml:"memtPerformExpirationEvery"`
+	MemtPrefetch               time.Duration `yaml:"memtPrefetch"`
+
+	PerformCompactionEvery   time.Duration            `yaml:"performCompactionEvery"`
+	CompactionFanIn          int                      `yaml:"compactionFanIn"`
+	ExpiredFractionThreshold float64                  `yaml:"expiredFractionThreshold"`
+	PartitionWindow          time.Duration            `yaml:"partitionWindow"`
+	PartitionWindowPerTag    map[string]time.Duration `yaml:"partitionWindowPerTag"`
+	Retention                time.Duration            `yaml:"retention"`
+	Codec                    sst.Codec                `yaml:"-"`
+	CodecPerTag              map[string]sst.Codec     `yaml:"-"`
+	BlockSize                int                      `yaml:"blockSize"`
+	MaxOpenFiles             int                      `yaml:"maxOpenFiles"`
+	MemoryMapped             bool                     `yaml:"memoryMapped"`
+}
+
+//the config file has the same keys as the Options, with the codecs given by name
+type optionsFile struct {
+	plainOptions `yaml:",inline"`
+	Codec        string            `yaml:"codec"`
+	CodecPerTag  map[string]string `yaml:"codecPerTag"`
+}
+
+type plainOptions Options
+
+//LoadOptions reads the options from a YAML or JSON file; the durations are written as "10s", the sync policy
+//as every-batch, periodically or never, and the codecs as none, flate, gzip or gorilla.
+//Unknown keys are rejected, so that a misspelled option is not silently replaced by its default
+func LoadOptions(fileName string) (Options, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return Options{}, errs.IO("read options", err)
+	}
+	var file optionsFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return Options{}, fmt.Errorf("%w: %s: %v", ErrInvalidOptions, fileName, err)
+	}
+
+	options := Options(file.plainOptions)
+	if file.Codec != "" {
+		options.Codec, err = sst.CodecByName(file.Codec)
+		if err != nil {
+			return Options{}, fmt.Errorf("%w: %v", ErrInvalidOptions, err)
+		}
+	}
+	if file.CodecPerTag != nil {
+		options.CodecPerTag = make(map[string]sst.Codec)
+		for tag, name := range file.CodecPerTag {
+			options.CodecPerTag[tag], err = sst.CodecByName(name)
+			if err != nil {
+				return Options{}, fmt.Errorf("%w: codec of tag %s: %v", ErrInvalidOptions, tag, err)
+			}
+		}
+	}
+	return options, options.Validate()
+}
+
+//WithDefaults returns the options with every unset value replaced by the default of the component
+func (o Options) WithDefaults() Options {
+	if o.SyncPeriod == 0 {
+		o.SyncPeriod = commitlog.DefaultSyncPeriod
+	}
+	if o.MaxCommitlogSegmentSize == 0 {
+		o.MaxCommitlogSegmentSize = commitlog.DefaultMaxSegmentSize
+	}
+	if o.MaxCommitlogSegmentAge == 0 {
+		o.MaxCommitlogSegmentAge = commitlog.DefaultMaxSegmentAge
+	}
+	if o.EntriesPerCommitlog == 0 {
+		o.EntriesPerCommitlog = writer.DefaultEntriesPerCommitlog
+	}
+	if o.PeriodBetweenFlushes == 0 {
+		o.PeriodBetweenFlushes = writer.DefaultPeriodBetweenFlushes
+	}
+	if o.MaxPendingSegments == 0 {
+		o.MaxPendingSegments = writer.DefaultMaxPendingSegments
+	}
+	if o.MemtMaxEntriesPerTag == 0 {
+		o.MemtMaxEntriesPerTag = memt.DefaultMaxEntriesPerTag
+	}
+	if o.MemtPerformExpirationEvery == 0 {
+		o.MemtPerformExpirationEvery = memt.DefaultPerformExpirationEvery
+	}
+	if o.PerformCompactionEvery == 0 {
+		o.PerformCompactionEvery = sst.DefaultPerformCompactionEvery
+	}
+	if o.CompactionFanIn == 0 {
+		o.CompactionFanIn = sst.DefaultCompactionFanIn
+	}
+	if o.ExpiredFractionThreshold == 0 {
+		o.ExpiredFractionThreshold = sst.DefaultExpiredFractionThreshold
+	}
+	if o.PartitionWindow == 0 {
+		o.PartitionWindow = sst.DefaultPartitionWindow
+	}
+	if o.Codec == nil {
+		o.Codec = sst.DefaultCodec
+	}
+	if o.BlockSize == 0 {
+		o.BlockSize = sst.DefaultBlockSize
+	}
+	if o.MaxOpenFiles == 0 {
+		o.MaxOpenFiles = sst.DefaultMaxOpenFiles
+	}
+	return o
+}
+
+//Validate reports the first invalid option as ErrInvalidOptions; the unset values are valid, as they get the defaults
+func (o Options) Validate() error {
+	if o.CommitlogPath == "" {
+		return invalidOption("commitlogPath", "is not set")
+	}
+	if o.SstPath == "" {
+		return invalidOption("sstPath", "is not set")
+	}
+	if _, err := o.SyncPolicy.MarshalText(); err != nil {
+		return invalidOption("syncPolicy", err.Error())
+	}
+	if (o.ExpiredFractionThreshold < 0) || (o.ExpiredFractionThreshold > 1) {
+		return invalidOption("expiredFractionThreshold", "is not within [0, 1]")
+	}
+
+	//checked in order, so that the same invalid option is reported every time
+	notNegative := []struct {
+		name  string
+		value int64
+	}{
+		{"syncPeriod", int64(o.SyncPeriod)},
+		{"maxCommitlogSegmentSize", o.MaxCommitlogSegmentSize},
+		{"maxCommitlogSegmentAge", int64(o.MaxCommitlogSegmentAge)},
+		{"entriesPerCommitlog", int64(o.EntriesPerCommitlog)},
+		{"periodBetweenFlushes", int64(o.PeriodBetweenFlushes)},
+		{"maxPendingSegments", int64(o.MaxPendingSegments)},
+		{"memtMaxEntriesPerTag", int64(o.MemtMaxEntriesPerTag)},
+		{"memtPerformExpirationEvery", int64(o.MemtPerformExpirationEvery)},
+		{"memtPrefetch", int64(o.MemtPrefetch)},
+		{"performCompactionEvery", int64(o.PerformCompactionEvery)},
+		{"compactionFanIn", int64(o.CompactionFanIn)},
+		{"partitionWindow", int64(o.PartitionWindow)},
+		{"retention", int64(o.Retention)},
+		{"blockSize", int64(o.BlockSize)},
+		{"maxOpenFiles", int64(o.MaxOpenFiles)},
+	}
+	for _, option := range notNegative {
+		if option.value < 0 {
+			return invalidOption(option.name, "is negative")
+		}
+	}
+	if o.CompactionFanIn == 1 {
+		return invalidOption("compactionFanIn", "must be at least 2")
+	}
+	//the partitions are aligned to whole milliseconds
+	if (o.PartitionWindow > 0) && (o.PartitionWindow < time.Millisecond) {
+		return invalidOption("partitionWindow", "is less than a millisecond")
+	}
+	windowTags := make([]string, 0, len(o.PartitionWindowPerTag))
+	for tag := range o.PartitionWindowPerTag {
+		windowTags = append(windowTags, tag)
+	}
+	sort.Strings(windowTags)
+	for _, tag := range windowTags {
+		window := o.PartitionWindowPerTag[tag]
+		if window <= 0 {
+			return invalidOption("partitionWindowPerTag", fmt.Sprintf("is not positive for tag %s", tag))
+		}
+		if window < time.Millisecond {
+			return invalidOption("partitionWindowPerTag", fmt.Sprintf("is less than a millisecond for tag %s", tag))
+		}
+	}
+	codecTags := make([]string, 0, len(o.CodecPerTag))
+	for tag := range o.CodecPerTag {
+		codecTags = append(codecTags, tag)
+	}
+	sort.Strings(codecTags)
+	for _, tag := range codecTags {
+		if o.CodecPerTag[tag] == nil {
+			return invalidOption("codecPerTag", fmt.Sprintf("is not set for tag %s", tag))
+		}
+	}
+	return nil
+}
+
+func invalidOption(name string, problem string) error {
+	return fmt.Errorf("%w: %s %s", ErrInvalidOptions, name, problem)
+}
@@ -0,0 +1,137 @@
+package golsm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nikita-tomilov/golsm/commitlog"
+	"github.com/nikita-tomilov/golsm/sst"
+	"github.com/nikita-tomilov/golsm/utils"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOptions_AreLoadedFromYamlAndJson(t *testing.T) {
+	//given
+	dir := fmt.Sprintf("/tmp/golsm_test/options/config-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	assert.Nil(t, os.MkdirAll(dir, os.ModePerm))
+	yamlConfig := `
+commitlogPath: /var/lib/golsm/commitlog
+sstPath: /var/lib/golsm/sst
+syncPolicy: periodically
+syncPeriod: 50ms
+entriesPerCommitlog: 500
+periodBetweenFlushes: 2s
+memtPrefetch: 1h
+partitionWindowPerTag:
+  hourly: 1h
+codec: gorilla
+codecPerTag:
+  logs: gzip
+`
+	jsonConfig := `{
+	"commitlogPath": "/var/lib/golsm/commitlog",
+	"sstPath": "/var/lib/golsm/sst",
+	"syncPolicy": "periodically",
+	"syncPeriod": "50ms",
+	"entriesPerCommitlog": 500,
+	"periodBetweenFlushes": "2s",
+	"memtPrefetch": "1h",
+	"partitionWindowPerTag": {"hourly": "1h"},
+	"codec": "gorilla",
+	"codecPerTag": {"logs": "gzip"}
+}`
+	assert.Nil(t, ioutil.WriteFile(dir+"/golsm.yaml", []byte(yamlConfig), 0644))
+	assert.Nil(t, ioutil.WriteFile(dir+"/golsm.json", []byte(jsonConfig), 0644))
+	expected := Options{
+		CommitlogPath:         "/var/lib/golsm/commitlog",
+		SstPath:               "/var/lib/golsm/sst",
+		SyncPolicy:            commitlog.SyncPeriodically,
+		SyncPeriod:            50 * time.Millisecond,
+		EntriesPerCommitlog:   500,
+		PeriodBetweenFlushes:  2 * time.Second,
+		MemtPrefetch:          time.Hour,
+		PartitionWindowPerTag: map[string]time.Duration{"hourly": time.Hour},
+		Codec:                 sst.CodecGorilla,
+		CodecPerTag:           map[string]sst.Codec{"logs": sst.CodecGzip},
+	}
+
+	//when
+	fromYaml, yamlErr := LoadOptions(dir + "/golsm.yaml")
+	fromJson, jsonErr := LoadOptions(dir + "/golsm.json")
+
+	//then
+	assert.Nil(t, yamlErr, "yaml config was not loaded")
+	assert.Nil(t, jsonErr, "json config was not loaded")
+	assert.Equal(t, expected, fromYaml, "yaml config was loaded incorrectly")
+	assert.Equal(t, expected, fromJson, "json config was loaded incorrectly")
+}
+
+func TestOptions_InvalidOptionsAreRejected(t *testing.T) {
+	//given
+	dir := fmt.Sprintf("/tmp/golsm_test/options/config-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	assert.Nil(t, os.MkdirAll(dir, os.ModePerm))
+	configs := map[string]string{
+		"misspelled.yaml": "commitlogPath: /tmp/cl\nsstPath: /tmp/sst\nentriesPerComitlog: 10\n",
+		"codec.yaml":      "commitlogPath: /tmp/cl\nsstPath: /tmp/sst\ncodec: zstd\n",
+		"policy.yaml":     "commitlogPath: /tmp/cl\nsstPath: /tmp/sst\nsyncPolicy: sometimes\n",
+		"duration.yaml":   "commitlogPath: /tmp/cl\nsstPath: /tmp/sst\nsyncPeriod: 10\n",
+	}
+	for name, config := range configs {
+		assert.Nil(t, ioutil.WriteFile(dir+"/"+name, []byte(config), 0644))
+	}
+	valid := Options{CommitlogPath: "/tmp/cl", SstPath: "/tmp/sst"}
+	invalid := []Options{
+		{SstPath: "/tmp/sst"},
+		{CommitlogPath: "/tmp/cl", SstPath: "/tmp/sst", EntriesPerCommitlog: -1},
+		{CommitlogPath: "/tmp/cl", SstPath: "/tmp/sst", PeriodBetweenFlushes: -time.Second},
+		{CommitlogPath: "/tmp/cl", SstPath: "/tmp/sst", ExpiredFractionThreshold: 1.5},
+		{CommitlogPath: "/tmp/cl", SstPath: "/tmp/sst", CompactionFanIn: 1},
+		{CommitlogPath: "/tmp/cl", SstPath: "/tmp/sst", SyncPolicy: commitlog.SyncPolicy(42)},
+		{CommitlogPath: "/tmp/cl", SstPath: "/tmp/sst", PartitionWindowPerTag: map[string]time.Duration{"tag": 0}},
+		{CommitlogPath: "/tmp/cl", SstPath: "/tmp/sst", PartitionWindow: time.Microsecond},
+		{CommitlogPath: "/tmp/cl", SstPath: "/tmp/sst", PartitionWindowPerTag: map[string]time.Duration{"tag": time.Microsecond}},
+	}
+
+	//when
+	withDefaults := valid.WithDefaults()
+
+	//then
+	assert.Nil(t, valid.Validate(), "unset options were not accepted")
+	assert.Nil(t, withDefaults.Validate(), "defaults are not valid")
+	assert.Equal(t, sst.DefaultCodec, withDefaults.Codec, "default codec was not applied")
+	assert.Equal(t, sst.DefaultPartitionWindow, withDefaults.PartitionWindow, "default partition window was not applied")
+	assert.Equal(t, time.Duration(0), withDefaults.Retention, "retention was enabled by default")
+	for _, options := range invalid {
+		assert.True(t, errors.Is(options.Validate(), ErrInvalidOptions), fmt.Sprintf("invalid options %+v were accepted", options))
+	}
+	for name := range configs {
+		_, err := LoadOptions(dir + "/" + name)
+		assert.True(t, errors.Is(err, ErrInvalidOptions), fmt.Sprintf("invalid config %s was accepted", name))
+	}
+	_, err := InitStorage(invalid[0])
+	assert.True(t, errors.Is(err, ErrInvalidOptions), "storage was started with invalid options")
+}
+
+func TestOptions_FirstInvalidOptionIsReported(t *testing.T) {
+	//given
+	options := Options{CommitlogPath: "/tmp/cl", SstPath: "/tmp/sst", SyncPeriod: -time.Second, BlockSize: -1, MaxOpenFiles: -1,
+		PartitionWindowPerTag: map[string]time.Duration{"tagOne": 0, "tagTwo": 0, "tagZero": 0}}
+	perTag := Options{CommitlogPath: "/tmp/cl", SstPath: "/tmp/sst", PartitionWindowPerTag: options.PartitionWindowPerTag}
+
+	//when
+	errs := make([]string, 0)
+	perTagErrs := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		errs = append(errs, options.Validate().Error())
+		perTagErrs = append(perTagErrs, perTag.Validate().Error())
+	}
+
+	//then
+	for i := range errs {
+		assert.Contains(t, errs[i], "syncPeriod", "another invalid option was reported")
+		assert.Contains(t, perTagErrs[i], "tagOne", "another invalid tag was reported")
+	}
+}
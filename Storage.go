@@ -0,0 +1,29 @@
+package golsm
+
+import (
+	"github.com/nikita-tomilov/golsm/memt"
+	"github.com/nikita-tomilov/golsm/writer"
+)
+
+//Storage is the LSM storage returned by InitStorage; it is read and written through the embedded StorageReader and StorageWriter
+//until Close, after which the calls return ErrClosed
+type Storage struct {
+	*StorageReader
+	*StorageWriter
+	diskWriter *writer.DiskWriter
+	memTable   *memt.Manager
+}
+
+//Flush makes everything stored before the call reach SST
+func (s *Storage) Flush() error {
+	return s.diskWriter.Flush()
+}
+
+//Close flushes the storage, stops all of its background workers, waiting for the merges in progress, and closes its files
+func (s *Storage) Close() error {
+	err := s.diskWriter.Close()
+	if closeErr := s.memTable.CloseStorage(); (closeErr != nil) && (err == nil) {
+		err = closeErr
+	}
+	return err
+}
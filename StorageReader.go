@@ -17,53 +17,94 @@ type StorageReader struct {
 	mutex      *sync.Mutex
 }
 
-func (sr *StorageReader) Init() {
+func (sr *StorageReader) Init() error {
 	sr.mutex = &sync.Mutex{}
 	if (len(sr.SSTManager.GetTags()) > 0) && (sr.MemtPrefetch.Milliseconds() > 0) {
 		//i was initialized over existing storage; should prefetch some data to memt
-		sr.prefetch()
+		return sr.prefetch()
 	}
+	return nil
 }
 
-func (sr *StorageReader) prefetch() {
-	availFrom, availTo := sr.SSTManager.Availability()
+func (sr *StorageReader) prefetch() error {
+	availFrom, availTo, err := sr.SSTManager.Availability()
+	if err != nil {
+		return err
+	}
 	if (availTo == 0) || (availFrom == 0) {
-		return
+		return nil
 	}
 
 	from := maxNotZero(availFrom, uint64(int64(availTo) - sr.MemtPrefetch.Milliseconds()))
 	to := availTo
 	tags := sr.SSTManager.GetTags()
-	data := sr.retrieveFromSSTOnly(tags, from, to)
+	data, err := sr.retrieveFromSSTOnly(tags, from, to)
+	if err != nil {
+		return err
+	}
 
-	sr.MemTable.MergeWithPrefetched(data)
+	return sr.MemTable.MergeWithPrefetched(data)
 }
 
-func (sr *StorageReader) Retrieve(tags []string, from uint64, to uint64) map[string][]dto.Measurement {
+//Retrieve reads the tags as of the start of the call: the memtables are copied first and the SST segments pinned afterwards,
+//so that no flush happening meanwhile is seen twice or missed, and no compaction removes the files being read
+func (sr *StorageReader) Retrieve(tags []string, from uint64, to uint64) (map[string][]dto.Measurement, error) {
 	ans := make(map[string][]dto.Measurement)
 
+	memtSnapshots := make([]*memt.MemTforTag, len(tags))
+	for i, tag := range tags {
+		memtSnapshots[i] = sr.MemTable.MemTableForTag(tag).Snapshot()
+	}
+	sstSnapshots := make([]*sst.Snapshot, 0, len(tags))
+	defer func() {
+		for _, snapshot := range sstSnapshots {
+			snapshot.Release()
+		}
+	}()
 	for _, tag := range tags {
-		ans[tag] = sr.retrieveDataForTag(tag, from, to)
+		sstForTag, err := sr.SSTManager.SstForTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		sstSnapshots = append(sstSnapshots, sstForTag.Snapshot())
+	}
+
+	for i, tag := range tags {
+		data, err := sr.retrieveDataForTag(memtSnapshots[i], sstSnapshots[i], from, to)
+		if err != nil {
+			return nil, err
+		}
+		ans[tag] = data
 	}
 
-	return ans
+	return ans, nil
 }
 
-func (sr *StorageReader) retrieveFromSSTOnly(tags []string, from uint64, to uint64) map[string][]dto.Measurement {
+func (sr *StorageReader) retrieveFromSSTOnly(tags []string, from uint64, to uint64) (map[string][]dto.Measurement, error) {
 	ans := make(map[string][]dto.Measurement)
 
 	for _, tag := range tags {
-		ans[tag] = sr.retrieveDataForTagFromSSTableOnly(tag, from, to)
+		data, err := sr.retrieveDataForTagFromSSTableOnly(tag, from, to)
+		if err != nil {
+			return nil, err
+		}
+		ans[tag] = data
 	}
 
-	return ans
+	return ans, nil
 }
 
-func (sr *StorageReader) Availability() (uint64, uint64) {
-	fromForMem, toForMem := sr.MemTable.Availability()
-	fromForSst, toForSst := sr.SSTManager.Availability()
+func (sr *StorageReader) Availability() (uint64, uint64, error) {
+	fromForMem, toForMem, err := sr.MemTable.Availability()
+	if err != nil {
+		return 0, 0, err
+	}
+	fromForSst, toForSst, err := sr.SSTManager.Availability()
+	if err != nil {
+		return 0, 0, err
+	}
 
-	return minNotZero(fromForMem, fromForSst), maxNotZero(toForMem, toForSst)
+	return minNotZero(fromForMem, fromForSst), maxNotZero(toForMem, toForSst), nil
 }
 
 func (sr *StorageReader) GetTags() []string {
@@ -92,11 +133,17 @@ func maxNotZero(a uint64, b uint64) uint64 {
 	return b
 }
 
-func (sr *StorageReader) retrieveDataForTagFromSSTableOnly(tag string, from uint64, to uint64) []dto.Measurement {
-	sstForTag := sr.SSTManager.SstForTag(tag)
+func (sr *StorageReader) retrieveDataForTagFromSSTableOnly(tag string, from uint64, to uint64) ([]dto.Measurement, error) {
+	sstForTag, err := sr.SSTManager.SstForTag(tag)
+	if err != nil {
+		return nil, err
+	}
 	timestampToValue := make(map[uint64][]byte)
 
-	dataFromSst := sstForTag.GetEntriesWithIndex(from, to)
+	dataFromSst, err := sstForTag.GetEntriesWithIndex(from, to)
+	if err != nil {
+		return nil, err
+	}
 
 	for _, dfs := range dataFromSst {
 		timestampToValue[dfs.Timestamp] = dfs.Value
@@ -113,18 +160,15 @@ func (sr *StorageReader) retrieveDataForTagFromSSTableOnly(tag string, from uint
 		return ans[i].Timestamp < ans[j].Timestamp
 	})
 
-	return ans
+	return ans, nil
 }
 
-func (sr *StorageReader) retrieveDataForTag(tag string, from uint64, to uint64) []dto.Measurement {
-	memtForTag := sr.MemTable.MemTableForTag(tag)
-	sstForTag := sr.SSTManager.SstForTag(tag)
-
+func (sr *StorageReader) retrieveDataForTag(memtForTag *memt.MemTforTag, sstForTag *sst.Snapshot, from uint64, to uint64) ([]dto.Measurement, error) {
 	timestampToValue := make(map[uint64][]byte)
 	var dataFromMemt []memt.Entry
 
 	if memtForTag == nil {
-		return nil
+		return nil, nil
 	}
 
 	availMemtFrom, availMemtTo := memtForTag.Availability()
@@ -135,10 +179,15 @@ func (sr *StorageReader) retrieveDataForTag(tag string, from uint64, to uint64)
 
 	if (availMemtFrom > from) || (availMemtTo < to) || (availMemtFrom == 0) || (availMemtTo == 0) {
 		if sstForTag != nil {
-			dataFromSst := sstForTag.GetEntriesWithIndex(from, to)
+			dataFromSst, err := sstForTag.GetEntriesWithIndex(from, to)
+			if err != nil {
+				return nil, err
+			}
 
 			for _, dfs := range dataFromSst {
-				timestampToValue[dfs.Timestamp] = dfs.Value
+				if !memtForTag.IsDeleted(dfs.Timestamp) {
+					timestampToValue[dfs.Timestamp] = sstForTag.Detached(dfs.Value)
+				}
 			}
 		}
 	}
@@ -158,5 +207,5 @@ func (sr *StorageReader) retrieveDataForTag(tag string, from uint64, to uint64)
 		return ans[i].Timestamp < ans[j].Timestamp
 	})
 
-	return ans
+	return ans, nil
 }
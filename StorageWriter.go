@@ -18,19 +18,20 @@ func (sw *StorageWriter) Init() {
 	sw.mutex = &sync.Mutex{}
 }
 
-func (sw *StorageWriter) Store(data map[string][]dto.Measurement, expiresAt uint64) {
+func (sw *StorageWriter) Store(data map[string][]dto.Measurement, expiresAt uint64) error {
+	entriesPerTag := make(map[string][]commitlog.Entry)
 	for tag, values := range data {
 		entries := make([]commitlog.Entry, len(values))
 		for i, value := range values {
 			e := commitlog.Entry{Key: []byte(tag), Timestamp: value.Timestamp, ExpiresAt: expiresAt, Value: value.Value}
 			entries[i] = e
 		}
-		sw.DiskWriter.StoreMultiple(entries)
-		sw.MemTable.MergeWithCommitlogForTag(tag, entries)
+		entriesPerTag[tag] = entries
 	}
+	return sw.storeEntriesPerTag(entriesPerTag)
 }
 
-func (sw *StorageWriter) StoreBatch(data []dto.TaggedMeasurement, expiresAt uint64) {
+func (sw *StorageWriter) StoreBatch(data []dto.TaggedMeasurement, expiresAt uint64) error {
 	entriesPerTag := make(map[string][]commitlog.Entry)
 
 	for _, entry := range data {
@@ -41,9 +42,41 @@ func (sw *StorageWriter) StoreBatch(data []dto.TaggedMeasurement, expiresAt uint
 		}
 		entriesPerTag[entry.Tag] = append(entries, commitlog.Entry{Key: []byte(entry.Tag), Timestamp: entry.Timestamp, ExpiresAt: expiresAt, Value: entry.Value})
 	}
+	return sw.storeEntriesPerTag(entriesPerTag)
+}
+
+//Delete removes the data of the tag within [from, to]; it is hidden from the readers right away
+//and dropped from the disk by the next compaction of SST
+func (sw *StorageWriter) Delete(tag string, from uint64, to uint64) error {
+	entriesPerTag := make(map[string][]commitlog.Entry)
+	entriesPerTag[tag] = []commitlog.Entry{commitlog.NewTombstone([]byte(tag), from, to)}
+	return sw.storeEntriesPerTag(entriesPerTag)
+}
+
+//DropTag removes all the data of the tag; the tag does not reappear after a restart
+func (sw *StorageWriter) DropTag(tag string) error {
+	if err := sw.DiskWriter.DropTag(tag); err != nil {
+		return err
+	}
+	sw.MemTable.DropTag(tag)
+	return nil
+}
+
+//everything is validated first so that an oversized value does not leave the data partially stored, and all the tags
+//go to the commitlog with a single append, so that the batch is either stored as a whole or not at all
+func (sw *StorageWriter) storeEntriesPerTag(entriesPerTag map[string][]commitlog.Entry) error {
+	batch := make([]commitlog.Entry, 0)
+	for _, entries := range entriesPerTag {
+		for _, entry := range entries {
+			if err := entry.Validate(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, entries...)
+	}
 
-	for tag, entries := range entriesPerTag {
-		sw.DiskWriter.StoreMultiple(entries)
-		sw.MemTable.MergeWithCommitlogForTag(tag, entries)
+	if err := sw.DiskWriter.StoreMultiple(batch); err != nil {
+		return err
 	}
+	return sw.MemTable.MergeWithCommitlog(batch)
 }
@@ -0,0 +1,152 @@
+package commitlog
+
+import (
+	"fmt"
+	"github.com/nikita-tomilov/golsm/errs"
+	"sync"
+	"time"
+)
+
+type SyncPolicy int
+
+const (
+	//every StoreMultiple call is fsync'ed before returning
+	SyncEveryBatch SyncPolicy = iota
+	//writes are fsync'ed together every SyncPeriod; StoreMultiple waits for the next sync
+	SyncPeriodically
+	//writes are left to the OS page cache
+	SyncNever
+)
+
+const DefaultSyncPeriod = 10 * time.Millisecond
+
+var syncPolicyNames = map[SyncPolicy]string{SyncEveryBatch: "every-batch", SyncPeriodically: "periodically", SyncNever: "never"}
+
+func (p SyncPolicy) String() string {
+	name, known := syncPolicyNames[p]
+	if !known {
+		return fmt.Sprintf("SyncPolicy(%d)", int(p))
+	}
+	return name
+}
+
+//MarshalText and UnmarshalText let the policy be written by name in the config files
+func (p SyncPolicy) MarshalText() ([]byte, error) {
+	name, known := syncPolicyNames[p]
+	if !known {
+		return nil, fmt.Errorf("unknown sync policy %d", int(p))
+	}
+	return []byte(name), nil
+}
+
+func (p *SyncPolicy) UnmarshalText(text []byte) error {
+	for policy, name := range syncPolicyNames {
+		if name == string(text) {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown sync policy %q", string(text))
+}
+
+var errManagerClosed = errs.Closed("commitlog manager")
+
+type durabilityTracker struct {
+	mutex      *sync.Mutex
+	cond       *sync.Cond
+	writtenSeq uint64
+	syncedSeq  uint64
+	syncErr    error
+	closed     bool
+	closing    bool
+	stop       chan struct{}
+	stopped    chan struct{}
+}
+
+func newDurabilityTracker() *durabilityTracker {
+	mutex := &sync.Mutex{}
+	return &durabilityTracker{mutex: mutex, cond: sync.NewCond(mutex), stop: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+func (d *durabilityTracker) markWritten() uint64 {
+	d.mutex.Lock()
+	d.writtenSeq++
+	seq := d.writtenSeq
+	d.mutex.Unlock()
+	return seq
+}
+
+func (d *durabilityTracker) markSynced(seq uint64, err error) {
+	d.mutex.Lock()
+	if seq > d.syncedSeq {
+		d.syncedSeq = seq
+	}
+	if (err != nil) && (d.syncErr == nil) {
+		d.syncErr = err
+	}
+	d.cond.Broadcast()
+	d.mutex.Unlock()
+}
+
+//once the fsync has failed, the state of the file is unknown, so the error sticks
+func (d *durabilityTracker) failure() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if (d.syncErr == nil) && d.closed {
+		return errManagerClosed
+	}
+	return d.syncErr
+}
+
+func (d *durabilityTracker) awaitSynced(seq uint64) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for (d.syncedSeq < seq) && (d.syncErr == nil) && !d.closed {
+		d.cond.Wait()
+	}
+	if d.syncErr != nil {
+		return d.syncErr
+	}
+	if d.syncedSeq < seq {
+		return errManagerClosed
+	}
+	return nil
+}
+
+func (d *durabilityTracker) pending() (uint64, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.writtenSeq, d.writtenSeq > d.syncedSeq
+}
+
+func (d *durabilityTracker) runEvery(period time.Duration, f func()) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	defer close(d.stopped)
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			f()
+		}
+	}
+}
+
+//startClosing tells whether the caller is the first one to close the tracker
+func (d *durabilityTracker) startClosing() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closing {
+		return false
+	}
+	d.closing = true
+	return true
+}
+
+func (d *durabilityTracker) close() {
+	d.mutex.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mutex.Unlock()
+}
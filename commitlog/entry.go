@@ -3,6 +3,32 @@ package commitlog
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const MaxKeySize = 1024 * 1024
+
+const MaxValueSize = 64 * 1024 * 1024
+
+var ErrKeyTooLarge = errors.New("commitlog entry key is too large")
+
+var ErrValueTooLarge = errors.New("commitlog entry value is too large")
+
+var ErrInvalidTombstone = errors.New("commitlog tombstone is invalid")
+
+var ErrUnknownEntryKind = errors.New("commitlog entry kind is unknown")
+
+const entryFixedSize = 4 + 8 + 8
+
+type EntryKind byte
+
+const (
+	KindPut EntryKind = iota
+	//KindTombstone deletes the data of the key from Timestamp to the timestamp stored in the Value, both inclusive
+	KindTombstone
+	//KindDropTag deletes all the data of the key written before it
+	KindDropTag
 )
 
 type Entry struct {
@@ -10,6 +36,40 @@ type Entry struct {
 	Timestamp uint64
 	ExpiresAt uint64
 	Value     []byte
+	Kind      EntryKind
+}
+
+func NewTombstone(key []byte, from uint64, to uint64) Entry {
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, to)
+	return Entry{Key: key, Timestamp: from, Value: value, Kind: KindTombstone}
+}
+
+func NewDropRecord(key []byte) Entry {
+	return Entry{Key: key, Kind: KindDropTag}
+}
+
+func (e *Entry) IsTombstone() bool {
+	return e.Kind == KindTombstone
+}
+
+func (e *Entry) IsDropRecord() bool {
+	return e.Kind == KindDropTag
+}
+
+//AfterLastDrop returns the entries following the last drop record and whether there was any
+func AfterLastDrop(entries []Entry) ([]Entry, bool) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].IsDropRecord() {
+			return entries[i+1:], true
+		}
+	}
+	return entries, false
+}
+
+//TombstoneRange returns the inclusive range of the timestamps deleted by the tombstone
+func (e *Entry) TombstoneRange() (uint64, uint64) {
+	return e.Timestamp, binary.LittleEndian.Uint64(e.Value)
 }
 
 func (e *Entry) ToString() string {
@@ -20,7 +80,42 @@ func (e *Entry) ToString() string {
 	return string(b)
 }
 
+func (e *Entry) Validate() error {
+	if len(e.Key) > MaxKeySize {
+		return fmt.Errorf("%w: %d bytes, at most %d allowed", ErrKeyTooLarge, len(e.Key), MaxKeySize)
+	}
+	if len(e.Value) > MaxValueSize {
+		return fmt.Errorf("%w: %d bytes for key %s, at most %d allowed", ErrValueTooLarge, len(e.Value), string(e.Key), MaxValueSize)
+	}
+	if e.IsTombstone() {
+		if len(e.Value) != 8 {
+			return fmt.Errorf("%w: range end of %d bytes for key %s", ErrInvalidTombstone, len(e.Value), string(e.Key))
+		}
+		if from, to := e.TombstoneRange(); from > to {
+			return fmt.Errorf("%w: range %d-%d for key %s", ErrInvalidTombstone, from, to, string(e.Key))
+		}
+	} else if (e.Kind != KindPut) && (e.Kind != KindDropTag) {
+		return fmt.Errorf("%w: %d for key %s", ErrUnknownEntryKind, e.Kind, string(e.Key))
+	}
+	return nil
+}
+
 func FromByteArray(arr []uint8) Entry {
+	keyLen := binary.LittleEndian.Uint32(arr)
+	key := arr[4:(keyLen + 4)]
+	timestamp := binary.LittleEndian.Uint64(arr[(keyLen + 4):])
+	expiresAt := binary.LittleEndian.Uint64(arr[(keyLen + 12):])
+	value := arr[(keyLen + 20):]
+	return Entry{
+		Key:       key,
+		Timestamp: timestamp,
+		ExpiresAt: expiresAt,
+		Value:     value,
+	}
+}
+
+//fromLegacyByteArray parses the entry written with uint16 key length by the format versions before 2
+func fromLegacyByteArray(arr []uint8) Entry {
 	keyLen := binary.LittleEndian.Uint16(arr)
 	key := arr[2:(keyLen + 2)]
 	timestamp := binary.LittleEndian.Uint64(arr[(keyLen + 2):])
@@ -36,19 +131,19 @@ func FromByteArray(arr []uint8) Entry {
 
 func (e *Entry) ToByteArray() []uint8 {
 	keyLen := len(e.Key)
-	payloadLen := keyLen + len(e.Value) + 8 + 8 + 2
+	payloadLen := keyLen + len(e.Value) + entryFixedSize
 	arr := make([]byte, payloadLen)
-	binary.LittleEndian.PutUint16(arr, uint16(keyLen))
-	copy(arr[2:], e.Key)
-	binary.LittleEndian.PutUint64(arr[(keyLen + 2):], e.Timestamp)
-	binary.LittleEndian.PutUint64(arr[(keyLen + 10):], e.ExpiresAt)
-	copy(arr[(keyLen + 18):], e.Value)
+	binary.LittleEndian.PutUint32(arr, uint32(keyLen))
+	copy(arr[4:], e.Key)
+	binary.LittleEndian.PutUint64(arr[(keyLen + 4):], e.Timestamp)
+	binary.LittleEndian.PutUint64(arr[(keyLen + 12):], e.ExpiresAt)
+	copy(arr[(keyLen + 20):], e.Value)
 	return arr
 }
 
 func (e *Entry) ToByteArrayWithLength() []uint8 {
-	dest := make([]byte, 2)
+	dest := make([]byte, 4)
 	arr := e.ToByteArray()
-	binary.LittleEndian.PutUint16(dest, uint16(len(arr)))
+	binary.LittleEndian.PutUint32(dest, uint32(len(arr)))
 	return append(dest[:], arr[:]...)
 }
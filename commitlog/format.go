@@ -0,0 +1,121 @@
+package commitlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+//version 1 had uint16 record and key lengths; version 2 has uint32 ones; version 3 prefixes the payload with the entry kind
+const formatVersion = 3
+
+var fileMagic = []byte("GLSMCLOG")
+
+type recordFormat struct {
+	lengthSize    int
+	hasChecksum   bool
+	keyLengthSize int
+	hasKind       bool
+}
+
+//legacyFormat is the one of the commitlogs written before the file header was introduced
+var legacyFormat = recordFormat{lengthSize: 2, hasChecksum: false, keyLengthSize: 2}
+
+var recordFormats = map[byte]recordFormat{
+	1: {lengthSize: 2, hasChecksum: true, keyLengthSize: 2},
+	2: {lengthSize: 4, hasChecksum: true, keyLengthSize: 4},
+	3: {lengthSize: 4, hasChecksum: true, keyLengthSize: 4, hasKind: true},
+}
+
+func fileHeader() []byte {
+	return append(append([]byte{}, fileMagic...), formatVersion)
+}
+
+func fileHeaderSize() int {
+	return len(fileMagic) + 1
+}
+
+func hasFileHeader(data []byte) bool {
+	return (len(data) >= fileHeaderSize()) && bytes.Equal(data[:len(fileMagic)], fileMagic)
+}
+
+//formatOf returns the record format of the commitlog file contents starting with the header
+func formatOf(data []byte) (recordFormat, bool) {
+	f, known := recordFormats[data[len(fileMagic)]]
+	return f, known
+}
+
+func encodeRecord(e Entry) []byte {
+	payload := append([]byte{byte(e.Kind)}, e.ToByteArray()...)
+	arr := make([]byte, 8+len(payload))
+	binary.LittleEndian.PutUint32(arr, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(arr[4:], crc32.ChecksumIEEE(payload))
+	copy(arr[8:], payload)
+	return arr
+}
+
+func (f recordFormat) headerSize() int {
+	if f.hasChecksum {
+		return f.lengthSize + 4
+	}
+	return f.lengthSize
+}
+
+func (f recordFormat) readLength(arr []byte) int {
+	if f.lengthSize == 2 {
+		return int(binary.LittleEndian.Uint16(arr))
+	}
+	return int(binary.LittleEndian.Uint32(arr))
+}
+
+func (f recordFormat) decodePayload(payload []byte) (Entry, bool) {
+	kind := KindPut
+	if f.hasKind {
+		if len(payload) == 0 {
+			return Entry{}, false
+		}
+		kind = EntryKind(payload[0])
+		payload = payload[1:]
+	}
+	fixedSize := f.keyLengthSize + 8 + 8
+	if len(payload) < fixedSize {
+		return Entry{}, false
+	}
+	if f.keyLengthSize == 2 {
+		if int(binary.LittleEndian.Uint16(payload))+fixedSize > len(payload) {
+			return Entry{}, false
+		}
+		return fromLegacyByteArray(payload), true
+	}
+	if uint64(binary.LittleEndian.Uint32(payload))+uint64(fixedSize) > uint64(len(payload)) {
+		return Entry{}, false
+	}
+	entry := FromByteArray(payload)
+	entry.Kind = kind
+	return entry, true
+}
+
+//decodeRecords parses the records until the end of data or until the first torn/corrupted one;
+//returns the parsed entries and the amount of bytes that were valid
+func (f recordFormat) decodeRecords(data []byte) ([]Entry, int) {
+	ans := make([]Entry, 0)
+	offset := 0
+	for offset+f.headerSize() <= len(data) {
+		payloadLen := f.readLength(data[offset:])
+		payloadStart := offset + f.headerSize()
+		if payloadStart+payloadLen > len(data) {
+			break
+		}
+		payload := data[payloadStart:(payloadStart + payloadLen)]
+		if f.hasChecksum && (crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[offset+f.lengthSize:])) {
+			break
+		}
+		entry, ok := f.decodePayload(payload)
+		if !ok {
+			break
+		}
+		ans = append(ans, entry)
+		offset = payloadStart + payloadLen
+	}
+	return ans, offset
+}
@@ -0,0 +1,66 @@
+package commitlog
+
+import "sync"
+
+type pendingBatch struct {
+	data    []byte
+	entries int
+	seq     uint64
+	err     error
+	done    bool
+}
+
+//groupCommitter coalesces the batches of concurrent writers: the first writer to arrive
+//becomes the leader and writes everything that got queued meanwhile with a single write call
+type groupCommitter struct {
+	mutex   *sync.Mutex
+	cond    *sync.Cond
+	queue   []*pendingBatch
+	writing bool
+}
+
+func newGroupCommitter() *groupCommitter {
+	mutex := &sync.Mutex{}
+	return &groupCommitter{mutex: mutex, cond: sync.NewCond(mutex)}
+}
+
+func (g *groupCommitter) commit(data []byte, entries int, write func([]byte, int) (uint64, error)) (uint64, error) {
+	g.mutex.Lock()
+	batch := &pendingBatch{data: data, entries: entries}
+	g.queue = append(g.queue, batch)
+	for !batch.done {
+		if g.writing {
+			g.cond.Wait()
+			continue
+		}
+		g.writing = true
+		group := g.queue
+		g.queue = nil
+		g.mutex.Unlock()
+
+		seq, err := write(concatBatches(group))
+
+		g.mutex.Lock()
+		for _, b := range group {
+			b.seq, b.err, b.done = seq, err, true
+		}
+		g.writing = false
+		g.cond.Broadcast()
+	}
+	g.mutex.Unlock()
+	return batch.seq, batch.err
+}
+
+func concatBatches(group []*pendingBatch) ([]byte, int) {
+	size := 0
+	entries := 0
+	for _, b := range group {
+		size += len(b.data)
+		entries += b.entries
+	}
+	data := make([]byte, 0, size)
+	for _, b := range group {
+		data = append(data, b.data...)
+	}
+	return data, entries
+}
@@ -1,76 +1,343 @@
 package commitlog
 
 import (
+	"fmt"
+	log "github.com/jeanphorn/log4go"
+	"github.com/nikita-tomilov/golsm/errs"
+	"io/ioutil"
 	"os"
-	"sync/atomic"
+	"sort"
+	"sync"
+	"time"
 )
 
+const DefaultMaxSegmentSize = 64 * 1024 * 1024
+
+const DefaultMaxSegmentAge = 10 * time.Minute
+
+const segmentFileNameFormat = "commitlog-%06d.log"
+
+var legacyCommitlogFileNames = []string{"COMMITLOGA", "COMMITLOGB"}
+
+//Manager keeps the commitlog as a sequence of numbered segments: the active one receives the writes,
+//the sealed ones wait to be flushed to SST and removed
 type Manager struct {
-	Path              string
-	commitlogA        *OverFile
-	commitlogB        *OverFile
-	usingA            bool
-	activeCommitlog   atomic.Value
-	inactiveCommitlog atomic.Value
+	Path           string
+	SyncPolicy     SyncPolicy
+	SyncPeriod     time.Duration
+	MaxSegmentSize int64
+	MaxSegmentAge  time.Duration
+	active         *OverFile
+	sealed         []*OverFile
+	nextSegmentId  uint64
+	segmentsMutex  *sync.Mutex
+	discardedBytes int64
+	durability     *durabilityTracker
+	group          *groupCommitter
 }
 
-func (m *Manager) Init() {
-	os.MkdirAll(m.Path, os.ModePerm)
+func (m *Manager) Init() error {
+	if err := os.MkdirAll(m.Path, os.ModePerm); err != nil {
+		return errs.IO("creating commitlog directory "+m.Path, err)
+	}
+	if m.MaxSegmentSize == 0 {
+		m.MaxSegmentSize = DefaultMaxSegmentSize
+	}
+	if m.MaxSegmentAge == 0 {
+		m.MaxSegmentAge = DefaultMaxSegmentAge
+	}
+	m.segmentsMutex = &sync.Mutex{}
+	m.nextSegmentId = 1
+	m.sealed = make([]*OverFile, 0)
 
-	m.commitlogA = &OverFile{commitlogFileName: m.Path + "/COMMITLOGA"}
-	m.commitlogB = &OverFile{commitlogFileName: m.Path + "/COMMITLOGB"}
+	if err := m.adoptLegacyCommitlogs(); err != nil {
+		return err
+	}
+	ids, err := m.listSegmentIds()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		segment, err := m.newSegment(id)
+		if err != nil {
+			return err
+		}
+		m.discardedBytes += segment.DiscardedBytes()
+		if segment.IsEmpty() {
+			if err := segment.Remove(); err != nil {
+				return err
+			}
+			continue
+		}
+		m.sealed = append(m.sealed, segment)
+	}
+	if m.active, err = m.newSegment(m.nextSegmentId); err != nil {
+		return err
+	}
 
-	m.commitlogA.Init()
-	m.commitlogB.Init()
+	m.durability = newDurabilityTracker()
+	m.group = newGroupCommitter()
+	if m.SyncPolicy == SyncPeriodically {
+		if m.SyncPeriod == 0 {
+			m.SyncPeriod = DefaultSyncPeriod
+		}
+		go m.durability.runEvery(m.SyncPeriod, m.syncPending)
+	}
+	return nil
+}
 
-	m.activeCommitlog.Store(m.commitlogA)
-	m.usingA = true
+func (m *Manager) segmentFileName(id uint64) string {
+	return m.Path + "/" + fmt.Sprintf(segmentFileNameFormat, id)
 }
 
-func (m *Manager) getActiveCommitlog() *OverFile {
-	active := m.activeCommitlog.Load().(*OverFile)
-	return active
+func (m *Manager) newSegment(id uint64) (*OverFile, error) {
+	segment := &OverFile{Id: id, commitlogFileName: m.segmentFileName(id)}
+	if err := segment.Init(); err != nil {
+		return nil, err
+	}
+	if id >= m.nextSegmentId {
+		m.nextSegmentId = id + 1
+	}
+	return segment, nil
 }
 
-func (m *Manager) getInactiveCommitlog() *OverFile {
-	inactive := m.inactiveCommitlog.Load().(*OverFile)
-	return inactive
+func (m *Manager) listSegmentIds() ([]uint64, error) {
+	files, err := ioutil.ReadDir(m.Path)
+	if err != nil {
+		return nil, errs.IO("listing commitlog directory "+m.Path, err)
+	}
+	ids := make([]uint64, 0)
+	for _, f := range files {
+		var id uint64
+		if n, _ := fmt.Sscanf(f.Name(), segmentFileNameFormat, &id); n == 1 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids, nil
+}
+
+//adoptLegacyCommitlogs renames the COMMITLOGA/COMMITLOGB pair to numbered segments, older file first
+func (m *Manager) adoptLegacyCommitlogs() error {
+	legacy := make([]os.FileInfo, 0)
+	for _, name := range legacyCommitlogFileNames {
+		info, err := os.Stat(m.Path + "/" + name)
+		if err == nil {
+			legacy = append(legacy, info)
+		}
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+	sort.Slice(legacy, func(i, j int) bool {
+		return legacy[i].ModTime().Before(legacy[j].ModTime())
+	})
+	ids, err := m.listSegmentIds()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id >= m.nextSegmentId {
+			m.nextSegmentId = id + 1
+		}
+	}
+	for _, info := range legacy {
+		log.Info(fmt.Sprintf("Adopting legacy commitlog %s as segment %d", info.Name(), m.nextSegmentId))
+		if err := os.Rename(m.Path+"/"+info.Name(), m.segmentFileName(m.nextSegmentId)); err != nil {
+			return errs.IO("adopting legacy commitlog "+info.Name(), err)
+		}
+		m.nextSegmentId++
+	}
+	return nil
 }
 
-func (m *Manager) Store(entry Entry) {
-	active := m.getActiveCommitlog()
-	active.Store(entry)
+func (m *Manager) Store(entry Entry) error {
+	return m.StoreMultiple([]Entry{entry})
 }
 
-func (m *Manager) StoreMultiple(entries []Entry) {
-	active := m.getActiveCommitlog()
+func (m *Manager) StoreMultiple(entries []Entry) error {
+	seq, err := m.Append(entries)
+	if err != nil {
+		return err
+	}
+	return m.AwaitDurable(seq)
+}
+
+//Append writes the entries to the active commitlog without waiting for the SyncPeriodically policy to make them durable;
+//the returned sequence number is to be passed to AwaitDurable. Concurrent calls are group-committed
+func (m *Manager) Append(entries []Entry) (uint64, error) {
+	if err := m.durability.failure(); err != nil {
+		return 0, err
+	}
+	data := make([]byte, 0)
 	for _, entry := range entries {
-		active.Store(entry)
+		if err := entry.Validate(); err != nil {
+			return 0, err
+		}
+		data = append(data, encodeRecord(entry)...)
 	}
+	return m.group.commit(data, len(entries), m.writeGroup)
 }
 
-func (m *Manager) RetrieveAll() []Entry {
-	active := m.getActiveCommitlog()
+func (m *Manager) writeGroup(data []byte, entries int) (uint64, error) {
+	m.segmentsMutex.Lock()
+	defer m.segmentsMutex.Unlock()
+	active := m.active
+	if err := active.StoreEncoded(data, entries); err != nil {
+		return 0, err
+	}
+	seq := m.durability.markWritten()
+	var err error
+	if m.SyncPolicy == SyncEveryBatch {
+		err = active.Sync()
+		m.durability.markSynced(seq, err)
+	}
+	if (err == nil) && ((active.Size() >= m.MaxSegmentSize) || (active.Age() >= m.MaxSegmentAge)) {
+		err = m.sealActive()
+	}
+	return seq, err
+}
+
+func (m *Manager) AwaitDurable(seq uint64) error {
+	switch m.SyncPolicy {
+	case SyncPeriodically:
+		return m.durability.awaitSynced(seq)
+	case SyncNever:
+		return nil
+	default:
+		return m.durability.failure()
+	}
+}
+
+//Rollover seals the active segment, if it has any entries, and starts a new one
+func (m *Manager) Rollover() error {
+	m.segmentsMutex.Lock()
+	defer m.segmentsMutex.Unlock()
+	if m.active.IsEmpty() {
+		return nil
+	}
+	return m.sealActive()
+}
+
+func (m *Manager) sealActive() error {
+	sealed := m.active
+	if m.SyncPolicy != SyncNever {
+		if err := sealed.Sync(); err != nil {
+			return err
+		}
+	}
+	active, err := m.newSegment(m.nextSegmentId)
+	if err != nil {
+		return err
+	}
+	m.sealed = append(m.sealed, sealed)
+	m.active = active
+	log.Debug(fmt.Sprintf("Sealed commitlog segment %d with %d entries", sealed.Id, sealed.Count()))
+	return nil
+}
+
+func (m *Manager) ActiveSegmentId() uint64 {
+	m.segmentsMutex.Lock()
+	defer m.segmentsMutex.Unlock()
+	return m.active.Id
+}
+
+//SealedSegments returns the segments awaiting the flush to SST, oldest first
+func (m *Manager) SealedSegments() []*OverFile {
+	m.segmentsMutex.Lock()
+	defer m.segmentsMutex.Unlock()
+	ans := make([]*OverFile, len(m.sealed))
+	copy(ans, m.sealed)
+	return ans
+}
+
+func (m *Manager) SealedSegmentsCount() int {
+	m.segmentsMutex.Lock()
+	defer m.segmentsMutex.Unlock()
+	return len(m.sealed)
+}
+
+//RemoveSegment deletes the sealed segment; it should only be called once its entries are durably stored in SST
+func (m *Manager) RemoveSegment(segment *OverFile) error {
+	m.segmentsMutex.Lock()
+	defer m.segmentsMutex.Unlock()
+	for i, s := range m.sealed {
+		if s == segment {
+			m.sealed = append(m.sealed[:i], m.sealed[i+1:]...)
+			return segment.Remove()
+		}
+	}
+	return fmt.Errorf("commitlog segment %d is not sealed", segment.Id)
+}
+
+func (m *Manager) RetrieveAll() ([]Entry, error) {
+	m.segmentsMutex.Lock()
+	active := m.active
+	m.segmentsMutex.Unlock()
 	return active.RetrieveAll()
 }
 
-func (m *Manager) SwapCommitlogs() {
-	if m.usingA {
-		m.inactiveCommitlog.Store(m.commitlogA)
-		m.activeCommitlog.Store(m.commitlogB)
-	} else {
-		m.inactiveCommitlog.Store(m.commitlogB)
-		m.activeCommitlog.Store(m.commitlogA)
+func (m *Manager) RetrieveUnflushed() ([]Entry, error) {
+	m.segmentsMutex.Lock()
+	segments := append(append([]*OverFile{}, m.sealed...), m.active)
+	m.segmentsMutex.Unlock()
+	ans := make([]Entry, 0)
+	for _, segment := range segments {
+		entries, err := segment.RetrieveAll()
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, entries...)
 	}
-	m.usingA = !m.usingA
+	return ans, nil
+}
+
+func (m *Manager) Sync() error {
+	m.segmentsMutex.Lock()
+	active := m.active
+	m.segmentsMutex.Unlock()
+	return active.Sync()
 }
 
-func (m *Manager) RetrieveAllFromPrevious() []Entry {
-	inactive := m.getInactiveCommitlog()
-	return inactive.RetrieveAll()
+func (m *Manager) syncPending() {
+	seq, hasPending := m.durability.pending()
+	if !hasPending {
+		return
+	}
+	m.durability.markSynced(seq, m.Sync())
+}
+
+//Close syncs and closes every segment; the writes are rejected afterwards
+func (m *Manager) Close() error {
+	if !m.durability.startClosing() {
+		return errManagerClosed
+	}
+	if m.SyncPolicy == SyncPeriodically {
+		close(m.durability.stop)
+		<-m.durability.stopped
+	}
+	seq, _ := m.durability.pending()
+	err := m.Sync()
+	m.durability.markSynced(seq, err)
+	m.durability.close()
+	m.segmentsMutex.Lock()
+	defer m.segmentsMutex.Unlock()
+	for _, segment := range m.sealed {
+		if syncErr := segment.Sync(); (syncErr != nil) && (err == nil) {
+			err = syncErr
+		}
+		if closeErr := segment.Close(); (closeErr != nil) && (err == nil) {
+			err = closeErr
+		}
+	}
+	if closeErr := m.active.Close(); (closeErr != nil) && (err == nil) {
+		err = closeErr
+	}
+	return err
 }
 
-func (m *Manager) ClearPrevious() {
-	inactive := m.getInactiveCommitlog()
-	inactive.Clear()
+func (m *Manager) DiscardedBytes() int64 {
+	return m.discardedBytes
 }
@@ -1,14 +1,24 @@
 package commitlog_test
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/nikita-tomilov/golsm/commitlog"
+	"github.com/nikita-tomilov/golsm/errs"
+	"github.com/nikita-tomilov/golsm/utils"
 	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestCommitlog(t *testing.T) {
 	//given
-	m := commitlog.Manager{Path: "/tmp/golsm/test"}
+	m := commitlog.Manager{Path: fmt.Sprintf("/tmp/golsm_test/commitlog/segments-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
 	m.Init()
 	dummy1 := commitlog.Entry{
 		Key:       []byte("tagZero"),
@@ -36,21 +46,260 @@ func TestCommitlog(t *testing.T) {
 	}
 	//when
 	m.Store(dummy1)
-	m.SwapCommitlogs()
+	m.Rollover()
 	m.Store(dummy2)
 	m.Store(dummy3)
-	m.SwapCommitlogs()
+	m.Rollover()
+	m.Rollover()
 	m.Store(dummy4)
 
 	//then
-	all1 := m.RetrieveAll()
-	m.SwapCommitlogs()
-	all2 := m.RetrieveAll()
+	sealed := m.SealedSegments()
+	assert.Equal(t, 2, len(sealed), "sealed segments count incorrect")
+	all1, err1 := sealed[0].RetrieveAll()
+	all2, err2 := sealed[1].RetrieveAll()
+	active, err3 := m.RetrieveAll()
 
-	m.Store(dummy1)
+	assert.Nil(t, err1, "first segment was not read")
+	assert.Nil(t, err2, "second segment was not read")
+	assert.Nil(t, err3, "active segment was not read")
+
+	assert.Equal(t, []commitlog.Entry{dummy1}, all1, "first segment failed")
+	assert.Equal(t, []commitlog.Entry{dummy2, dummy3}, all2, "second segment failed")
+	assert.Equal(t, []commitlog.Entry{dummy4}, active, "active segment failed")
+
+	//when
+	assert.Nil(t, m.RemoveSegment(sealed[0]))
+	m = commitlog.Manager{Path: m.Path}
+	m.Init()
+
+	//then
+	assert.Equal(t, []commitlog.Entry{dummy2, dummy3, dummy4}, unflushed(t, &m), "segments were not reopened in order")
+	assert.Equal(t, 2, len(m.SealedSegments()), "reopened segments should be sealed")
+}
+
+func TestCommitlog_RollsOverBySize(t *testing.T) {
+	//given
+	m := commitlog.Manager{Path: fmt.Sprintf("/tmp/golsm_test/commitlog/rollover-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()), MaxSegmentSize: 100}
+	m.Init()
+	dummy := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, Value: make([]byte, 40), ExpiresAt: 9999}
+
+	//when
+	for i := 0; i < 5; i++ {
+		m.Store(dummy)
+	}
+
+	//then
+	assert.Equal(t, 2, len(m.SealedSegments()), "segments were not rolled over by size")
+	assert.Equal(t, 5, len(unflushed(t, &m)), "entries were lost on rollover")
+}
+
+func TestCommitlog_AdoptsLegacyCommitlogs(t *testing.T) {
+	//given
+	path := fmt.Sprintf("/tmp/golsm_test/commitlog/legacy-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	assert.Nil(t, os.MkdirAll(path, os.ModePerm))
+	dummy := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, Value: make([]byte, 4), ExpiresAt: 9999}
+	assert.Nil(t, ioutil.WriteFile(path+"/COMMITLOGB", legacyRecord(dummy), 0644))
+
+	//when
+	m := commitlog.Manager{Path: path}
+	m.Init()
+
+	//then
+	assert.Equal(t, []commitlog.Entry{dummy}, unflushed(t, &m), "legacy commitlog was not adopted")
+	assert.False(t, utils.FileExists(path+"/COMMITLOGB"), "legacy commitlog was not renamed")
+}
+
+func TestCommitlog_RecoversFromTornWrite(t *testing.T) {
+	//given
+	path := fmt.Sprintf("/tmp/golsm_test/commitlog/torn-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	m := commitlog.Manager{Path: path}
+	m.Init()
+	dummy := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, Value: make([]byte, 4), ExpiresAt: 9999}
+	m.Store(dummy)
+	m.Store(dummy)
+
+	//when
+	f, err := os.OpenFile(path+"/commitlog-000001.log", os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte{30, 0, 1, 2, 3, 4, 5})
+	assert.Nil(t, err)
+	f.Close()
+
+	m = commitlog.Manager{Path: path}
+	m.Init()
+
+	//then
+	assert.Equal(t, int64(7), m.DiscardedBytes(), "torn tail size incorrect")
+	assert.Equal(t, 2, len(unflushed(t, &m)), "valid entries were lost")
+
+	//when
+	m.Store(dummy)
+
+	//then
+	assert.Equal(t, 3, len(unflushed(t, &m)), "commitlog is not writable after recovery")
+}
+
+func TestCommitlog_DetectsChecksumMismatch(t *testing.T) {
+	//given
+	path := fmt.Sprintf("/tmp/golsm_test/commitlog/crc-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	m := commitlog.Manager{Path: path}
+	m.Init()
+	dummy := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, Value: make([]byte, 4), ExpiresAt: 9999}
+	m.Store(dummy)
+	m.Store(dummy)
+
+	//when
+	data, err := ioutil.ReadFile(path + "/commitlog-000001.log")
+	assert.Nil(t, err)
+	data[len(data)-1] ^= 0xFF
+	assert.Nil(t, ioutil.WriteFile(path+"/commitlog-000001.log", data, 0644))
+
+	m = commitlog.Manager{Path: path}
+	m.Init()
+
+	//then
+	assert.Equal(t, 1, len(unflushed(t, &m)), "corrupted entry was not discarded")
+	assert.Less(t, int64(0), m.DiscardedBytes(), "discarded bytes were not reported")
+}
+
+func TestCommitlog_PeriodicSyncPolicyWaitsForSync(t *testing.T) {
+	//given
+	path := fmt.Sprintf("/tmp/golsm_test/commitlog/periodic-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	m := commitlog.Manager{Path: path, SyncPolicy: commitlog.SyncPeriodically, SyncPeriod: 100 * time.Millisecond}
+	m.Init()
+	dummy := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, Value: make([]byte, 4), ExpiresAt: 9999}
+
+	//when
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = m.StoreMultiple([]commitlog.Entry{dummy, dummy})
+		}(i)
+	}
+	wg.Wait()
+
+	//then
+	for _, err := range errs {
+		assert.Nil(t, err, "store failed")
+	}
+	all, err := m.RetrieveAll()
+	assert.Nil(t, err, "commitlog was not read")
+	assert.Equal(t, 20, len(all), "entries were lost")
+
+	//when
+	assert.Nil(t, m.Close(), "close failed")
+
+	//then
+	assert.NotNil(t, m.Store(dummy), "store after close should fail")
+}
+
+func TestCommitlog_StoresLargeValues(t *testing.T) {
+	//given
+	m := commitlog.Manager{Path: fmt.Sprintf("/tmp/golsm_test/commitlog/large-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	m.Init()
+	large := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, Value: make([]byte, 200*1024), ExpiresAt: 9999}
+	large.Value[len(large.Value)-1] = 42
+	oversized := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1338, Value: make([]byte, commitlog.MaxValueSize+1), ExpiresAt: 9999}
+
+	//when
+	errLarge := m.Store(large)
+	errOversized := m.Store(oversized)
+	m = commitlog.Manager{Path: m.Path}
+	m.Init()
+
+	//then
+	assert.Nil(t, errLarge, "large value was rejected")
+	assert.True(t, errors.Is(errOversized, commitlog.ErrValueTooLarge), "oversized value was not rejected")
+	assert.Equal(t, []commitlog.Entry{large}, unflushed(t, &m), "large value was not stored correctly")
+}
+
+func TestCommitlog_StoresTombstones(t *testing.T) {
+	//given
+	m := commitlog.Manager{Path: fmt.Sprintf("/tmp/golsm_test/commitlog/tombstones-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	m.Init()
+	put := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, Value: make([]byte, 4)}
+	tombstone := commitlog.NewTombstone([]byte("tagZero"), 1000, 2000)
+	invalid := commitlog.NewTombstone([]byte("tagZero"), 2000, 1000)
+	unknown := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, Kind: commitlog.KindDropTag + 1}
+
+	//when
+	err := m.StoreMultiple([]commitlog.Entry{put, tombstone})
+	m = commitlog.Manager{Path: m.Path}
+	m.Init()
+	entries := unflushed(t, &m)
+
+	//then
+	assert.Nil(t, err, "tombstone was rejected")
+	assert.True(t, errors.Is(invalid.Validate(), commitlog.ErrInvalidTombstone), "inverted range was not rejected")
+	assert.True(t, errors.Is(unknown.Validate(), commitlog.ErrUnknownEntryKind), "unknown entry kind was not rejected")
+	assert.Equal(t, 2, len(entries), "entries count is incorrect")
+	assert.False(t, entries[0].IsTombstone(), "put was read as a tombstone")
+	assert.True(t, entries[1].IsTombstone(), "tombstone was read as a put")
+	from, to := entries[1].TombstoneRange()
+	assert.Equal(t, uint64(1000), from, "tombstone range is incorrect")
+	assert.Equal(t, uint64(2000), to, "tombstone range is incorrect")
+}
+
+func TestCommitlog_ReadsVersion1Segments(t *testing.T) {
+	//given
+	path := fmt.Sprintf("/tmp/golsm_test/commitlog/v1-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	assert.Nil(t, os.MkdirAll(path, os.ModePerm))
+	dummy := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, Value: make([]byte, 4), ExpiresAt: 9999}
+	payload := legacyRecord(dummy)[2:]
+	record := make([]byte, 6)
+	binary.LittleEndian.PutUint16(record, uint16(len(payload)))
+	binary.LittleEndian.PutUint32(record[2:], crc32.ChecksumIEEE(payload))
+	data := append(append([]byte("GLSMCLOG\x01"), record...), payload...)
+	assert.Nil(t, ioutil.WriteFile(path+"/commitlog-000001.log", data, 0644))
+
+	//when
+	m := commitlog.Manager{Path: path}
+	m.Init()
+
+	//then
+	assert.Equal(t, []commitlog.Entry{dummy}, unflushed(t, &m), "version 1 segment was not read")
+	assert.Equal(t, int64(0), m.DiscardedBytes(), "version 1 segment was considered corrupted")
+}
+
+func TestCommitlog_ReportsTypedErrors(t *testing.T) {
+	//given
+	path := fmt.Sprintf("/tmp/golsm_test/commitlog/errors-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	assert.Nil(t, os.MkdirAll(path, os.ModePerm))
+	assert.Nil(t, ioutil.WriteFile(path+"/commitlog-000001.log", []byte("GLSMCLOG\x63"), 0644))
+	dummy := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, Value: make([]byte, 4), ExpiresAt: 9999}
+
+	//when
+	errUnknownVersion := (&commitlog.Manager{Path: path}).Init()
+	assert.Nil(t, os.Remove(path+"/commitlog-000001.log"))
+	m := commitlog.Manager{Path: path}
+	errInit := m.Init()
+	m.Close()
+	errClosed := m.Store(dummy)
+
+	//then
+	assert.True(t, errors.Is(errUnknownVersion, errs.ErrCorrupted), "unknown format version was not reported as corruption")
+	assert.Nil(t, errInit, "commitlog was not opened")
+	assert.True(t, errors.Is(errClosed, errs.ErrClosed), "store after close was not rejected")
+}
+
+func unflushed(t *testing.T, m *commitlog.Manager) []commitlog.Entry {
+	entries, err := m.RetrieveUnflushed()
+	assert.Nil(t, err, "commitlog was not read")
+	return entries
+}
 
-	assert.Equal(t, dummy1, all1[0], "commitlogA failed")
-	assert.Equal(t, dummy2, all2[0], "commitlogB failed")
-	assert.Equal(t, dummy3, all2[1], "commitlogB failed on second item")
-	assert.Equal(t, dummy4, all1[1], "commitlogA failed on second item")
-}
\ No newline at end of file
+func legacyRecord(e commitlog.Entry) []byte {
+	payloadLen := 2 + len(e.Key) + 16 + len(e.Value)
+	arr := make([]byte, 2+payloadLen)
+	binary.LittleEndian.PutUint16(arr, uint16(payloadLen))
+	binary.LittleEndian.PutUint16(arr[2:], uint16(len(e.Key)))
+	copy(arr[4:], e.Key)
+	binary.LittleEndian.PutUint64(arr[4+len(e.Key):], e.Timestamp)
+	binary.LittleEndian.PutUint64(arr[12+len(e.Key):], e.ExpiresAt)
+	copy(arr[20+len(e.Key):], e.Value)
+	return arr
+}
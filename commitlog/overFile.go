@@ -1,38 +1,165 @@
 package commitlog
 
 import (
-	"encoding/binary"
+	"fmt"
+	log "github.com/jeanphorn/log4go"
+	"github.com/nikita-tomilov/golsm/errs"
 	"github.com/nikita-tomilov/golsm/utils"
+	"io"
+	"io/ioutil"
 	"os"
+	"sync"
+	"time"
 )
 
 type Commitlog interface {
-	Init()
-	Store(entry Entry)
-	RetrieveAll() []Entry
+	Init() error
+	Store(entry Entry) error
+	Sync() error
+	RetrieveAll() ([]Entry, error)
 	Count() int
-	Clear()
+	Remove() error
+	Close() error
 }
 
+//OverFile is a single commitlog segment
 type OverFile struct {
+	Id                uint64
 	commitlogFileName string
 	commitlogFile     *os.File
+	mutex             *sync.Mutex
 	entriesCount      int
+	size              int64
+	createdAt         time.Time
+	discardedBytes    int64
+	//set when a failed write could not be cut off the file, so that no write is acknowledged after the torn one
+	brokenErr error
 }
 
-func (o *OverFile) Init() {
+func (o *OverFile) Init() error {
+	o.mutex = &sync.Mutex{}
+	if err := o.recover(); err != nil {
+		return err
+	}
+	return o.open()
+}
+
+func (o *OverFile) open() error {
 	file, err := os.OpenFile(o.commitlogFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	utils.Check(err)
+	if err != nil {
+		return errs.IO("opening commitlog "+o.commitlogFileName, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errs.IO("opening commitlog "+o.commitlogFileName, err)
+	}
+	size := info.Size()
+	if size == 0 {
+		if _, err = file.Write(fileHeader()); err != nil {
+			file.Close()
+			return errs.IO("writing commitlog header "+o.commitlogFileName, err)
+		}
+		size = int64(fileHeaderSize())
+	}
 	o.commitlogFile = file
+	o.size = size
+	o.createdAt = time.Now()
+	return nil
+}
+
+//recover cuts off the torn tail left by a crash in the middle of the write
+//and upgrades the commitlog written in the legacy or older format
+func (o *OverFile) recover() error {
+	if !utils.FileExists(o.commitlogFileName) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(o.commitlogFileName)
+	if err != nil {
+		return errs.IO("reading commitlog "+o.commitlogFileName, err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	format, headerSize, version := legacyFormat, 0, byte(0)
+	if hasFileHeader(data) {
+		known := false
+		format, known = formatOf(data)
+		if !known {
+			return errs.Corrupted("commitlog %s has unknown format version %d", o.commitlogFileName, data[len(fileMagic)])
+		}
+		headerSize, version = fileHeaderSize(), data[len(fileMagic)]
+	}
+	entries, validBytes := format.decodeRecords(data[headerSize:])
+	o.entriesCount = len(entries)
+	o.discardedBytes = int64(len(data) - headerSize - validBytes)
+	if o.discardedBytes > 0 {
+		log.Warn(fmt.Sprintf("Commitlog %s has a torn or corrupted tail; discarding %d bytes after %d valid entries", o.commitlogFileName, o.discardedBytes, len(entries)))
+	}
+	if version != formatVersion {
+		return o.rewrite(entries)
+	}
+	if o.discardedBytes > 0 {
+		return errs.IO("truncating commitlog "+o.commitlogFileName, os.Truncate(o.commitlogFileName, int64(headerSize+validBytes)))
+	}
+	return nil
+}
+
+func (o *OverFile) rewrite(entries []Entry) error {
+	data := fileHeader()
+	for _, entry := range entries {
+		data = append(data, encodeRecord(entry)...)
+	}
+	tmpFileName := o.commitlogFileName + ".tmp"
+	if err := ioutil.WriteFile(tmpFileName, data, 0644); err != nil {
+		return errs.IO("rewriting commitlog "+o.commitlogFileName, err)
+	}
+	return errs.IO("rewriting commitlog "+o.commitlogFileName, os.Rename(tmpFileName, o.commitlogFileName))
 }
 
-func (o *OverFile) Store(entry Entry) {
+func (o *OverFile) Store(entry Entry) error {
 	//log.Debug("STORE on " + o.commitlogFileName + " ts " + strconv.FormatUint(entry.Timestamp, 10))
-	o.commitlogFile.Write(entry.ToByteArrayWithLength())
-	o.entriesCount += 1
+	return o.StoreEncoded(encodeRecord(entry), 1)
+}
+
+func (o *OverFile) StoreEncoded(records []byte, entries int) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.brokenErr != nil {
+		return o.brokenErr
+	}
+	if _, err := o.commitlogFile.Write(records); err != nil {
+		o.cutOff()
+		return errs.IO("writing commitlog "+o.commitlogFileName, err)
+	}
+	o.size += int64(len(records))
+	o.entriesCount += entries
+	return nil
+}
+
+//cutOff removes the part of the failed write from the file, so that the replay does not stop at it
+//before the later writes; must be called under the mutex
+func (o *OverFile) cutOff() {
+	err := o.commitlogFile.Truncate(o.size)
+	if err == nil {
+		_, err = o.commitlogFile.Seek(o.size, io.SeekStart)
+	}
+	if err != nil {
+		o.brokenErr = errs.IO("cutting off the failed write of commitlog "+o.commitlogFileName, err)
+		log.Error(o.brokenErr.Error())
+	}
+}
+
+func (o *OverFile) Sync() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.brokenErr != nil {
+		return o.brokenErr
+	}
+	return errs.IO("syncing commitlog "+o.commitlogFileName, o.commitlogFile.Sync())
 }
 
-func (o *OverFile) RetrieveAll() []Entry {
+func (o *OverFile) RetrieveAll() ([]Entry, error) {
 	//log.Debug("RETRIEVE ALL on " + o.commitlogFileName)
 	return o.readAllEntries()
 }
@@ -41,32 +168,55 @@ func (o *OverFile) Count() int {
 	return o.entriesCount
 }
 
-func (o *OverFile) readAllEntries() []Entry {
-	o.commitlogFile.Close()
-	f, err := os.OpenFile(o.commitlogFileName, os.O_RDONLY, 0644)
-	utils.Check(err)
-	buf := make([]byte, 2)
-	ans := make([]Entry, 0)
-	n := 2
-	n, _ = f.Read(buf)
-	for n == 2 {
-		lenToRead := int(binary.LittleEndian.Uint16(buf))
-		bigbuf := make([]byte, lenToRead)
-		n2, _ := f.Read(bigbuf)
-		if n2 != lenToRead {
-			panic("fail")
-		}
-		ans = append(ans, FromByteArray(bigbuf))
-		n, _ = f.Read(buf)
+func (o *OverFile) DiscardedBytes() int64 {
+	return o.discardedBytes
+}
+
+func (o *OverFile) IsEmpty() bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.size <= int64(fileHeaderSize())
+}
+
+func (o *OverFile) Size() int64 {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.size
+}
+
+func (o *OverFile) Age() time.Duration {
+	return time.Since(o.createdAt)
+}
+
+func (o *OverFile) readAllEntries() ([]Entry, error) {
+	data, err := ioutil.ReadFile(o.commitlogFileName)
+	if err != nil {
+		return nil, errs.IO("reading commitlog "+o.commitlogFileName, err)
 	}
-	f.Close()
-	o.Init()
-	return ans
+	if !hasFileHeader(data) {
+		return []Entry{}, nil
+	}
+	format, known := formatOf(data)
+	if !known {
+		return nil, errs.Corrupted("commitlog %s has unknown format version %d", o.commitlogFileName, data[len(fileMagic)])
+	}
+	entries, validBytes := format.decodeRecords(data[fileHeaderSize():])
+	if fileHeaderSize()+validBytes != len(data) {
+		log.Warn(fmt.Sprintf("Commitlog %s has %d unreadable bytes at the end", o.commitlogFileName, len(data)-fileHeaderSize()-validBytes))
+	}
+	return entries, nil
 }
 
-func (o *OverFile) Clear() {
-	//log.Debug("CLEAR on " + o.commitlogFileName)
+func (o *OverFile) Remove() error {
+	//log.Debug("REMOVE on " + o.commitlogFileName)
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
 	o.commitlogFile.Close()
-	utils.Check(os.Remove(o.commitlogFileName))
-	o.Init()
-}
\ No newline at end of file
+	return errs.IO("removing commitlog "+o.commitlogFileName, os.Remove(o.commitlogFileName))
+}
+
+func (o *OverFile) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return errs.IO("closing commitlog "+o.commitlogFileName, o.commitlogFile.Close())
+}
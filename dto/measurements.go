@@ -1,5 +1,10 @@
 package dto
 
+import (
+	"encoding/binary"
+	"math"
+)
+
 type Measurement struct {
 	Timestamp uint64
 	Value     []byte
@@ -10,3 +15,15 @@ type TaggedMeasurement struct {
 	Timestamp uint64
 	Value     []byte
 }
+
+//FloatValue encodes the number the way the numeric series codec of the SST expects the values to be
+func FloatValue(v float64) []byte {
+	ans := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ans, math.Float64bits(v))
+	return ans
+}
+
+//Float decodes the value stored with FloatValue
+func (m *Measurement) Float() float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(m.Value))
+}
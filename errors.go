@@ -0,0 +1,14 @@
+package golsm
+
+import (
+	"errors"
+	"github.com/nikita-tomilov/golsm/errs"
+)
+
+//the errors of the storage are to be checked with errors.Is
+var (
+	ErrCorrupted      = errs.ErrCorrupted
+	ErrIO             = errs.ErrIO
+	ErrClosed         = errs.ErrClosed
+	ErrInvalidOptions = errors.New("invalid options")
+)
@@ -0,0 +1,52 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+)
+
+//the errors returned by the storage are to be inspected with errors.Is against these kinds
+var (
+	ErrCorrupted = errors.New("data is corrupted")
+	ErrIO        = errors.New("I/O failed")
+	ErrClosed    = errors.New("storage is closed")
+)
+
+//Error keeps the cause of the failure while still matching its kind in errors.Is
+type Error struct {
+	Kind error
+	Op   string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s: %v", e.Op, e.Kind)
+	}
+	return fmt.Sprintf("%s: %v: %v", e.Op, e.Kind, e.Err)
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+//IO wraps the error of the file operation; nil and the already wrapped errors are returned as is
+func IO(op string, err error) error {
+	var e *Error
+	if (err == nil) || errors.As(err, &e) {
+		return err
+	}
+	return &Error{Kind: ErrIO, Op: op, Err: err}
+}
+
+func Corrupted(format string, args ...interface{}) error {
+	return &Error{Kind: ErrCorrupted, Op: fmt.Sprintf(format, args...)}
+}
+
+func Closed(op string) error {
+	return &Error{Kind: ErrClosed, Op: op}
+}
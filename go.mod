@@ -8,4 +8,5 @@ require (
 	github.com/jeanphorn/log4go v0.0.0-20190526082429-7dbb8deb9468
 	github.com/stretchr/testify v1.6.1
 	github.com/toolkits/file v0.0.0-20160325033739-a5b3c5147e07 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -13,6 +13,13 @@ type MemTforTag struct {
 	MaxEntriesCount int
 	mutex           *sync.Mutex
 	data            *btree.BTree
+	tombstones      []tombstone
+}
+
+//tombstone hides the SST data until it is flushed there itself
+type tombstone struct {
+	from uint64
+	to   uint64
 }
 
 const DefaultSlicePreassignedMem = 0
@@ -25,13 +32,64 @@ func (mt *MemTforTag) InitStorage() {
 func (mt *MemTforTag) MergeWithCommitlog(entries []commitlog.Entry) {
 	mt.mutex.Lock()
 	for _, entry := range entries {
-		if string(entry.Key) == mt.Tag {
+		if string(entry.Key) != mt.Tag {
+			continue
+		}
+		if entry.IsTombstone() {
+			from, to := entry.TombstoneRange()
+			mt.deleteRange(from, to)
+			mt.tombstones = append(mt.tombstones, tombstone{from: from, to: to})
+		} else {
 			mt.save(entry.Timestamp, entry.ExpiresAt, entry.Value)
 		}
 	}
 	mt.mutex.Unlock()
 }
 
+func (mt *MemTforTag) deleteRange(from uint64, to uint64) {
+	toBeDeleted := make([]btree.Item, 0, DefaultSlicePreassignedMem)
+	mt.data.AscendGreaterOrEqual(buildIndexKey(from), func(i btree.Item) bool {
+		if i.(*Entry).Timestamp > to {
+			return false
+		}
+		toBeDeleted = append(toBeDeleted, i)
+		return true
+	})
+	for _, i := range toBeDeleted {
+		mt.data.Delete(i)
+	}
+}
+
+//IsDeleted tells whether the data at the timestamp is deleted by a tombstone that is not yet flushed to SST
+func (mt *MemTforTag) IsDeleted(ts uint64) bool {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	for _, t := range mt.tombstones {
+		if (ts >= t.from) && (ts <= t.to) {
+			return true
+		}
+	}
+	return false
+}
+
+//ReleaseTombstones forgets the tombstones of the entries once they are flushed to SST
+func (mt *MemTforTag) ReleaseTombstones(entries []commitlog.Entry) {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	for _, entry := range entries {
+		if (string(entry.Key) != mt.Tag) || !entry.IsTombstone() {
+			continue
+		}
+		from, to := entry.TombstoneRange()
+		for i, t := range mt.tombstones {
+			if (t.from == from) && (t.to == to) {
+				mt.tombstones = append(mt.tombstones[:i], mt.tombstones[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
 func (mt *MemTforTag) MergeWithPrefetched(entries []dto.Measurement, expiresAt uint64) {
 	mt.mutex.Lock()
 	for _, entry := range entries {
@@ -51,13 +109,25 @@ func (mt *MemTforTag) save(timestamp uint64, expiresAt uint64, value []byte) {
 	mt.data.ReplaceOrInsert(&entry)
 }
 
+//Snapshot returns a copy of the table as of now, unaffected by the later changes; the entries are shared
+//by the copies until either of them changes, so the snapshot is cheap
+func (mt *MemTforTag) Snapshot() *MemTforTag {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	tombstones := make([]tombstone, len(mt.tombstones))
+	copy(tombstones, mt.tombstones)
+	return &MemTforTag{Tag: mt.Tag, MaxEntriesCount: mt.MaxEntriesCount, mutex: &sync.Mutex{}, data: mt.data.Clone(), tombstones: tombstones}
+}
+
 func (mt *MemTforTag) RetrieveAll() []Entry {
 	return mt.Retrieve(0, ^uint64(0)-1)
 }
 
 func (mt *MemTforTag) Availability() (uint64, uint64) {
+	mt.mutex.Lock()
 	min := mt.data.Min()
 	max := mt.data.Max()
+	mt.mutex.Unlock()
 
 	if (min == nil) || (max == nil) {
 		return 0, 0
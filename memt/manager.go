@@ -3,51 +3,81 @@ package memt
 import (
 	"github.com/nikita-tomilov/golsm/commitlog"
 	"github.com/nikita-tomilov/golsm/dto"
+	"github.com/nikita-tomilov/golsm/errs"
 	"github.com/nikita-tomilov/golsm/utils"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const DefaultMaxEntriesPerTag = 10
+
+const DefaultPerformExpirationEvery = 10 * time.Second
+
 type Manager struct {
-	memtForTag             map[string]*MemTforTag
-	mutex                  *sync.Mutex
-	shouldBeRunning        bool
+	memtForTag             *utils.ShardedMap
+	closed                 int32
+	stop                   chan struct{}
+	workers                *sync.WaitGroup
 	MaxEntriesPerTag       int
 	PerformExpirationEvery time.Duration
 }
 
 func (sm *Manager) InitStorage() {
-	sm.memtForTag = make(map[string]*MemTforTag)
+	sm.memtForTag = utils.NewShardedMap()
 	if sm.MaxEntriesPerTag == 0 {
-		sm.MaxEntriesPerTag = 10
+		sm.MaxEntriesPerTag = DefaultMaxEntriesPerTag
 	}
 	if sm.PerformExpirationEvery == 0 {
-		sm.PerformExpirationEvery = 10 * time.Second
+		sm.PerformExpirationEvery = DefaultPerformExpirationEvery
 	}
-	sm.shouldBeRunning = true
+	sm.closed = 0
+	sm.stop = make(chan struct{})
+	sm.workers = &sync.WaitGroup{}
+	sm.workers.Add(1)
 	go func() {
-		for sm.shouldBeRunning {
-			time.Sleep(sm.PerformExpirationEvery)
-			for _, memtft := range sm.memtForTag {
-				memtft.PerformExpiration()
-			}
-		}
+		defer sm.workers.Done()
+		utils.DoEvery(sm.PerformExpirationEvery, sm.stop, func() {
+			sm.memtForTag.Range(func(_ string, memtft interface{}) {
+				memtft.(*MemTforTag).PerformExpiration()
+			})
+		})
 	}()
 }
 
-func (sm *Manager) CloseStorage() {
-	sm.shouldBeRunning = false
+//CloseStorage stops the expiration and waits for it to finish; the merges are rejected afterwards
+func (sm *Manager) CloseStorage() error {
+	if !atomic.CompareAndSwapInt32(&sm.closed, 0, 1) {
+		return errs.Closed("memt manager")
+	}
+	close(sm.stop)
+	sm.workers.Wait()
+	return nil
+}
+
+func (sm *Manager) checkOpen() error {
+	if atomic.LoadInt32(&sm.closed) != 0 {
+		return errs.Closed("memt manager")
+	}
+	return nil
 }
 
-func (sm *Manager) MergeWithPrefetched(data map[string][]dto.Measurement) {
+func (sm *Manager) MergeWithPrefetched(data map[string][]dto.Measurement) error {
+	if err := sm.checkOpen(); err != nil {
+		return err
+	}
 	expiresAt := utils.GetNowMillis() + uint64(sm.PerformExpirationEvery.Milliseconds() * 10)
 	for tag, values := range data {
 		memtForTag := sm.MemTableForTag(tag)
 		memtForTag.MergeWithPrefetched(values, expiresAt)
 	}
+	return nil
 }
 
-func (sm *Manager) MergeWithCommitlog(commitlogEntries []commitlog.Entry) {
+func (sm *Manager) MergeWithCommitlog(commitlogEntries []commitlog.Entry) error {
+	if err := sm.checkOpen(); err != nil {
+		return err
+	}
 	groupedByTag := make(map[string][]commitlog.Entry)
 	for _, entry := range commitlogEntries {
 		tag := string(entry.Key)
@@ -61,57 +91,80 @@ func (sm *Manager) MergeWithCommitlog(commitlogEntries []commitlog.Entry) {
 		}
 	}
 	for tag, values := range groupedByTag {
-		memtForTag := sm.MemTableForTag(tag)
-		memtForTag.MergeWithCommitlog(values)
+		values, dropped := commitlog.AfterLastDrop(values)
+		if dropped {
+			sm.DropTag(tag)
+		}
+		if len(values) > 0 {
+			memtForTag := sm.MemTableForTag(tag)
+			memtForTag.MergeWithCommitlog(values)
+		}
 	}
+	return nil
 }
 
-func (sm *Manager) MergeWithCommitlogForTag(tag string, entries []commitlog.Entry) {
+func (sm *Manager) DropTag(tag string) {
+	sm.memtForTag.Delete(tag)
+}
+
+func (sm *Manager) MergeWithCommitlogForTag(tag string, entries []commitlog.Entry) error {
+	if err := sm.checkOpen(); err != nil {
+		return err
+	}
 	st := sm.MemTableForTag(tag)
 	st.MergeWithCommitlog(entries)
+	return nil
+}
+
+//ReleaseTombstones is to be called once the entries are flushed to SST; the tags not in memory, like the dropped ones, are not created
+func (sm *Manager) ReleaseTombstones(entries []commitlog.Entry) {
+	for _, entry := range entries {
+		if !entry.IsTombstone() {
+			continue
+		}
+		if memtft, exists := sm.memtForTag.Load(string(entry.Key)); exists {
+			memtft.(*MemTforTag).ReleaseTombstones([]commitlog.Entry{entry})
+		}
+	}
 }
 
-func (sm *Manager) Availability() (uint64, uint64) {
+func (sm *Manager) Availability() (uint64, uint64, error) {
+	if err := sm.checkOpen(); err != nil {
+		return 0, 0, err
+	}
 	fromts := ^uint64(0)
 	tots := uint64(0)
 
-	for _, memtft := range sm.memtForTag {
-		f, t := memtft.Availability()
+	sm.memtForTag.Range(func(_ string, memtft interface{}) {
+		f, t := memtft.(*MemTforTag).Availability()
 		if fromts > f {
 			fromts = f
 		}
 		if tots < t {
 			tots = t
 		}
-	}
+	})
 
 	if tots == uint64(0) {
-		return 0, 0
+		return 0, 0, nil
 	}
-	return fromts, tots
+	return fromts, tots, nil
 }
 
 func (sm *Manager) GetTags() []string {
-	keys := make([]string, len(sm.memtForTag))
-	i := 0
-	for k := range sm.memtForTag {
-		keys[i] = k
-		i++
-	}
-	return keys
+	return sm.memtForTag.Keys()
 }
 
 func (sm *Manager) createMemtForTag(tag string) *MemTforTag {
 	memtft := MemTforTag{Tag: tag, MaxEntriesCount: sm.MaxEntriesPerTag}
 	memtft.InitStorage()
-	sm.memtForTag[tag] = &memtft
 	return &memtft
 }
 
+//MemTableForTag is safe for concurrent use; the existing tags are looked up under the read lock of their shard
 func (sm *Manager) MemTableForTag(tag string) *MemTforTag {
-	memtForTag, memtForTagExists := sm.memtForTag[tag]
-	if !memtForTagExists {
-		memtForTag = sm.createMemtForTag(tag)
-	}
-	return memtForTag
+	memtForTag, _ := sm.memtForTag.LoadOrCreate(tag, func() (interface{}, error) {
+		return sm.createMemtForTag(tag), nil
+	})
+	return memtForTag.(*MemTforTag)
 }
@@ -1,10 +1,14 @@
 package memt
 
 import (
+	"errors"
 	log "github.com/jeanphorn/log4go"
 	"github.com/nikita-tomilov/golsm/commitlog"
+	"github.com/nikita-tomilov/golsm/errs"
 	"github.com/nikita-tomilov/golsm/utils"
 	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -19,10 +23,10 @@ func TestMemTManager_SanityCheck(t *testing.T) {
 	m.MergeWithCommitlog(actualEntries)
 
 	//then
-	assert.Equal(t, 2, len(m.memtForTag), "mt count mismatch")
+	assert.Equal(t, 2, len(m.GetTags()), "mt count mismatch")
 
-	st1 := m.memtForTag["tagZero"]
-	st2 := m.memtForTag["tagOne"]
+	st1 := m.MemTableForTag("tagZero")
+	st2 := m.MemTableForTag("tagOne")
 
 	st1e := st1.RetrieveAll()
 	st2e := st2.RetrieveAll()
@@ -35,10 +39,10 @@ func TestMemTManager_SanityCheck(t *testing.T) {
 	m.MergeWithCommitlog(actualEntries2)
 
 	//then
-	assert.Equal(t, 2, len(m.memtForTag), "mt count mismatch")
+	assert.Equal(t, 2, len(m.GetTags()), "mt count mismatch")
 
-	st1 = m.memtForTag["tagZero"]
-	st2 = m.memtForTag["tagOne"]
+	st1 = m.MemTableForTag("tagZero")
+	st2 = m.MemTableForTag("tagOne")
 
 	st1e = st1.RetrieveAll()
 	st2e = st2.RetrieveAll()
@@ -49,6 +53,68 @@ func TestMemTManager_SanityCheck(t *testing.T) {
 	log.Close()
 }
 
+func TestMemTManager_RejectsMergesWhenClosed(t *testing.T) {
+	//given
+	m := Manager{}
+	m.InitStorage()
+
+	//when
+	m.CloseStorage()
+	err := m.MergeWithCommitlog(getDummyCommitlogEntriesForMultipleTags())
+	_, _, availabilityErr := m.Availability()
+
+	//then
+	assert.True(t, errors.Is(err, errs.ErrClosed), "merge into closed memt was not rejected")
+	assert.True(t, errors.Is(availabilityErr, errs.ErrClosed), "closed memt reported availability")
+	assert.Equal(t, 0, len(m.GetTags()), "entries were merged into closed memt")
+}
+
+func TestMemTManager_ReleasingTombstonesDoesNotRecreateDroppedTag(t *testing.T) {
+	//given
+	m := Manager{}
+	m.InitStorage()
+	tombstone := commitlog.NewTombstone([]byte("tagZero"), 1000, 2000)
+	m.MergeWithCommitlog([]commitlog.Entry{tombstone})
+	m.DropTag("tagZero")
+
+	//when
+	m.ReleaseTombstones([]commitlog.Entry{tombstone})
+
+	//then
+	assert.Equal(t, 0, len(m.GetTags()), "dropped tag was created again")
+}
+
+func TestMemTManager_ConcurrentTagsAreNotLost(t *testing.T) {
+	//given
+	m := Manager{MaxEntriesPerTag: 9999, PerformExpirationEvery: 10 * time.Millisecond}
+	m.InitStorage()
+	expiresAt := utils.GetNowMillis() + 100000
+
+	//when
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				tag := "tag" + strconv.Itoa(i)
+				e := commitlog.Entry{Key: []byte(tag), Timestamp: uint64(1337 + w), ExpiresAt: expiresAt, Value: make([]byte, 4)}
+				assert.Nil(t, m.MergeWithCommitlog([]commitlog.Entry{e}), "merge failed")
+				m.MemTableForTag(tag).RetrieveAll()
+				m.Availability()
+			}
+		}(w)
+	}
+	wg.Wait()
+	m.CloseStorage()
+
+	//then
+	assert.Equal(t, 200, len(m.GetTags()), "tags were lost")
+	for i := 0; i < 200; i++ {
+		assert.Equal(t, 16, len(m.MemTableForTag("tag"+strconv.Itoa(i)).RetrieveAll()), "entries were lost")
+	}
+}
+
 func TestMemTManager_MaxEntriesPerTagWorks(t *testing.T) {
 	//given
 	m := Manager{MaxEntriesPerTag:2}
@@ -59,10 +125,10 @@ func TestMemTManager_MaxEntriesPerTagWorks(t *testing.T) {
 	m.MergeWithCommitlog(actualEntries)
 
 	//then
-	assert.Equal(t, 2, len(m.memtForTag), "mt count mismatch")
+	assert.Equal(t, 2, len(m.GetTags()), "mt count mismatch")
 
-	st1 := m.memtForTag["tagZero"]
-	st2 := m.memtForTag["tagOne"]
+	st1 := m.MemTableForTag("tagZero")
+	st2 := m.MemTableForTag("tagOne")
 
 	st1e := st1.RetrieveAll()
 	st2e := st2.RetrieveAll()
@@ -80,10 +146,10 @@ func TestMemTManager_MaxEntriesPerTagWorks(t *testing.T) {
 	m.MergeWithCommitlog(actualEntries2)
 
 	//then
-	assert.Equal(t, 2, len(m.memtForTag), "mt count mismatch")
+	assert.Equal(t, 2, len(m.GetTags()), "mt count mismatch")
 
-	st1 = m.memtForTag["tagZero"]
-	st2 = m.memtForTag["tagOne"]
+	st1 = m.MemTableForTag("tagZero")
+	st2 = m.MemTableForTag("tagOne")
 
 	st1e = st1.RetrieveAll()
 	st2e = st2.RetrieveAll()
@@ -109,16 +175,16 @@ func TestMemTManager_ExpirationWorks(t *testing.T) {
 	m.MergeWithCommitlog(actualEntries)
 
 	//then
-	assert.Equal(t, 1, len(m.memtForTag), "mt count mismatch")
+	assert.Equal(t, 1, len(m.GetTags()), "mt count mismatch")
 
-	st1 := m.memtForTag["tagZero"]
+	st1 := m.MemTableForTag("tagZero")
 	st1e := st1.RetrieveAll()
 
 	assert.Equal(t, 2, len(st1e), "dto count in mt mismatch for tagZero before expiration")
 
 	time.Sleep(m.PerformExpirationEvery * 3)
 
-	st1 = m.memtForTag["tagZero"]
+	st1 = m.MemTableForTag("tagZero")
 	st1e = st1.RetrieveAll()
 
 	assert.Equal(t, 1, len(st1e), "dto count in mt mismatch for tagZero after expiration")
@@ -152,4 +218,22 @@ func getDummyCommitlogEntriesForExpirationTest() []commitlog.Entry {
 	ans[0] = commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1347, ExpiresAt: expiresAt, Value: make([]byte, 4)}
 	ans[1] = commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1345, ExpiresAt: expiresAt + 5000, Value: make([]byte, 2)}
 	return ans
-}
\ No newline at end of file
+}
+
+func TestMemTManager_SnapshotIsNotChangedByLaterMerges(t *testing.T) {
+	//given
+	m := Manager{}
+	m.InitStorage()
+	defer m.CloseStorage()
+	m.MergeWithCommitlog([]commitlog.Entry{{Key: []byte("tagZero"), Timestamp: 1337, Value: make([]byte, 4)}})
+	snapshot := m.MemTableForTag("tagZero").Snapshot()
+
+	//when
+	m.MergeWithCommitlog([]commitlog.Entry{{Key: []byte("tagZero"), Timestamp: 1339, Value: make([]byte, 4)}})
+	m.MergeWithCommitlog([]commitlog.Entry{commitlog.NewTombstone([]byte("tagZero"), 0, 2000)})
+
+	//then
+	assert.Equal(t, 1, len(snapshot.RetrieveAll()), "snapshot saw the later entries")
+	assert.False(t, snapshot.IsDeleted(1337), "snapshot saw the later tombstone")
+	assert.Equal(t, 0, len(m.MemTableForTag("tagZero").RetrieveAll()), "table was not changed")
+}
@@ -0,0 +1,132 @@
+package sst
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+//Codec compresses the SST blocks; the codec id is stored within every block,
+//so a segment can be read as long as the codecs it was written with are registered
+type Codec interface {
+	Id() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+const (
+	CodecIdNone  = 0
+	CodecIdFlate = 1
+	CodecIdGzip  = 2
+)
+
+var CodecNone Codec = noneCodec{}
+
+var CodecFlate Codec = flateCodec{}
+
+var CodecGzip Codec = gzipCodec{}
+
+var DefaultCodec = CodecFlate
+
+var codecs = map[byte]Codec{CodecIdNone: CodecNone, CodecIdFlate: CodecFlate, CodecIdGzip: CodecGzip, CodecIdGorilla: CodecGorilla}
+
+var codecsMutex = &sync.RWMutex{}
+
+//RegisterCodec makes the codec available for reading the blocks written with it
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	codecs[codec.Id()] = codec
+}
+
+var codecNames = map[string]Codec{"none": CodecNone, "flate": CodecFlate, "gzip": CodecGzip, "gorilla": CodecGorilla}
+
+//CodecByName returns the built-in codec by the name used in the config files: none, flate, gzip or gorilla
+func CodecByName(name string) (Codec, error) {
+	codec, exists := codecNames[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return codec, nil
+}
+
+func codecById(id byte) (Codec, error) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	codec, exists := codecs[id]
+	if !exists {
+		return nil, fmt.Errorf("unknown codec %d", id)
+	}
+	return codec, nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Id() byte {
+	return CodecIdNone
+}
+
+func (noneCodec) Compress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (noneCodec) Decompress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Id() byte {
+	return CodecIdFlate
+}
+
+func (flateCodec) Compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Id() byte {
+	return CodecIdGzip
+}
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
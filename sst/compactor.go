@@ -0,0 +1,66 @@
+package sst
+
+import (
+	"fmt"
+	log "github.com/jeanphorn/log4go"
+	"sync"
+	"sync/atomic"
+)
+
+//compactor runs the compactions requested by the tags on a dedicated goroutine, one tag at a time
+type compactor struct {
+	//reclaimedBytes is accessed atomically, so it goes first to stay 64-bit aligned
+	reclaimedBytes int64
+	mutex          *sync.Mutex
+	cond           *sync.Cond
+	queue          []*SSTforTag
+	pending        map[*SSTforTag]bool
+	stopping       bool
+}
+
+func newCompactor() *compactor {
+	mutex := &sync.Mutex{}
+	return &compactor{mutex: mutex, cond: sync.NewCond(mutex), queue: make([]*SSTforTag, 0), pending: make(map[*SSTforTag]bool)}
+}
+
+func (c *compactor) request(st *SSTforTag) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.pending[st] {
+		return
+	}
+	c.pending[st] = true
+	c.queue = append(c.queue, st)
+	c.cond.Signal()
+}
+
+//run returns once stop is called, finishing the compaction in progress and leaving the queued ones
+func (c *compactor) run() {
+	for {
+		c.mutex.Lock()
+		for (len(c.queue) == 0) && !c.stopping {
+			c.cond.Wait()
+		}
+		if c.stopping {
+			c.mutex.Unlock()
+			return
+		}
+		st := c.queue[0]
+		c.queue = c.queue[1:]
+		delete(c.pending, st)
+		c.mutex.Unlock()
+
+		reclaimed, err := st.Compact()
+		atomic.AddInt64(&c.reclaimedBytes, reclaimed)
+		if err != nil {
+			log.Error(fmt.Sprintf("Compaction of tag %s failed: %s", st.Tag, err.Error()))
+		}
+	}
+}
+
+func (c *compactor) stop() {
+	c.mutex.Lock()
+	c.stopping = true
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+}
@@ -19,6 +19,15 @@ func (e *Entry) ToString() string {
 	return string(b)
 }
 
+//fromByteArrayInPlace decodes the entry without copying its value, which keeps pointing into arr
+func fromByteArrayInPlace(arr []uint8) Entry {
+	return Entry{
+		Timestamp: binary.LittleEndian.Uint64(arr),
+		ExpiresAt: binary.LittleEndian.Uint64(arr[8:]),
+		Value:     arr[16:len(arr):len(arr)],
+	}
+}
+
 func FromByteArray(arr []uint8) Entry {
 	timestamp := binary.LittleEndian.Uint64(arr)
 	expiresAt := binary.LittleEndian.Uint64(arr[8:])
@@ -35,12 +44,10 @@ func FromByteArray(arr []uint8) Entry {
 
 func (e *Entry) ToByteArrayWithLength() []uint8 {
 	entryLen := len(e.Value) + 8 + 8
-	arr := make([]byte, entryLen + 2)
-	binary.LittleEndian.PutUint64(arr[2:], e.Timestamp)
-	binary.LittleEndian.PutUint64(arr[10:], e.ExpiresAt)
-	for i := 18; i < len(arr); i++ {
-		arr[i] = e.Value[i - 18]
-	}
-	binary.LittleEndian.PutUint16(arr, uint16(entryLen))
+	arr := make([]byte, entryLen+4)
+	binary.LittleEndian.PutUint64(arr[4:], e.Timestamp)
+	binary.LittleEndian.PutUint64(arr[12:], e.ExpiresAt)
+	copy(arr[20:], e.Value)
+	binary.LittleEndian.PutUint32(arr, uint32(entryLen))
 	return arr
-}
\ No newline at end of file
+}
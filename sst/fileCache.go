@@ -0,0 +1,156 @@
+package sst
+
+import (
+	"container/list"
+	"github.com/nikita-tomilov/golsm/errs"
+	"os"
+	"sync"
+)
+
+const DefaultMaxOpenFiles = 256
+
+//fileCache keeps the read-only handles of the segment files, shared by the concurrent readers as they read with ReadAt.
+//Up to capacity handles are kept open, closing the least recently used idle ones beyond it; the handles being read are never closed,
+//so the handles above the capacity only live while read. The nil cache opens the file for every read
+type fileCache struct {
+	capacity int
+	mutex    *sync.Mutex
+	handles  map[string]*fileHandle
+	//the idle handles, from the most to the least recently used
+	lru    *list.List
+	closed bool
+}
+
+type fileHandle struct {
+	*os.File
+	fileName string
+	refs     int
+	//set once the file is evicted, so that the handle is closed by the last reader
+	evicted bool
+	idle    *list.Element
+}
+
+func newFileCache(capacity int) *fileCache {
+	return &fileCache{capacity: capacity, mutex: &sync.Mutex{}, handles: make(map[string]*fileHandle), lru: list.New()}
+}
+
+//acquire returns the handle of the file, which is to be given back by release once read
+func (c *fileCache) acquire(fileName string) (*fileHandle, error) {
+	if c != nil {
+		c.mutex.Lock()
+		if c.closed {
+			c.mutex.Unlock()
+			return nil, errs.Closed("SST file cache")
+		}
+		h, exists := c.handles[fileName]
+		if exists {
+			c.use(h)
+		}
+		c.mutex.Unlock()
+		if exists {
+			return h, nil
+		}
+	}
+	file, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, errs.IO("opening SST segment "+fileName, err)
+	}
+	h := &fileHandle{File: file, fileName: fileName, refs: 1}
+	if c == nil {
+		return h, nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		file.Close()
+		return nil, errs.Closed("SST file cache")
+	}
+	//another reader may have opened the file meanwhile
+	if opened, exists := c.handles[fileName]; exists {
+		file.Close()
+		c.use(opened)
+		return opened, nil
+	}
+	c.handles[fileName] = h
+	c.shrink()
+	return h, nil
+}
+
+//must be called under the mutex
+func (c *fileCache) use(h *fileHandle) {
+	h.refs++
+	if h.idle != nil {
+		c.lru.Remove(h.idle)
+		h.idle = nil
+	}
+}
+
+func (c *fileCache) release(h *fileHandle) {
+	if c == nil {
+		h.Close()
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	h.refs--
+	if h.refs > 0 {
+		return
+	}
+	if h.evicted {
+		h.Close()
+		return
+	}
+	h.idle = c.lru.PushFront(h)
+	c.shrink()
+}
+
+//must be called under the mutex
+func (c *fileCache) shrink() {
+	for (len(c.handles) > c.capacity) && (c.lru.Len() > 0) {
+		c.evictHandle(c.lru.Back().Value.(*fileHandle))
+	}
+}
+
+//evict forgets the handle of the file before it is removed or moved; the handle is closed once the running reads are over
+func (c *fileCache) evict(fileName string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if h, exists := c.handles[fileName]; exists {
+		c.evictHandle(h)
+	}
+}
+
+//must be called under the mutex
+func (c *fileCache) evictHandle(h *fileHandle) {
+	delete(c.handles, h.fileName)
+	h.evicted = true
+	if h.idle != nil {
+		c.lru.Remove(h.idle)
+		h.idle = nil
+	}
+	if h.refs == 0 {
+		h.Close()
+	}
+}
+
+//closeAll closes every idle handle and refuses to open the files afterwards; the ones being read are closed by their last reader
+func (c *fileCache) closeAll() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	for _, h := range c.handles {
+		c.evictHandle(h)
+	}
+}
+
+func (c *fileCache) openFiles() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.handles)
+}
@@ -1,14 +1,13 @@
 package sst
 
 import (
-	"bufio"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"github.com/google/btree"
 	log "github.com/jeanphorn/log4go"
 	"github.com/nikita-tomilov/golsm/commitlog"
+	"github.com/nikita-tomilov/golsm/errs"
 	"github.com/nikita-tomilov/golsm/utils"
-	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -18,334 +17,768 @@ import (
 
 const DefaultSlicePreassignedMem = 0
 
+const DefaultCompactionFanIn = 4
+
+const DefaultExpiredFractionThreshold = 0.25
+
+const segmentTierBaseSize = 1024 * 1024
+
+const (
+	PartitionHourly = time.Hour
+	PartitionDaily  = 24 * time.Hour
+	PartitionWeekly = 7 * 24 * time.Hour
+)
+
+const DefaultPartitionWindow = PartitionDaily
+
+//SSTforTag stores the data for the tag as immutable sorted segments, one time partition each, merged by the compaction;
+//the segment files are kept under the ids the manifest of the directory of FileName maps to the Tag
 type SSTforTag struct {
-	Tag                     string
-	FileName                string
-	PerformCompactionEvery  time.Duration
-	file                    *os.File
-	mutex                   *sync.Mutex
-	index                   *btree.BTree
-	nextCompactionTimestamp uint64
+	Tag                      string
+	FileName                 string
+	CompactionFanIn          int
+	ExpiredFractionThreshold float64
+	PartitionWindow          time.Duration
+	Retention                time.Duration
+	Codec                    Codec
+	BlockSize                int
+	MemoryMapped             bool
+	compactionRequested      func(*SSTforTag)
+	//shared by the tags of the manager; a table opened by itself acquires the manifest of its directory until CloseStorage
+	manifest                 *manifest
+	ownsManifest             bool
+	//shared by the tags of the manager to bound the open files; a table opened by itself opens the file on every read
+	files                    *fileCache
+	mutex                    *sync.RWMutex
+	compactionMutex          *sync.Mutex
+	version                  *version
+	nextSegmentId            uint64
+}
+
+func (st *SSTforTag) InitStorage() error {
+	if err := os.MkdirAll(st.dir(), os.ModePerm); err != nil {
+		return errs.IO("creating SST directory "+st.dir(), err)
+	}
+	if st.CompactionFanIn == 0 {
+		st.CompactionFanIn = DefaultCompactionFanIn
+	}
+	if st.ExpiredFractionThreshold == 0 {
+		st.ExpiredFractionThreshold = DefaultExpiredFractionThreshold
+	}
+	if st.PartitionWindow == 0 {
+		st.PartitionWindow = DefaultPartitionWindow
+	}
+	//the partitions are aligned to whole milliseconds
+	if st.PartitionWindow < time.Millisecond {
+		return fmt.Errorf("partition window %s of SST %s is less than a millisecond", st.PartitionWindow, st.FileName)
+	}
+	if st.Codec == nil {
+		st.Codec = DefaultCodec
+	}
+	if st.BlockSize == 0 {
+		st.BlockSize = DefaultBlockSize
+	}
+	st.mutex = &sync.RWMutex{}
+	st.compactionMutex = &sync.Mutex{}
+	st.nextSegmentId = 1
+	if st.Tag == "" {
+		st.Tag = filepath.Base(st.FileName)
+	}
+	if st.manifest == nil {
+		m, err := acquireManifest(st.dir())
+		if err != nil {
+			return err
+		}
+		st.manifest = m
+		st.ownsManifest = true
+	}
+	if err := st.openSegments(); err != nil {
+		st.releaseManifest()
+		return err
+	}
+	return nil
 }
 
-func (st *SSTforTag) InitStorage() {
-	dir, _ := filepath.Split(st.FileName)
-	os.MkdirAll(dir, os.ModePerm)
-	st.index = btree.New(4)
-	if st.PerformCompactionEvery == 0 {
-		st.PerformCompactionEvery = time.Minute * 10
+func (st *SSTforTag) openSegments() error {
+	if err := st.importLegacyFiles(); err != nil {
+		return err
 	}
-	if utils.FileExists(st.FileName) {
-		st.initOverExistingFile()
-	} else {
-		st.initOverNewFile()
+
+	segments := make([]*segment, 0)
+	for _, ms := range st.manifest.segmentsOf(st.Tag) {
+		//the ids of the quarantined segments are not reused, so that Repair can put the salvaged segments back in their place
+		if ms.id >= st.nextSegmentId {
+			st.nextSegmentId = ms.id + 1
+		}
+		if ms.quarantined {
+			continue
+		}
+		s, err := st.openOrQuarantine(ms)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			segments = append(segments, s)
+		}
 	}
+	sortSegments(segments)
+	st.version = newVersion(segments)
+	return nil
 }
 
-func (st *SSTforTag) initOverNewFile() {
-	file, err := os.OpenFile(st.FileName, os.O_CREATE|os.O_WRONLY, 0644)
-	utils.Check(err)
-	st.file = file
-	st.mutex = &sync.Mutex{}
+//CloseStorage closes the table opened by itself; the tables of a manager are closed by the manager
+func (st *SSTforTag) CloseStorage() {
+	st.close()
 }
 
-func (st *SSTforTag) initOverExistingFile() {
-	file, err := os.OpenFile(st.FileName, os.O_APPEND|os.O_WRONLY, 0644)
-	utils.Check(err)
-	st.file = file
-	st.mutex = &sync.Mutex{}
-	st.rebuildIndex()
+func (st *SSTforTag) releaseManifest() {
+	if st.ownsManifest {
+		st.ownsManifest = false
+		st.manifest.release()
+	}
 }
 
-func (st *SSTforTag) reopenFile() {
-	file, err := os.OpenFile(st.FileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	utils.Check(err)
-	st.file = file
+//the segments are kept in the directory of FileName
+func (st *SSTforTag) dir() string {
+	return filepath.Dir(st.FileName)
 }
 
-func (st *SSTforTag) rebuildIndex() {
-	st.iterateOverFileAndApplyForAllEntries(func(e Entry, o int64) {
-		st.index.ReplaceOrInsert(buildIndexEntry(e.Timestamp, o, e.ExpiresAt))
+//sortSegments orders the segments from the oldest to the newest; the segments sharing an id never overlap
+func sortSegments(segments []*segment) {
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].id == segments[j].id {
+			return segments[i].partition < segments[j].partition
+		}
+		return segments[i].id < segments[j].id
 	})
 }
 
-func (st *SSTforTag) GetAllEntries() []Entry {
-	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
-	st.iterateOverFileAndApplyForAllEntries(func(e Entry, o int64) {
-		ans = append(ans, e)
+func (st *SSTforTag) partitionOf(ts uint64) uint64 {
+	window := uint64(st.PartitionWindow.Milliseconds())
+	return ts - ts%window
+}
+
+type partitionEntries struct {
+	partition uint64
+	entries   []Entry
+}
+
+//splitByPartition splits the sorted entries into the consecutive groups belonging to the same time partition
+func (st *SSTforTag) splitByPartition(entries []Entry) []partitionEntries {
+	ans := make([]partitionEntries, 0)
+	for i, entry := range entries {
+		partition := st.partitionOf(entry.Timestamp)
+		if (i == 0) || (ans[len(ans)-1].partition != partition) {
+			ans = append(ans, partitionEntries{partition: partition, entries: make([]Entry, 0)})
+		}
+		ans[len(ans)-1].entries = append(ans[len(ans)-1].entries, entry)
+	}
+	return ans
+}
+
+func (st *SSTforTag) GetAllEntries() ([]Entry, error) {
+	snapshot := st.Snapshot()
+	defer snapshot.Release()
+	return snapshot.detachAll(snapshot.GetAllEntries())
+}
+
+func (st *SSTforTag) getCurrentMinTimestamp() uint64 {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	ans := uint64(0)
+	for _, s := range st.version.segments {
+		ts := s.minTimestamp()
+		if (ts != 0) && ((ans == 0) || (ts < ans)) {
+			ans = ts
+		}
+	}
+	return ans
+}
+
+func (st *SSTforTag) getCurrentMaxTimestamp() uint64 {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	ans := uint64(0)
+	for _, s := range st.version.segments {
+		ts := s.maxTimestamp()
+		if ts > ans {
+			ans = ts
+		}
+	}
+	return ans
+}
+
+func (st *SSTforTag) MergeWithCommitlog(commitlogEntries []commitlog.Entry) error {
+	written, err := st.writeFromCommitlog(commitlogEntries)
+	if err != nil {
+		return err
+	}
+	if err := st.installSegments(written, nil); err != nil {
+		return err
+	}
+	return st.afterFlush()
+}
+
+//writeFromCommitlog writes the entries as the segments per partition, which are to be installed
+func (st *SSTforTag) writeFromCommitlog(commitlogEntries []commitlog.Entry) ([]*segment, error) {
+	sorted, deletions := resolveCommitlog(commitlogEntries)
+	entries := make([]Entry, len(sorted))
+	for i, entry := range sorted {
+		entries[i] = Entry{Timestamp: entry.Timestamp, ExpiresAt: entry.ExpiresAt, Value: entry.Value}
+	}
+
+	parts := st.splitByPartition(entries)
+	tombstones := st.splitTombstonesByPartition(st.clipToStoredEntries(deletions))
+	for partition := range tombstones {
+		if !containsPartition(parts, partition) {
+			parts = append(parts, partitionEntries{partition: partition, entries: make([]Entry, 0)})
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].partition < parts[j].partition
 	})
-	sort.Slice(ans, func(i, j int) bool {
-		return ans[i].Timestamp < ans[j].Timestamp
+
+	written := make([]*segment, 0, len(parts))
+	for _, part := range parts {
+		st.mutex.Lock()
+		id := st.nextSegmentId
+		st.nextSegmentId++
+		st.mutex.Unlock()
+
+		s, err := writeSegment(st.files, st.MemoryMapped, st.dir(), st.manifest.newFileId(), part.partition, id, part.entries, tombstones[part.partition], st.Codec, st.BlockSize)
+		if (err == nil) && (s.entriesInFile == 0) && (len(s.tombstones) == 0) {
+			if err = s.remove(); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			removeSegments(written)
+			return nil, err
+		}
+		log.Debug(fmt.Sprintf("Wrote segment %d of %d entries and %d tombstones in partition %d for tag %s", id, len(part.entries), len(s.tombstones), part.partition, st.Tag))
+		written = append(written, s)
+	}
+	return written, nil
+}
+
+//afterFlush requests the compaction if the flushed segments made it needed
+func (st *SSTforTag) afterFlush() error {
+	if st.needsCompaction() {
+		if st.compactionRequested != nil {
+			st.compactionRequested(st)
+		} else if _, err := st.Compact(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//for equal timestamps, the entry that came later in the commitlog wins
+func sortAndDeduplicate(commitlogEntries []commitlog.Entry) []commitlog.Entry {
+	sorted := commitlogEntries
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp < sorted[j].Timestamp
 	})
+	ans := sorted[:0]
+	for i, entry := range sorted {
+		if (i+1 < len(sorted)) && (sorted[i+1].Timestamp == entry.Timestamp) {
+			continue
+		}
+		ans = append(ans, entry)
+	}
 	return ans
 }
 
-func (st *SSTforTag) iterateOverFileAndApplyForAllEntries(receiver func(Entry, int64)) {
-	st.iterateOverFileAndApplyForEntries(0, int((^uint(0))>>1), receiver)
+//clipToStoredEntries narrows the tombstones down to the ranges of the entries already stored,
+//since there is nothing to delete outside of them; the quarantined segments count as stored
+func (st *SSTforTag) clipToStoredEntries(deletions []tombstone) []tombstone {
+	quarantined := st.quarantinedRanges(st.quarantinedSegments(), math.MaxUint64)
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	ans := make([]tombstone, 0)
+	for _, t := range deletions {
+		for _, s := range st.version.segments {
+			if s.overlapsEntries(t.from, t.to) {
+				ans = append(ans, t.clip(s.firstTs, s.lastTs))
+			}
+		}
+		for _, q := range quarantined {
+			if t.overlaps(q.from, q.to) {
+				ans = append(ans, t.clip(q.from, q.to))
+			}
+		}
+	}
+	return ans
 }
 
-func (st *SSTforTag) iterateOverFileAndApplyForEntries(fileOffsetBytes int64, entriesCount int, receiver func(Entry, int64)) {
-	st.mutex.Lock()
-	file, err := os.OpenFile(st.FileName, os.O_RDONLY, 0644)
-	utils.Check(err)
+//splitTombstonesByPartition cuts the tombstones at the partition boundaries
+func (st *SSTforTag) splitTombstonesByPartition(tombstones []tombstone) map[uint64][]tombstone {
+	window := uint64(st.PartitionWindow.Milliseconds())
+	ans := make(map[uint64][]tombstone)
+	for _, t := range tombstones {
+		for partition := st.partitionOf(t.from); partition <= t.to; partition += window {
+			piece := t
+			if piece.from < partition {
+				piece.from = partition
+			}
+			if piece.to > partition+window-1 {
+				piece.to = partition + window - 1
+			}
+			ans[partition] = append(ans[partition], piece)
+			if partition+window < partition {
+				break
+			}
+		}
+	}
+	return ans
+}
 
-	if fileOffsetBytes > 0 {
-		_, ok := file.Seek(fileOffsetBytes, 0)
-		utils.Check(ok)
+func containsPartition(parts []partitionEntries, partition uint64) bool {
+	for _, part := range parts {
+		if part.partition == partition {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *SSTforTag) needsCompaction() bool {
+	if (len(st.pickOutdatedSegments()) > 0) || (st.pickSegmentToPartition() != nil) || (len(st.pickSegmentsToPurge()) > 0) {
+		return true
+	}
+	if len(st.pickSegmentsToResolveTombstones()) > 0 {
+		return true
+	}
+	return len(st.pickSegmentsToCompact()) > 0
+}
+
+//Compact drops the outdated segments, splits the segments written before the partitioning into partitions,
+//merges the segments having the tombstones with the older segments of their partition to drop the deleted entries,
+//rewrites the segments having more than ExpiredFractionThreshold of the entries expired
+//and merges every run of CompactionFanIn or more adjacent segments of the same size tier within a partition;
+//it returns the amount of bytes reclaimed on disk, even if it has failed midway
+func (st *SSTforTag) Compact() (int64, error) {
+	st.compactionMutex.Lock()
+	defer st.compactionMutex.Unlock()
+
+	reclaimed, err := st.compact()
+	if reclaimed != 0 {
+		log.Info(fmt.Sprintf("Compaction of tag %s reclaimed %d bytes", st.Tag, reclaimed))
+	}
+	return reclaimed, err
+}
+
+func (st *SSTforTag) compact() (int64, error) {
+	reclaimed, err := st.dropOutdatedSegments()
+	if err != nil {
+		return reclaimed, err
 	}
-	reader := bufio.NewReader(file)
 
-	readerFileOffset := int64(fileOffsetBytes)
-	prevFileOffset := int64(fileOffsetBytes)
-	entriesParsed := 0
-	prevEntry := Entry{Timestamp: 0}
-	sizeBuf := make([]uint8, 2)
 	for {
-		n, err := io.ReadFull(reader, sizeBuf)
-		if n != 2 {
+		s := st.pickSegmentToPartition()
+		if s == nil {
 			break
 		}
-		readerFileOffset += int64(n)
-		utils.Check(err)
-		entrySize := int(binary.LittleEndian.Uint16(sizeBuf))
-		entryBytes := make([]uint8, entrySize)
-		n2, err := io.ReadFull(reader, entryBytes)
-		utils.Check(err)
-		if n2 != entrySize {
-			panic(fmt.Sprintf("read seems to be failed; expected to read %d, managed to read %d, parsed %d entries", entrySize, n2, entriesParsed))
-		}
-		readerFileOffset += int64(n2)
-		entry := FromByteArray(entryBytes)
-		if entry.Timestamp < prevEntry.Timestamp {
-			panic(fmt.Sprintf("SST was not sorted! prevEntry TS %d, now TS %d", prevEntry.Timestamp, entry.Timestamp))
-		}
-		prevEntry = entry
-		receiver(entry, prevFileOffset)
-		prevFileOffset = readerFileOffset
-		entriesParsed += 1
-		if entriesParsed >= entriesCount {
+		r, err := st.compactSegments([]*segment{s})
+		reclaimed += r
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+
+	for _, run := range st.pickSegmentsToResolveTombstones() {
+		r, err := st.compactSegments(run)
+		reclaimed += r
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+
+	for _, s := range st.pickSegmentsToPurge() {
+		r, err := st.compactSegments([]*segment{s})
+		reclaimed += r
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+
+	for {
+		run := st.pickSegmentsToCompact()
+		if len(run) == 0 {
 			break
 		}
+		r, err := st.compactSegments(run)
+		reclaimed += r
+		if err != nil {
+			return reclaimed, err
+		}
 	}
+	return reclaimed, nil
+}
 
-	err = file.Close()
-	utils.Check(err)
-	st.mutex.Unlock()
+func (st *SSTforTag) pickOutdatedSegments() []*segment {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	now := utils.GetNowMillis()
+	ans := make([]*segment, 0)
+	for _, s := range st.version.segments {
+		if s.isOutdated(now, st.Retention) {
+			ans = append(ans, s)
+		}
+	}
+	return ans
 }
 
-func (st *SSTforTag) getCurrentMinTimestamp() uint64 {
-	min := st.index.Min()
-	if min == nil {
-		return 0
+//dropOutdatedSegments removes the segments which hold nothing but the expired entries or the ones older than the retention
+func (st *SSTforTag) dropOutdatedSegments() (int64, error) {
+	outdated := st.pickOutdatedSegments()
+	if len(outdated) == 0 {
+		return 0, nil
+	}
+	reclaimed := int64(0)
+	for _, s := range outdated {
+		reclaimed += s.size
+		log.Debug(fmt.Sprintf("Dropping outdated segment %d in partition %d for tag %s", s.id, s.partition, st.Tag))
 	}
-	mine := min.(IndexEntry)
-	if (mine.expiresAt != 0) && (mine.expiresAt < utils.GetNowMillis()) {
-		st.performExpirationWithinIndex()
-		return st.getCurrentMinTimestamp()
-	} else {
-		return mine.ts
+	if err := st.installSegments(nil, outdated); err != nil {
+		return 0, err
 	}
+	return reclaimed, nil
 }
 
-func (st *SSTforTag) getCurrentMaxTimestamp() uint64 {
-	max := st.index.Max()
-	if max == nil {
-		return 0
+//pickSegmentsToPurge returns the segments having too many of the entries expired
+func (st *SSTforTag) pickSegmentsToPurge() []*segment {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	now := utils.GetNowMillis()
+	ans := make([]*segment, 0)
+	for _, s := range st.version.segments {
+		if s.expiredFraction(now) > st.ExpiredFractionThreshold {
+			ans = append(ans, s)
+		}
 	}
-	maxe := max.(IndexEntry)
-	if (maxe.expiresAt != 0) && (maxe.expiresAt < utils.GetNowMillis()) {
-		st.performExpirationWithinIndex()
-		return st.getCurrentMaxTimestamp()
-	} else {
-		return maxe.ts
+	return ans
+}
+
+func (st *SSTforTag) pickSegmentToPartition() *segment {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	for _, s := range st.version.segments {
+		if s.partition == noPartition {
+			return s
+		}
 	}
+	return nil
 }
 
-func (st *SSTforTag) performExpirationWithinIndex() {
-	toBeDeleted := make([]IndexEntry, 0, DefaultSlicePreassignedMem)
-	now := utils.GetNowMillis()
-	st.index.Ascend(func(i btree.Item) bool {
-		oe := i.(IndexEntry)
-		if (oe.expiresAt != 0) && (oe.expiresAt < now) {
-			toBeDeleted = append(toBeDeleted, oe)
+//segmentsByPartition groups the partitioned segments, keeping them ordered from the oldest to the newest
+func (st *SSTforTag) segmentsByPartition() [][]*segment {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	groups := make(map[uint64][]*segment)
+	partitions := make([]uint64, 0)
+	for _, s := range st.version.segments {
+		if s.partition == noPartition {
+			continue
 		}
-		return true
+		if _, exists := groups[s.partition]; !exists {
+			partitions = append(partitions, s.partition)
+		}
+		groups[s.partition] = append(groups[s.partition], s)
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i] < partitions[j]
 	})
-	for _, i := range toBeDeleted {
-		st.index.Delete(i)
+	ans := make([][]*segment, len(partitions))
+	for i, partition := range partitions {
+		ans[i] = groups[partition]
 	}
+	return ans
 }
 
-func (st *SSTforTag) MergeWithCommitlog(commitlogEntries []commitlog.Entry) {
-	sorted := commitlogEntries
-	sort.Slice(sorted, func(i, j int) bool {
-		return sorted[i].Timestamp < sorted[j].Timestamp
-	})
-	minimalTimestamp := sorted[0].Timestamp
-	if st.getCurrentMinTimestamp() != 0 {
-		if (minimalTimestamp >= st.getCurrentMaxTimestamp()) && (st.nextCompactionTimestamp > utils.GetNowMillis()) {
-			st.appendDataToEndOfTable(sorted)
-		} else {
-			st.addDataResortingTable(sorted)
-		}
-	} else {
-		st.appendDataToEndOfTable(sorted)
-	}
-}
-
-func (st *SSTforTag) appendDataToEndOfTable(commitlogEntries []commitlog.Entry) {
-	log.Debug("Appending to end of table")
-	st.mutex.Lock()
-	offset, err := st.file.Seek(0, utils.WhenceRelativeToEndOfFile)
-	utils.Check(err)
-	writer := bufio.NewWriter(st.file)
-	for _, entry := range commitlogEntries {
-		sstEntry := Entry{Timestamp: entry.Timestamp, ExpiresAt: entry.ExpiresAt, Value: entry.Value}
-		st.index.ReplaceOrInsert(buildIndexEntry(sstEntry.Timestamp, offset, sstEntry.ExpiresAt))
-		offset += writeEntryToFile(sstEntry, writer)
-	}
-	err = writer.Flush()
-	st.file.Sync()
-	utils.Check(err)
-	st.mutex.Unlock()
-}
-
-func (st *SSTforTag) addDataResortingTable(commitlogEntries []commitlog.Entry) {
-	log.Debug("Adding and resorting the table")
-	//TODO: what should I do if there is equal TS in both commitlog and already existing file?
-	copyFileName := st.FileName + ".copy"
-	copyFile, err := os.OpenFile(copyFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	utils.Check(err)
-	writer := bufio.NewWriter(copyFile)
-	idx := 0
-
-	//over sstable
-	st.iterateOverFileAndApplyForAllEntries(func(sstEntry Entry, o int64) {
-		banExistingEntry := false
-		for idx < len(commitlogEntries) {
-			commitlogEntry := commitlogEntries[idx]
-			if commitlogEntry.Timestamp <= sstEntry.Timestamp {
-				newSstEntry := Entry{Timestamp: commitlogEntry.Timestamp, ExpiresAt: commitlogEntry.ExpiresAt, Value: commitlogEntry.Value}
-				writeEntryToFile(newSstEntry, writer)
-				//log.Debug("write new %d", newSstEntry.Timestamp)
-				if commitlogEntry.Timestamp == sstEntry.Timestamp {
-					banExistingEntry = true
-				}
-				idx++
-			} else {
+//pickSegmentsToResolveTombstones returns, per partition, the run from the oldest segment to the newest one having the tombstones
+func (st *SSTforTag) pickSegmentsToResolveTombstones() [][]*segment {
+	ans := make([][]*segment, 0)
+	for _, group := range st.segmentsByPartition() {
+		for i := len(group) - 1; i >= 0; i-- {
+			if len(group[i].tombstones) > 0 {
+				ans = append(ans, group[:i+1])
 				break
 			}
 		}
-		if !banExistingEntry {
-			writeEntryToFile(sstEntry, writer)
-			//log.Debug("write exis %d", sstEntry.Timestamp)
-		} else {
-			log.Warn("Not writing old entry for tag %s ts %d as there is newer entry", st.Tag, sstEntry.Timestamp)
+	}
+	return ans
+}
+
+//pickSegmentsToCompact looks for a run of adjacent segments of the same tier within a partition;
+//a segment written before the partitioning may overlap any partition, so it breaks the run
+func (st *SSTforTag) pickSegmentsToCompact() []*segment {
+	for _, group := range st.segmentsByPartition() {
+		partition := group[0].partition
+		st.mutex.RLock()
+		run := make([]*segment, 0)
+		for _, s := range st.version.segments {
+			if (s.partition != partition) && (s.partition != noPartition) {
+				continue
+			}
+			if (s.partition == partition) && ((len(run) == 0) || (st.segmentTier(s) == st.segmentTier(run[0]))) {
+				run = append(run, s)
+				continue
+			}
+			if len(run) >= st.CompactionFanIn {
+				break
+			}
+			run = make([]*segment, 0)
+			if s.partition == partition {
+				run = append(run, s)
+			}
 		}
-	})
+		st.mutex.RUnlock()
+		if len(run) >= st.CompactionFanIn {
+			return run
+		}
+	}
+	return nil
+}
+
+func (st *SSTforTag) segmentTier(s *segment) int {
+	tier := 0
+	limit := int64(segmentTierBaseSize)
+	for s.size > limit {
+		tier++
+		limit *= int64(st.CompactionFanIn)
+	}
+	return tier
+}
 
-	st.mutex.Lock()
+//compactSegments replaces the run of adjacent segments by a single one per partition,
+//each of them having the id of the newest segment of the run that overlaps its partition; returns the reclaimed bytes.
+//The tombstones of the run are applied to its entries and kept only while older segments outside of the run may hold the deleted entries
+func (st *SSTforTag) compactSegments(run []*segment) (int64, error) {
+	lists := make([][]Entry, len(run))
+	tombstones := make([][]tombstone, len(run))
+	for i, s := range run {
+		entries, err := s.allEntries()
+		if errors.Is(err, errs.ErrCorrupted) {
+			st.quarantineSegment(s, err)
+		}
+		if err != nil {
+			return 0, err
+		}
+		lists[i] = entries
+		tombstones[i] = s.tombstones
+	}
+	merged := resolveSegments(lists, tombstones)
+	kept := st.splitTombstonesByPartition(st.tombstonesToKeep(run))
+	parts := st.splitByPartition(merged)
+	for partition := range kept {
+		if !containsPartition(parts, partition) {
+			parts = append(parts, partitionEntries{partition: partition, entries: make([]Entry, 0)})
+		}
+	}
+	window := uint64(st.PartitionWindow.Milliseconds())
+	compacted := make([]*segment, 0)
+	for _, part := range parts {
+		id := uint64(0)
+		for _, s := range run {
+			if s.overlaps(part.partition, part.partition+window-1) && (s.id > id) {
+				id = s.id
+			}
+		}
+		c, err := writeSegment(st.files, st.MemoryMapped, st.dir(), st.manifest.newFileId(), part.partition, id, part.entries, kept[part.partition], st.Codec, st.BlockSize)
+		if (err == nil) && (c.entriesInFile == 0) && (len(c.tombstones) == 0) {
+			if err = c.remove(); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			removeSegments(compacted)
+			return 0, err
+		}
+		compacted = append(compacted, c)
+	}
 
-	//over still unprocessed new commitlog entries, if there are any
-	for idx < len(commitlogEntries) {
-		newEntry := commitlogEntries[idx]
-		sstEntry := Entry{Timestamp: newEntry.Timestamp, ExpiresAt: newEntry.ExpiresAt, Value: newEntry.Value}
-		writeEntryToFile(sstEntry, writer)
-		idx += 1
+	reclaimed := int64(0)
+	for _, s := range run {
+		reclaimed += s.size
+	}
+	for _, c := range compacted {
+		reclaimed -= c.size
 	}
+	if err := st.installSegments(compacted, run); err != nil {
+		return 0, err
+	}
+	log.Debug(fmt.Sprintf("Compacted %d segments of tag %s into %d segments", len(run), st.Tag, len(compacted)))
+	return reclaimed, nil
+}
 
-	writer.Flush()
-	copyFile.Sync()
-	copyFile.Close()
+//installSegments replaces the segments by the written ones with a single edit of the manifest, so that a crash leaves either of them;
+//the written ones are removed if the edit fails, and the files of the replaced ones once their last reader is done
+func (st *SSTforTag) installSegments(written []*segment, replaced []*segment) error {
+	if (len(written) == 0) && (len(replaced) == 0) {
+		return nil
+	}
+	ops, err := st.installFiles(written)
+	if err != nil {
+		return err
+	}
+	for _, s := range replaced {
+		ops = append(ops, manifestOp{kind: opRemoveSegment, tag: st.Tag, segment: s.manifestSegment()})
+	}
+	if err := st.manifest.apply(ops...); err != nil {
+		removeSegments(written)
+		return err
+	}
+	st.publish(written, replaced)
+	return nil
+}
 
-	st.file.Close()
-	err = os.Rename(copyFileName, st.FileName)
-	utils.Check(err)
-	st.mutex.Unlock()
-	st.reopenFile()
-	st.rebuildIndex()
-	st.nextCompactionTimestamp = utils.GetNowMillis() + uint64(st.PerformCompactionEvery.Milliseconds())
+//installFiles gives the written segments their final names and returns the edits of the manifest adding them;
+//the segments are removed on failure
+func (st *SSTforTag) installFiles(written []*segment) ([]manifestOp, error) {
+	ops := make([]manifestOp, 0, len(written))
+	for _, s := range written {
+		if err := s.install(); err != nil {
+			removeSegments(written)
+			return nil, err
+		}
+		ops = append(ops, manifestOp{kind: opAddSegment, tag: st.Tag, segment: s.manifestSegment()})
+	}
+	return ops, nil
 }
 
-func (st *SSTforTag) GetEntriesWithoutIndex(fromTs uint64, toTs uint64) []Entry {
-	if st.index.Len() == 0 {
-		return []Entry{}
+//publish makes the installed segments replace the given ones in the current version
+func (st *SSTforTag) publish(written []*segment, replaced []*segment) {
+	isReplaced := make(map[*segment]bool)
+	for _, s := range replaced {
+		isReplaced[s] = true
 	}
-	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
-	now := utils.GetNowMillis()
-	st.iterateOverFileAndApplyForAllEntries(func(e Entry, o int64) {
-		if (e.Timestamp > 0) && (e.Timestamp >= fromTs) && (e.Timestamp <= toTs) && ((e.ExpiresAt == 0) || (e.ExpiresAt >= now)) {
-			ans = append(ans, e)
+	st.setVersion(func(segments []*segment) []*segment {
+		ans := make([]*segment, 0, len(segments)+len(written))
+		for _, s := range segments {
+			if !isReplaced[s] {
+				ans = append(ans, s)
+			}
 		}
+		return append(ans, written...)
 	})
-	return ans
 }
 
-func (st *SSTforTag) GetEntriesWithIndex(fromTs uint64, toTs uint64) []Entry {
-	count := 0
-	firstOffset := int64(-1)
-	now := utils.GetNowMillis()
-	if st.index.Len() == 0 {
-		return []Entry{}
+func removeSegments(segments []*segment) {
+	for _, s := range segments {
+		s.remove()
 	}
-	st.mutex.Lock()
-	st.index.AscendRange(buildIndexEntry(fromTs, 0, 0), buildIndexEntry(toTs+1, 0, 0), func(i btree.Item) bool {
-		oe := i.(IndexEntry)
-		if (oe.expiresAt != 0) && (oe.expiresAt < now) {
-			return true
+}
+
+//tombstonesToKeep returns the tombstones of the run that still may delete the entries of the older segments outside of it,
+//the quarantined ones included
+func (st *SSTforTag) tombstonesToKeep(run []*segment) []tombstone {
+	quarantined := st.quarantinedSegments()
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	inRun := make(map[*segment]bool)
+	newestId := uint64(0)
+	for _, s := range run {
+		inRun[s] = true
+		if s.id > newestId {
+			newestId = s.id
 		}
-		//log.Debug(fmt.Sprintf("ascendRange on tag %s entry ts %d offset %d", st.Tag, oe.ts, oe.fileOffset))
-		if firstOffset == -1 {
-			firstOffset = oe.fileOffset
+	}
+	ans := make([]tombstone, 0)
+	for _, s := range run {
+		olderInQuarantine := st.quarantinedRanges(quarantined, s.id)
+		for _, t := range s.tombstones {
+			kept := false
+			for _, older := range st.version.segments {
+				if !inRun[older] && (older.id < s.id) && older.overlapsEntries(t.from, t.to) {
+					kept = true
+					break
+				}
+			}
+			for _, q := range olderInQuarantine {
+				kept = kept || t.overlaps(q.from, q.to)
+			}
+			if kept {
+				ans = append(ans, t)
+			}
 		}
-		count += 1
-		return true
-	})
-	st.mutex.Unlock()
+	}
+	return ans
+}
+
+//mergeSorted merges the lists sorted by timestamp; for equal timestamps, the entry from the later list wins
+func mergeSorted(lists [][]Entry) []Entry {
 	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
-	countInFile := 0
-	st.iterateOverFileAndApplyForEntries(firstOffset, count, func(e Entry, i int64) {
-		if (e.Timestamp > 0) && (e.Timestamp >= fromTs) && (e.Timestamp <= toTs) && ((e.ExpiresAt == 0) || (e.ExpiresAt >= now)) {
-			ans = append(ans, e)
+	for _, list := range lists {
+		merged := make([]Entry, 0, len(ans)+len(list))
+		i, j := 0, 0
+		for (i < len(ans)) || (j < len(list)) {
+			if (j == len(list)) || ((i < len(ans)) && (ans[i].Timestamp < list[j].Timestamp)) {
+				merged = append(merged, ans[i])
+				i++
+				continue
+			}
+			if (i < len(ans)) && (ans[i].Timestamp == list[j].Timestamp) {
+				i++
+			}
+			merged = append(merged, list[j])
+			j++
 		}
-		countInFile++
-	})
-	if len(ans) != count {
-		panic(fmt.Sprintf("MISMATCH IN LENGTH ON TAG %s: INDEX SAID %d, IN REALITY WAS %d", st.Tag, count, len(ans)))
+		ans = merged
 	}
 	return ans
 }
 
-func (st *SSTforTag) Availability() (uint64, uint64) {
-	return st.getCurrentMinTimestamp(), st.getCurrentMaxTimestamp()
+func (st *SSTforTag) GetEntriesWithoutIndex(fromTs uint64, toTs uint64) ([]Entry, error) {
+	snapshot := st.Snapshot()
+	defer snapshot.Release()
+	return snapshot.detachAll(snapshot.GetEntriesWithoutIndex(fromTs, toTs))
+}
+
+func (st *SSTforTag) GetEntriesWithIndex(fromTs uint64, toTs uint64) ([]Entry, error) {
+	snapshot := st.Snapshot()
+	defer snapshot.Release()
+	return snapshot.detachAll(snapshot.GetEntriesWithIndex(fromTs, toTs))
 }
 
-func writeEntryToFile(e Entry, w *bufio.Writer) int64 {
-	if (e.ExpiresAt != 0) && (e.ExpiresAt < utils.GetNowMillis()) {
-		log.Debug("Attempt to WriteEntryToFile that was expired")
-		return 0
+//Drop removes all the segments of the tag from the disk, the quarantined ones included;
+//the files being read are removed once their last reader is done
+func (st *SSTforTag) Drop() error {
+	st.compactionMutex.Lock()
+	defer st.compactionMutex.Unlock()
+	quarantined := st.quarantinedFiles()
+	if err := st.manifest.apply(manifestOp{kind: opDropTag, tag: st.Tag}); err != nil {
+		return err
 	}
-	bytes := e.ToByteArrayWithLength()
-	n, err := w.Write(bytes)
-	utils.Check(err)
-	if n != len(bytes) {
-		panic("write seems to be failed")
+	st.setVersion(func(segments []*segment) []*segment {
+		return make([]*segment, 0)
+	})
+	for _, q := range quarantined {
+		if err := os.Remove(q.fileName); err != nil {
+			return errs.IO("removing quarantined SST file "+q.fileName, err)
+		}
 	}
-	return int64(n)
-	//log.Debug(fmt.Sprintf("Wrote disk entry for ts %d of bytes count %d", e.Timestamp, len(bytes)))
+	log.Info(fmt.Sprintf("Dropped tag %s", st.Tag))
+	return nil
 }
 
-type IndexEntry struct {
-	ts         uint64
-	fileOffset int64
-	expiresAt  uint64
+func (st *SSTforTag) Availability() (uint64, uint64) {
+	return st.getCurrentMinTimestamp(), st.getCurrentMaxTimestamp()
 }
 
-func (e IndexEntry) Less(than btree.Item) bool {
-	oe := than.(IndexEntry)
-	return e.ts < oe.ts
+func (st *SSTforTag) SegmentsCount() int {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return len(st.version.segments)
 }
 
-func buildIndexEntry(ts uint64, offset int64, expiresAt uint64) btree.Item {
-	return IndexEntry{ts, offset, expiresAt}
+//StoredEntriesCount returns the count of the entries written to the segment files, the deleted and the expired ones included
+func (st *SSTforTag) StoredEntriesCount() int {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	ans := 0
+	for _, s := range st.version.segments {
+		ans += s.entriesInFile
+	}
+	return ans
 }
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	log "github.com/jeanphorn/log4go"
 	"math/rand"
-	"os"
 	"testing"
 	"time"
 )
@@ -16,7 +15,7 @@ func BenchmarkGetEntriesWithIndex(b *testing.B) {
 
 	functions := []struct {
 		name string
-		fun  func(fromTs uint64, toTs uint64) []Entry
+		fun  func(fromTs uint64, toTs uint64) ([]Entry, error)
 	}{
 		{"with index on ssd", stSsd.GetEntriesWithIndex},
 		{"without index on ssd", stSsd.GetEntriesWithoutIndex},
@@ -32,7 +31,7 @@ func BenchmarkGetEntriesWithIndex(b *testing.B) {
 				if to-from <= 10 {
 					from -= 10
 				}
-				slice := function.fun(from, to)
+				slice := must(function.fun(from, to))
 				if len(slice) == 0 {
 					log.Warn(fmt.Sprintf("Slice empty for from; to %d; %d", from, to))
 				}
@@ -42,10 +41,48 @@ func BenchmarkGetEntriesWithIndex(b *testing.B) {
 	}
 }
 
+//the values only share the mapped memory when the blocks are not compressed
+func BenchmarkGetEntriesWithIndexMemoryMapped(b *testing.B) {
+	st := getNewInitializedStorageWithCodec("/tmp/golsm_test/sst-file-mmap.db", CodecNone)
+	mapped := SSTforTag{FileName: st.FileName, MemoryMapped: true, Codec: CodecNone}
+	mapped.InitStorage()
+	min, max := st.Availability()
+
+	functions := []struct {
+		name string
+		fun  func(fromTs uint64, toTs uint64) ([]Entry, error)
+	}{
+		{"with index read from file", func(fromTs uint64, toTs uint64) ([]Entry, error) {
+			snapshot := st.Snapshot()
+			defer snapshot.Release()
+			return snapshot.GetEntriesWithIndex(fromTs, toTs)
+		}},
+		{"with index read from mapping", func(fromTs uint64, toTs uint64) ([]Entry, error) {
+			snapshot := mapped.Snapshot()
+			defer snapshot.Release()
+			return snapshot.GetEntriesWithIndex(fromTs, toTs)
+		}},
+	}
+	for _, function := range functions {
+		b.Run(function.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				from := randomTs(min+20, min+(max-min)/2)
+				to := randomTs(from, max)
+				must(function.fun(from, to))
+			}
+		})
+	}
+}
+
 func getNewInitializedStorage(path string) *SSTforTag {
-	os.Remove(path)
-	st := SSTforTag{FileName: path}
+	return getNewInitializedStorageWithCodec(path, nil)
+}
+
+func getNewInitializedStorageWithCodec(path string, codec Codec) *SSTforTag {
+	st := SSTforTag{FileName: path, Codec: codec}
 	st.InitStorage()
+	st.Drop()
 
 	actualEntries := getBigBatchOfEntriesOfSize(100000, 1000, 0, 4096)
 
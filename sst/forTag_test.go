@@ -1,11 +1,17 @@
 package sst
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	log "github.com/jeanphorn/log4go"
 	"github.com/nikita-tomilov/golsm/commitlog"
+	"github.com/nikita-tomilov/golsm/dto"
+	"github.com/nikita-tomilov/golsm/errs"
 	"github.com/nikita-tomilov/golsm/utils"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math"
 	"os"
 	"sync"
 	"testing"
@@ -23,7 +29,7 @@ func TestSSTforTag_SanityCheck(t *testing.T) {
 	min, max := st.Availability()
 
 	//then
-	retrievedEntries := st.GetAllEntries()
+	retrievedEntries := must(st.GetAllEntries())
 	assert.Equal(t, 4, len(retrievedEntries), "entries mismatch")
 	i := 0
 	for i < len(retrievedEntries)-1 {
@@ -51,7 +57,7 @@ func TestSSTforTag_SanityCheck(t *testing.T) {
 	min2, max2 := st.Availability()
 
 	//then
-	retrievedEntries2 := st.GetAllEntries()
+	retrievedEntries2 := must(st.GetAllEntries())
 	assert.Equal(t, 6, len(retrievedEntries2), "entries mismatch")
 	i = 0
 	for i < len(retrievedEntries2)-1 {
@@ -80,12 +86,12 @@ func TestSSTforTag_IndexWorks(t *testing.T) {
 	assert.Equal(t, uint64(19990), max, "max ts incorrect")
 
 	//when
-	slice1 := st.GetEntriesWithoutIndex(15000, 16000)
+	slice1 := must(st.GetEntriesWithoutIndex(15000, 16000))
 	//then
 	assert.Equal(t, 101, len(slice1), "entries count is incorrect without index")
 
 	//when
-	slice2 := st.GetEntriesWithIndex(15000, 16000)
+	slice2 := must(st.GetEntriesWithIndex(15000, 16000))
 	//then
 	assert.Equal(t, 101, len(slice2), "entries count is incorrect with index")
 
@@ -123,7 +129,7 @@ func TestSSTforTag_ParallelReadsWritesWork(t *testing.T) {
 	go func() {
 		defer wg.Done()
 		for i := 0; i < 20; i++ {
-			slice := st.GetEntriesWithoutIndex(15000, utils.GetNowMillis()/10)
+			slice := must(st.GetEntriesWithoutIndex(15000, utils.GetNowMillis()/10))
 			assert.Less(t, 0, len(slice), "entries count is incorrect with index")
 			time.Sleep(time.Second)
 		}
@@ -134,9 +140,7 @@ func TestSSTforTag_ParallelReadsWritesWork(t *testing.T) {
 
 func TestSSTforTag_WritesSortedFile(t *testing.T) {
 	//given
-	path := "/tmp/golsm_test/test_3yYHfn_2"
-	os.Remove(path)
-	st := SSTforTag{FileName: path}
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-sorted-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
 	st.InitStorage()
 
 	//when
@@ -147,7 +151,7 @@ func TestSSTforTag_WritesSortedFile(t *testing.T) {
 	actualEntries3 := getBigBatchOfEntries(1000, 750, 0)
 	st.MergeWithCommitlog(actualEntries3)
 
-	entries := st.GetAllEntries()
+	entries := must(st.GetAllEntries())
 
 	//then
 	assert.Equal(t, 1500, len(entries), "size incorrect") //not 3000 because of repeating TSs
@@ -155,7 +159,11 @@ func TestSSTforTag_WritesSortedFile(t *testing.T) {
 
 func TestSSTforTag_ReadsExistingFile(t *testing.T) {
 	//given
-	st := SSTforTag{FileName: "test_3yYHfn"}
+	path := fmt.Sprintf("/tmp/golsm_test/testForTag-existing-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())
+	data, err := ioutil.ReadFile("test_3yYHfn")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+	st := SSTforTag{FileName: path}
 	st.InitStorage()
 
 	//when
@@ -166,7 +174,7 @@ func TestSSTforTag_ReadsExistingFile(t *testing.T) {
 	assert.Equal(t, uint64(1599763019524), max, "max ts incorrect") //Thursday, 10 September 2020 г., 18:36:59.524
 
 	//when
-	all := st.GetAllEntries()
+	all := must(st.GetAllEntries())
 	assert.Equal(t, 3600, len(all), "all entries count is incorrect")
 
 	for i := 0; i < 10000; i++ {
@@ -175,16 +183,449 @@ func TestSSTforTag_ReadsExistingFile(t *testing.T) {
 		if to-from <= 10 {
 			from -= 10
 		}
-		dWithoutIndex := st.GetEntriesWithoutIndex(from, to)
+		dWithoutIndex := must(st.GetEntriesWithoutIndex(from, to))
 		//fmt.Printf("without index for %d - %d : %d points\n", from, to, len(dWithoutIndex))
 
-		dWithIndex := st.GetEntriesWithIndex(from, to)
+		dWithIndex := must(st.GetEntriesWithIndex(from, to))
 		//fmt.Printf("with index for %d - %d : %d points\n", from, to, len(dWithIndex))
 
 		assert.Equal(t, len(dWithoutIndex), len(dWithIndex), fmt.Sprintf("size incorrect for %d-%d: w/ %d, w/o %d", from, to, len(dWithIndex), len(dWithoutIndex)))
 	}
 }
 
+func TestSSTforTag_StoresLargeValues(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
+	st.InitStorage()
+	actualEntries := getBigBatchOfEntriesOfSize(3, 1000, 0, 100*1024)
+	actualEntries[1].Value[100*1024-1] = 42
+
+	//when
+	st.MergeWithCommitlog(actualEntries)
+	st = SSTforTag{FileName: st.FileName}
+	st.InitStorage()
+	entries := must(st.GetEntriesWithIndex(10010, 10010))
+
+	//then
+	assert.Equal(t, 1, len(entries), "entries count is incorrect")
+	assert.Equal(t, actualEntries[1].Value, entries[0].Value, "large value was corrupted")
+}
+
+func TestSSTforTag_SplitsLegacyFileIntoPartitions(t *testing.T) {
+	//given
+	path := fmt.Sprintf("/tmp/golsm_test/testForTag-legacy-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())
+	data, err := ioutil.ReadFile("test_3yYHfn")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+	st := SSTforTag{FileName: path}
+	st.InitStorage()
+
+	//when
+	for i := 0; i < DefaultCompactionFanIn; i++ {
+		st.MergeWithCommitlog(getBigBatchOfEntriesOfSize(1, uint64(1000+i), 0, 70*1024))
+	}
+	st = SSTforTag{FileName: path}
+	st.InitStorage()
+
+	//then
+	assert.False(t, utils.FileExists(path), "legacy file was not compacted")
+	assert.Equal(t, 2, st.SegmentsCount(), "legacy data and new data should be compacted into a segment per partition")
+	for _, s := range st.version.segments {
+		assert.Equal(t, byte(formatVersion), s.formatVersion, "compacted segment is not of the current format")
+		assert.NotEqual(t, noPartition, s.partition, "compacted segment is not partitioned")
+	}
+	assert.Equal(t, 3600+DefaultCompactionFanIn, len(must(st.GetAllEntries())), "entries were lost during the compaction")
+}
+
+func TestSSTforTag_NewerSegmentsWin(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx()), CompactionFanIn: 3}
+	st.InitStorage()
+	old := getBigBatchOfEntries(100, 1000, 0)
+	newer := getBigBatchOfEntriesOfSize(10, 1050, 0, 8)
+
+	//when
+	st.MergeWithCommitlog(old)
+	st.MergeWithCommitlog(newer)
+	beforeCompaction := must(st.GetEntriesWithIndex(10500, 10590))
+	st.MergeWithCommitlog(getBigBatchOfEntries(1, 5000, 0))
+	afterCompaction := must(st.GetEntriesWithIndex(10500, 10590))
+
+	//then
+	assert.Equal(t, 1, st.SegmentsCount(), "segments were not compacted")
+	assert.Equal(t, 10, len(beforeCompaction), "entries count is incorrect before compaction")
+	assert.Equal(t, beforeCompaction, afterCompaction, "compaction changed the data")
+	for _, e := range afterCompaction {
+		assert.Equal(t, 8, len(e.Value), "older segment won over the newer one")
+	}
+	assert.Equal(t, 101, len(must(st.GetAllEntries())), "entries count is incorrect")
+}
+
+func TestSSTforTag_SnapshotOutlivesCompactionAndDrop(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx()), CompactionFanIn: 2}
+	st.InitStorage()
+	st.MergeWithCommitlog(getBigBatchOfEntries(100, 1000, 0))
+	snapshot := st.Snapshot()
+	pinnedFileName := snapshot.version.segments[0].fileName
+
+	//when
+	st.MergeWithCommitlog(getBigBatchOfEntries(100, 2000, 0))
+	compacted := st.SegmentsCount()
+	st.Drop()
+	pinned := must(snapshot.GetEntriesWithIndex(0, 100000))
+	existsWhilePinned := utils.FileExists(pinnedFileName)
+	snapshot.Release()
+
+	//then
+	assert.Equal(t, 1, compacted, "segments were not compacted")
+	assert.Equal(t, 0, st.SegmentsCount(), "tag was not dropped")
+	assert.Equal(t, 100, len(pinned), "snapshot saw the later changes")
+	assert.True(t, existsWhilePinned, "pinned file was removed")
+	assert.False(t, utils.FileExists(pinnedFileName), "replaced file was not removed after the release")
+}
+
+func TestSSTforTag_MemoryMappedReadsMatchFileReads(t *testing.T) {
+	//given
+	path := fmt.Sprintf("/tmp/golsm_test/testForTag-mmap-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())
+	data, err := ioutil.ReadFile("test_3yYHfn")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+	legacy := SSTforTag{FileName: path, MemoryMapped: true}
+	legacy.InitStorage()
+	written := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-mmap-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx()), Codec: CodecNone, BlockSize: 256}
+	written.InitStorage()
+	written.MergeWithCommitlog(getBigBatchOfEntriesOfSize(1000, 1000, 0, 16))
+	mapped := SSTforTag{FileName: written.FileName, Codec: CodecNone, BlockSize: 256, MemoryMapped: true}
+	mapped.InitStorage()
+
+	//when
+	fromFile := must(written.GetEntriesWithIndex(10100, 15000))
+	snapshot := mapped.Snapshot()
+	fromMapping := must(snapshot.GetEntriesWithIndex(10100, 15000))
+	detached := must(mapped.GetEntriesWithIndex(10100, 15000))
+
+	//then
+	assert.Equal(t, 3600, len(must(legacy.GetAllEntries())), "legacy segment was not read through the mapping")
+	assert.Equal(t, 491, len(fromFile), "entries count is incorrect")
+	assert.Equal(t, fromFile, fromMapping, "mapped segment was read incorrectly")
+	assert.NotNil(t, mapped.version.segments[0].mapped, "segment was not mapped")
+	assert.Nil(t, written.version.segments[0].mapped, "segment was mapped without MemoryMapped")
+	assert.Equal(t, fromFile, detached, "detached values differ")
+	snapshot.Release()
+}
+
+func TestSSTforTag_RejectsPartitionWindowUnderMillisecond(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx()), PartitionWindow: time.Microsecond}
+
+	//when
+	err := st.InitStorage()
+
+	//then
+	assert.NotNil(t, err, "partition window under a millisecond was accepted")
+}
+
+func TestSSTforTag_SplitsDataIntoPartitions(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx()), PartitionWindow: time.Second}
+	st.InitStorage()
+
+	//when
+	st.MergeWithCommitlog(getBigBatchOfEntries(250, 1000, 0))
+	entries := must(st.GetEntriesWithIndex(10500, 11990))
+	st = SSTforTag{FileName: st.FileName, PartitionWindow: time.Second}
+	st.InitStorage()
+
+	//then
+	assert.Equal(t, 3, st.SegmentsCount(), "segment per partition expected")
+	for _, s := range st.version.segments {
+		assert.Equal(t, st.partitionOf(s.firstTs), s.partition, "segment spans several partitions")
+		assert.Equal(t, st.partitionOf(s.lastTs), s.partition, "segment spans several partitions")
+	}
+	assert.Equal(t, 150, len(entries), "entries count is incorrect")
+	assert.Equal(t, 250, len(must(st.GetAllEntries())), "entries count is incorrect")
+}
+
+func TestSSTforTag_DropsOutdatedPartitions(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx()), PartitionWindow: PartitionHourly, Retention: 2 * time.Hour}
+	st.InitStorage()
+	now := utils.GetNowMillis()
+	old := commitlog.Entry{Key: []byte("tagZero"), Timestamp: now - uint64((3 * time.Hour).Milliseconds()), Value: make([]byte, 4)}
+	expiring := commitlog.Entry{Key: []byte("tagZero"), Timestamp: now - uint64(time.Hour.Milliseconds()), ExpiresAt: now + 100, Value: make([]byte, 4)}
+	fresh := commitlog.Entry{Key: []byte("tagZero"), Timestamp: now, Value: make([]byte, 4)}
+
+	//when
+	st.MergeWithCommitlog([]commitlog.Entry{old, expiring, fresh})
+	segmentsBefore := st.SegmentsCount()
+	expiringFileName := st.version.segments[0].fileName
+	time.Sleep(200 * time.Millisecond)
+	st.Compact()
+
+	//then
+	assert.Equal(t, 2, segmentsBefore, "partition older than the retention should be dropped right away")
+	assert.Equal(t, 1, st.SegmentsCount(), "partition with all the entries expired was not dropped")
+	entries := must(st.GetAllEntries())
+	assert.Equal(t, 1, len(entries), "entries count is incorrect")
+	assert.Equal(t, fresh.Timestamp, entries[0].Timestamp, "wrong partition was dropped")
+	assert.False(t, utils.FileExists(expiringFileName), "partition file was not deleted")
+	assert.True(t, utils.FileExists(st.version.segments[0].fileName), "wrong partition file was deleted")
+}
+
+func TestSSTforTag_TombstonesDeleteOlderEntries(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
+	st.InitStorage()
+	st.compactionRequested = func(*SSTforTag) {}
+	st.MergeWithCommitlog(getBigBatchOfEntries(100, 1000, 0))
+	rewritten := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 10550, Value: make([]byte, 8)}
+
+	//when
+	st.MergeWithCommitlog([]commitlog.Entry{commitlog.NewTombstone([]byte("tagZero"), 10500, 10590), rewritten})
+	beforeCompaction := must(st.GetEntriesWithIndex(10400, 10690))
+	st = SSTforTag{FileName: st.FileName}
+	st.InitStorage()
+	reopened := must(st.GetEntriesWithoutIndex(10400, 10690))
+	st.Compact()
+
+	//then
+	assert.Equal(t, 21, len(beforeCompaction), "tombstone did not hide the entries")
+	assert.Equal(t, beforeCompaction, reopened, "tombstone was not persisted")
+	assert.Equal(t, 1, st.SegmentsCount(), "segments were not compacted")
+	assert.Equal(t, 0, len(st.version.segments[0].tombstones), "tombstone outlived the deleted entries")
+	assert.Equal(t, 91, st.version.segments[0].entriesInFile, "deleted entries were not dropped from the disk")
+	assert.Equal(t, beforeCompaction, must(st.GetEntriesWithIndex(10400, 10690)), "compaction changed the data")
+	for _, e := range beforeCompaction {
+		if e.Timestamp == rewritten.Timestamp {
+			assert.Equal(t, 8, len(e.Value), "entry written after the tombstone was lost")
+		}
+	}
+}
+
+func TestSSTforTag_KeepsTombstonesForQuarantinedSegments(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
+	st.InitStorage()
+	st.compactionRequested = func(*SSTforTag) {}
+	st.MergeWithCommitlog(getBigBatchOfEntries(100, 1000, 0))
+	st.quarantine(st.version.segments[0], errors.New("damaged for the test"))
+
+	//when
+	st.MergeWithCommitlog([]commitlog.Entry{commitlog.NewTombstone([]byte("tagZero"), 10500, 10590)})
+	st.Compact()
+	_, errRepair := st.Repair()
+
+	//then
+	assert.Nil(t, errRepair, "repair failed")
+	assert.Equal(t, 20, len(must(st.GetEntriesWithIndex(10400, 10690))), "deleted entries came back with the repaired segment")
+}
+
+func TestSSTforTag_ReleasesOwnManifestOnClose(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d/tagZero", utils.GetNowMillis(), utils.GetTestIdx())}
+	st.InitStorage()
+	st.compactionRequested = func(*SSTforTag) {}
+	st.MergeWithCommitlog(getBigBatchOfEntries(10, 1000, 0))
+	dir := st.manifest.dir
+
+	//when
+	st.CloseStorage()
+	manifestsMutex.Lock()
+	_, stillAcquired := manifests[dir]
+	manifestsMutex.Unlock()
+	st = SSTforTag{FileName: st.FileName}
+	errReopen := st.InitStorage()
+	defer st.CloseStorage()
+
+	//then
+	assert.False(t, stillAcquired, "manifest was not released on close")
+	assert.Nil(t, errReopen, "table was not reopened")
+	assert.Equal(t, 10, len(must(st.GetAllEntries())), "entries were not reloaded from the disk")
+}
+
+func TestSSTforTag_LoadsPersistedIndex(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx()), BlockSize: 256}
+	st.InitStorage()
+	entries := getBigBatchOfEntries(100, 1000, 0)
+	entries[10].ExpiresAt = utils.GetNowMillis() + uint64(time.Hour.Milliseconds())
+	st.MergeWithCommitlog(entries)
+	written := st.version.segments[0]
+
+	//when
+	file, err := os.Open(written.fileName)
+	assert.Nil(t, err)
+	f, index, err := readIndex(file, written.size, formatVersion)
+	file.Close()
+	st = SSTforTag{FileName: st.FileName}
+	st.InitStorage()
+	loaded := st.version.segments[0]
+
+	//then
+	assert.Nil(t, err, "index was not persisted")
+	assert.Equal(t, written.indexEntries(), index, "persisted index is incorrect")
+	assert.Equal(t, uint64(10), f.blocksCount, "persisted blocks count is incorrect")
+	assert.Equal(t, written.indexEntries(), loaded.indexEntries(), "loaded index is incorrect")
+	assert.Equal(t, []uint64{10000, 10990}, []uint64{loaded.firstTs, loaded.lastTs}, "loaded bounds are incorrect")
+	assert.Equal(t, 100, loaded.entriesInFile, "loaded entries count is incorrect")
+	assert.True(t, loaded.neverExpires, "loaded expiration is incorrect")
+	assert.Equal(t, 100, len(must(st.GetEntriesWithIndex(10000, 10990))), "entries count is incorrect")
+	assert.Equal(t, 16, len(must(st.GetEntriesWithIndex(10095, 10255))), "entries count is incorrect")
+}
+
+func TestSSTforTag_CompressesBlocks(t *testing.T) {
+	//given
+	entries := getBigBatchOfEntriesOfSize(1000, 1000, 0, 8)
+	for i := range entries {
+		binary.LittleEndian.PutUint64(entries[i].Value, math.Float64bits(20.0+float64(i%7)/2))
+	}
+	sizes := make(map[byte]int64)
+
+	for _, codec := range []Codec{CodecNone, CodecFlate, CodecGzip} {
+		//when
+		st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx()), Codec: codec, BlockSize: 4096}
+		st.InitStorage()
+		st.MergeWithCommitlog(append([]commitlog.Entry{}, entries...))
+		sizes[codec.Id()] = st.version.segments[0].size
+		st = SSTforTag{FileName: st.FileName}
+		st.InitStorage()
+
+		//then
+		assert.Equal(t, 1000, len(must(st.GetAllEntries())), "entries count is incorrect")
+		for i := 0; i < 100; i++ {
+			from := randomTs(10000, 19990)
+			to := randomTs(from, 19990)
+			dWithoutIndex := must(st.GetEntriesWithoutIndex(from, to))
+			dWithIndex := must(st.GetEntriesWithIndex(from, to))
+			assert.Equal(t, dWithoutIndex, dWithIndex, fmt.Sprintf("entries incorrect for %d-%d with codec %d", from, to, codec.Id()))
+		}
+	}
+	assert.Less(t, sizes[CodecIdFlate]*4, sizes[CodecIdNone], "flate did not compress the blocks")
+	assert.Less(t, sizes[CodecIdGzip]*4, sizes[CodecIdNone], "gzip did not compress the blocks")
+}
+
+func TestSSTforTag_GorillaEncodesNumericSeries(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx()), Codec: CodecGorilla, BlockSize: 64 * 1024}
+	st.InitStorage()
+	expiresAt := utils.GetNowMillis() + uint64(time.Hour.Milliseconds())
+	entries := make([]commitlog.Entry, 10000)
+	for i := range entries {
+		reading := 20.0 + float64((i/60)%10)/4
+		entries[i] = commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1599759420000 + uint64(i)*1000, ExpiresAt: expiresAt, Value: dto.FloatValue(reading)}
+	}
+	entries[5000].Timestamp += 3
+	irregular := getBigBatchOfEntriesOfSize(10, 2000000000, 0, 5)
+
+	//when
+	st.MergeWithCommitlog(append([]commitlog.Entry{}, entries...))
+	sizePerPoint := float64(st.version.segments[0].size) / float64(len(entries))
+	st.MergeWithCommitlog(irregular)
+	st = SSTforTag{FileName: st.FileName}
+	st.InitStorage()
+	stored := must(st.GetEntriesWithIndex(entries[0].Timestamp, entries[len(entries)-1].Timestamp))
+
+	//then
+	assert.LessOrEqual(t, sizePerPoint, 2.0, "regular series takes too much space")
+	assert.Equal(t, len(entries), len(stored), "entries count is incorrect")
+	for i, e := range stored {
+		assert.Equal(t, entries[i].Timestamp, e.Timestamp, "timestamp is incorrect")
+		assert.Equal(t, expiresAt, e.ExpiresAt, "expiration is incorrect")
+		assert.Equal(t, entries[i].Value, e.Value, "value is incorrect")
+	}
+	assert.Equal(t, 10, len(must(st.GetEntriesWithIndex(20000000000, 20000000090))), "block with non-numeric values was not stored")
+}
+
+func TestSSTforTag_ScansSegmentWithCorruptIndex(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
+	st.InitStorage()
+	st.MergeWithCommitlog(getBigBatchOfEntries(100, 1000, 0))
+	written := st.version.segments[0]
+	data, err := ioutil.ReadFile(written.fileName)
+	assert.Nil(t, err)
+	data[len(data)-footerSize-indexEntrySize]++
+	assert.Nil(t, ioutil.WriteFile(written.fileName, data, 0644))
+
+	//when
+	st = SSTforTag{FileName: st.FileName}
+	st.InitStorage()
+
+	//then
+	assert.Equal(t, written.indexEntries(), st.version.segments[0].indexEntries(), "index was not rebuilt")
+	assert.Equal(t, 30, len(must(st.GetEntriesWithIndex(10100, 10390))), "entries count is incorrect")
+}
+
+func TestSSTforTag_ReportsCorruptedBlock(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
+	st.InitStorage()
+	st.MergeWithCommitlog(getBigBatchOfEntries(100, 1000, 0))
+	written := st.version.segments[0]
+	data, err := ioutil.ReadFile(written.fileName)
+	assert.Nil(t, err)
+	data[fileHeaderSize()+4+blockHeaderSize]++
+	assert.Nil(t, ioutil.WriteFile(written.fileName, data, 0644))
+
+	//when
+	entries, err := st.GetEntriesWithIndex(10000, 10990)
+
+	//then
+	assert.True(t, errors.Is(err, errs.ErrCorrupted), "corrupted block was not reported")
+	assert.Nil(t, entries, "entries of the corrupted segment were returned")
+}
+
+func TestSSTforTag_RejectsBlockLengthBeyondFile(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
+	st.InitStorage()
+	st.MergeWithCommitlog(getBigBatchOfEntries(100, 1000, 0))
+	written := st.version.segments[0]
+	data, err := ioutil.ReadFile(written.fileName)
+	assert.Nil(t, err)
+	binary.LittleEndian.PutUint32(data[fileHeaderSize():], 0xFFFFFFF0)
+	assert.Nil(t, ioutil.WriteFile(written.fileName, data, 0644))
+
+	//when
+	entries, err := st.GetEntriesWithIndex(10000, 10990)
+
+	//then
+	assert.True(t, errors.Is(err, errs.ErrCorrupted), "block length beyond the file was not reported")
+	assert.Nil(t, entries, "entries of the corrupted segment were returned")
+}
+
+func TestSSTforTag_QuarantinesTombstonesLengthBeyondFile(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
+	st.InitStorage()
+	st.compactionRequested = func(*SSTforTag) {}
+	st.MergeWithCommitlog(getBigBatchOfEntries(100, 1000, 0))
+	st.MergeWithCommitlog([]commitlog.Entry{commitlog.NewTombstone([]byte("tagZero"), 10500, 10590)})
+	written := st.version.segments[1]
+	data, err := ioutil.ReadFile(written.fileName)
+	assert.Nil(t, err)
+	binary.LittleEndian.PutUint32(data[fileHeaderSize():], 0xFFFFFFF0)
+	assert.Nil(t, ioutil.WriteFile(written.fileName, data, 0644))
+
+	//when
+	reopened := SSTforTag{FileName: st.FileName}
+	err = reopened.InitStorage()
+
+	//then
+	assert.Nil(t, err, "storage did not start over the corrupted file")
+	assert.Equal(t, 1, reopened.SegmentsCount(), "segment with the corrupted tombstones was opened")
+	assert.Equal(t, 1, len(reopened.quarantinedFiles()), "segment with the corrupted tombstones was not quarantined")
+}
+
+//must fails the test on the read error, so that the entries can be checked inline
+func must(entries []Entry, err error) []Entry {
+	if err != nil {
+		panic(err)
+	}
+	return entries
+}
+
 func Teardown(t *testing.T) {
 	log.Close()
 }
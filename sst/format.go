@@ -0,0 +1,232 @@
+package sst
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+//files without the header are of version 1, having uint16 entry lengths; version 2 has uint32 ones;
+//version 3 ends the entries with endOfEntriesMarker followed by the index and the footer;
+//version 4 groups the entries into the compressed blocks, and its index points to the blocks;
+//version 5 may start with the block of the tombstones
+const formatVersion = 5
+
+const legacyFormatVersion = 1
+
+const indexedFormatVersion = 3
+
+const blockFormatVersion = 4
+
+const tombstonesFormatVersion = 5
+
+//the codec id marking the block of the tombstones
+const tombstonesBlockId = 0xFF
+
+const DefaultBlockSize = 16 * 1024
+
+var fileMagic = []byte("GLSMSST")
+
+var footerMagic = []byte("GLSMSIDX")
+
+const endOfEntriesMarker = ^uint32(0)
+
+//version 3 index entry: ts, offset and expires at
+const legacyIndexEntrySize = 24
+
+//index entry: first ts, last ts, offset, expires at, expires from and the entries count
+const indexEntrySize = 8*5 + 4
+
+//block header after the length prefix: codec id and crc32 of the compressed data
+const blockHeaderSize = 1 + 4
+
+//footer size: index offset, entries count, first ts, last ts, expires at, flags, crc32 and the magic
+const footerSize = 8*5 + 1 + 4 + 8
+
+//footer describes the segment so that it can be opened without reading the entries
+type footer struct {
+	indexOffset  int64
+	blocksCount  uint64
+	firstTs      uint64
+	lastTs       uint64
+	expiresAt    uint64
+	neverExpires bool
+}
+
+func fileHeader() []byte {
+	return append(append([]byte{}, fileMagic...), formatVersion)
+}
+
+func fileHeaderSize() int64 {
+	return int64(len(fileMagic) + 1)
+}
+
+//readFormatVersion returns the format version of the file and the offset the entries start at
+func readFormatVersion(file *os.File) (byte, int64, error) {
+	header := make([]byte, fileHeaderSize())
+	n, err := file.ReadAt(header, 0)
+	if (err != nil) && (err != io.EOF) {
+		return 0, 0, err
+	}
+	if (n == len(header)) && bytes.Equal(header[:len(fileMagic)], fileMagic) {
+		return header[len(fileMagic)], fileHeaderSize(), nil
+	}
+	return legacyFormatVersion, 0, nil
+}
+
+func lengthPrefixSize(version byte) int {
+	if version == legacyFormatVersion {
+		return 2
+	}
+	return 4
+}
+
+func readLengthPrefix(version byte, arr []byte) int {
+	if version == legacyFormatVersion {
+		return int(binary.LittleEndian.Uint16(arr))
+	}
+	return int(binary.LittleEndian.Uint32(arr))
+}
+
+func isEndOfEntries(version byte, arr []byte) bool {
+	return (version >= indexedFormatVersion) && (binary.LittleEndian.Uint32(arr) == endOfEntriesMarker)
+}
+
+//encodeBlock compresses the encoded entries into a block: [u32 len][codec id][crc32][compressed entries]
+func encodeBlock(codec Codec, raw []byte) ([]byte, error) {
+	compressed, err := codec.Compress(raw)
+	if errors.Is(err, ErrIncompatibleBlock) {
+		codec = CodecFlate
+		compressed, err = codec.Compress(raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block := make([]byte, 4+blockHeaderSize+len(compressed))
+	binary.LittleEndian.PutUint32(block, uint32(len(compressed)))
+	block[4] = codec.Id()
+	binary.LittleEndian.PutUint32(block[5:], crc32.ChecksumIEEE(compressed))
+	copy(block[4+blockHeaderSize:], compressed)
+	return block, nil
+}
+
+//decodeBlock verifies and decompresses the block data following the length prefix
+func decodeBlock(header []byte, compressed []byte) ([]byte, error) {
+	if crc32.ChecksumIEEE(compressed) != binary.LittleEndian.Uint32(header[1:]) {
+		return nil, fmt.Errorf("block checksum mismatch")
+	}
+	codec, err := codecById(header[0])
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decompress(compressed)
+}
+
+//decodeBlockEntries splits the decompressed block into the entries appended to ans
+func decodeBlockEntries(raw []byte, ans []Entry, decode func([]byte) Entry) ([]Entry, error) {
+	for pos := 0; pos < len(raw); {
+		if pos+4 > len(raw) {
+			return nil, fmt.Errorf("block is truncated")
+		}
+		size := int(binary.LittleEndian.Uint32(raw[pos:]))
+		if (size < 16) || (pos+4+size > len(raw)) {
+			return nil, fmt.Errorf("block entry of size %d is truncated", size)
+		}
+		ans = append(ans, decode(raw[pos+4:pos+4+size]))
+		pos += 4 + size
+	}
+	return ans, nil
+}
+
+func indexEntrySizeOf(version byte) int64 {
+	if version < blockFormatVersion {
+		return legacyIndexEntrySize
+	}
+	return indexEntrySize
+}
+
+//encodeIndex returns the end of entries marker, the index block and the footer to be written after the entries
+func encodeIndex(index []IndexEntry, f footer) []byte {
+	buf := make([]byte, 4+len(index)*indexEntrySize+footerSize)
+	binary.LittleEndian.PutUint32(buf, endOfEntriesMarker)
+	pos := 4
+	for _, e := range index {
+		binary.LittleEndian.PutUint64(buf[pos:], e.ts)
+		binary.LittleEndian.PutUint64(buf[pos+8:], e.lastTs)
+		binary.LittleEndian.PutUint64(buf[pos+16:], uint64(e.fileOffset))
+		binary.LittleEndian.PutUint64(buf[pos+24:], e.expiresAt)
+		binary.LittleEndian.PutUint64(buf[pos+32:], e.expiresFrom)
+		binary.LittleEndian.PutUint32(buf[pos+40:], uint32(e.count))
+		pos += indexEntrySize
+	}
+	binary.LittleEndian.PutUint64(buf[pos:], uint64(f.indexOffset))
+	binary.LittleEndian.PutUint64(buf[pos+8:], f.blocksCount)
+	binary.LittleEndian.PutUint64(buf[pos+16:], f.firstTs)
+	binary.LittleEndian.PutUint64(buf[pos+24:], f.lastTs)
+	binary.LittleEndian.PutUint64(buf[pos+32:], f.expiresAt)
+	if f.neverExpires {
+		buf[pos+40] = 1
+	}
+	binary.LittleEndian.PutUint32(buf[pos+41:], crc32.ChecksumIEEE(buf[4:pos+41]))
+	copy(buf[pos+45:], footerMagic)
+	return buf
+}
+
+//readIndex reads the footer and the index block from the end of the file of the given size and format version
+func readIndex(file *os.File, size int64, version byte) (footer, []IndexEntry, error) {
+	f := footer{}
+	if size < fileHeaderSize()+footerSize {
+		return f, nil, fmt.Errorf("file is too short to have a footer")
+	}
+	trailer := make([]byte, footerSize)
+	if _, err := file.ReadAt(trailer, size-footerSize); err != nil {
+		return f, nil, err
+	}
+	if !bytes.Equal(trailer[45:], footerMagic) {
+		return f, nil, fmt.Errorf("footer magic is missing")
+	}
+	f.indexOffset = int64(binary.LittleEndian.Uint64(trailer))
+	f.blocksCount = binary.LittleEndian.Uint64(trailer[8:])
+	f.firstTs = binary.LittleEndian.Uint64(trailer[16:])
+	f.lastTs = binary.LittleEndian.Uint64(trailer[24:])
+	f.expiresAt = binary.LittleEndian.Uint64(trailer[32:])
+	f.neverExpires = trailer[40] == 1
+	entrySize := indexEntrySizeOf(version)
+	if f.blocksCount > uint64(size/entrySize) {
+		return f, nil, fmt.Errorf("blocks count %d does not fit the file", f.blocksCount)
+	}
+	indexSize := int64(f.blocksCount) * entrySize
+	if (f.indexOffset < fileHeaderSize()+4) || (f.indexOffset+indexSize != size-footerSize) {
+		return f, nil, fmt.Errorf("index offset %d does not match the blocks count %d", f.indexOffset, f.blocksCount)
+	}
+	block := make([]byte, indexSize+footerSize)
+	if _, err := file.ReadAt(block, f.indexOffset); err != nil {
+		return f, nil, err
+	}
+	if crc32.ChecksumIEEE(block[:indexSize+41]) != binary.LittleEndian.Uint32(block[indexSize+41:]) {
+		return f, nil, fmt.Errorf("index checksum mismatch")
+	}
+	index := make([]IndexEntry, f.blocksCount)
+	for i := range index {
+		pos := int64(i) * entrySize
+		if version < blockFormatVersion {
+			ts := binary.LittleEndian.Uint64(block[pos:])
+			expiresAt := binary.LittleEndian.Uint64(block[pos+16:])
+			index[i] = IndexEntry{ts: ts, lastTs: ts, fileOffset: int64(binary.LittleEndian.Uint64(block[pos+8:])), expiresAt: expiresAt, expiresFrom: expiresAt, count: 1}
+			continue
+		}
+		index[i] = IndexEntry{
+			ts:          binary.LittleEndian.Uint64(block[pos:]),
+			lastTs:      binary.LittleEndian.Uint64(block[pos+8:]),
+			fileOffset:  int64(binary.LittleEndian.Uint64(block[pos+16:])),
+			expiresAt:   binary.LittleEndian.Uint64(block[pos+24:]),
+			expiresFrom: binary.LittleEndian.Uint64(block[pos+32:]),
+			count:       int(binary.LittleEndian.Uint32(block[pos+40:])),
+		}
+	}
+	return f, index, nil
+}
@@ -0,0 +1,262 @@
+package sst
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+const CodecIdGorilla = 3
+
+//ErrIncompatibleBlock is returned by a codec that cannot encode the given block; such a block is written with CodecFlate instead
+var ErrIncompatibleBlock = errors.New("block is incompatible with the codec")
+
+//CodecGorilla encodes the numeric series as in Facebook Gorilla: the timestamps and expiration times are stored
+//as the delta-of-delta, and the values, which have to be float64 bit patterns (see dto.FloatValue), are XORed with the previous ones
+var CodecGorilla Codec = gorillaCodec{}
+
+//gorilla block: [u32 count][first ts][first expires at][first value] followed by the bit stream for the rest of the entries
+const gorillaHeaderSize = 4 + 8*3
+
+type gorillaCodec struct{}
+
+func (gorillaCodec) Id() byte {
+	return CodecIdGorilla
+}
+
+func (gorillaCodec) Compress(data []byte) ([]byte, error) {
+	entries, err := decodeBlockEntries(data, nil, FromByteArray)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: empty block", ErrIncompatibleBlock)
+	}
+	for _, e := range entries {
+		if len(e.Value) != 8 {
+			return nil, fmt.Errorf("%w: value of %d bytes at ts %d", ErrIncompatibleBlock, len(e.Value), e.Timestamp)
+		}
+	}
+	ans := make([]byte, gorillaHeaderSize)
+	binary.LittleEndian.PutUint32(ans, uint32(len(entries)))
+	binary.LittleEndian.PutUint64(ans[4:], entries[0].Timestamp)
+	binary.LittleEndian.PutUint64(ans[12:], entries[0].ExpiresAt)
+	copy(ans[20:], entries[0].Value)
+
+	w := &bitWriter{buf: ans}
+	ts := deltaEncoder{prev: entries[0].Timestamp}
+	exp := deltaEncoder{prev: entries[0].ExpiresAt}
+	values := xorEncoder{prev: binary.LittleEndian.Uint64(entries[0].Value)}
+	for _, e := range entries[1:] {
+		ts.write(w, e.Timestamp)
+		exp.write(w, e.ExpiresAt)
+		values.write(w, binary.LittleEndian.Uint64(e.Value))
+	}
+	return w.buf, nil
+}
+
+func (gorillaCodec) Decompress(data []byte) ([]byte, error) {
+	if len(data) < gorillaHeaderSize {
+		return nil, fmt.Errorf("gorilla block is truncated")
+	}
+	count := int(binary.LittleEndian.Uint32(data))
+	first := Entry{
+		Timestamp: binary.LittleEndian.Uint64(data[4:]),
+		ExpiresAt: binary.LittleEndian.Uint64(data[12:]),
+		Value:     append([]byte{}, data[20:28]...),
+	}
+	ans := first.ToByteArrayWithLength()
+
+	r := &bitReader{buf: data, pos: gorillaHeaderSize * 8}
+	ts := deltaEncoder{prev: first.Timestamp}
+	exp := deltaEncoder{prev: first.ExpiresAt}
+	values := xorEncoder{prev: binary.LittleEndian.Uint64(first.Value)}
+	for i := 1; i < count; i++ {
+		e := Entry{Value: make([]byte, 8)}
+		var err error
+		if e.Timestamp, err = ts.read(r); err != nil {
+			return nil, err
+		}
+		if e.ExpiresAt, err = exp.read(r); err != nil {
+			return nil, err
+		}
+		value, err := values.read(r)
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(e.Value, value)
+		ans = append(ans, e.ToByteArrayWithLength()...)
+	}
+	return ans, nil
+}
+
+//deltaEncoder writes the difference between the consecutive deltas using the Gorilla buckets
+type deltaEncoder struct {
+	prev      uint64
+	prevDelta int64
+}
+
+//the bucket for a delta-of-delta is prefixed by as many 1 bits as its index, followed by 0 unless it is the last one
+var deltaBucketBits = []int{0, 7, 9, 12, 64}
+
+func (d *deltaEncoder) write(w *bitWriter, value uint64) {
+	delta := int64(value - d.prev)
+	dod := delta - d.prevDelta
+	d.prev = value
+	d.prevDelta = delta
+	for i, size := range deltaBucketBits {
+		last := i == len(deltaBucketBits)-1
+		if !last && ((size == 0 && dod != 0) || (size > 0 && (dod < -(1<<(size-1))+1 || dod > 1<<(size-1)))) {
+			continue
+		}
+		w.writeBits(1<<i-1, i)
+		if !last {
+			w.writeBit(false)
+		}
+		w.writeBits(uint64(dod), size)
+		return
+	}
+}
+
+func (d *deltaEncoder) read(r *bitReader) (uint64, error) {
+	bucket := 0
+	for bucket < len(deltaBucketBits)-1 {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		bucket++
+	}
+	size := deltaBucketBits[bucket]
+	raw, err := r.readBits(size)
+	if err != nil {
+		return 0, err
+	}
+	dod := int64(raw)
+	if (size > 0) && (size < 64) && (raw > 1<<(size-1)) {
+		dod = int64(raw) - 1<<size
+	}
+	d.prevDelta += dod
+	d.prev += uint64(d.prevDelta)
+	return d.prev, nil
+}
+
+//xorEncoder writes the meaningful bits of the XOR with the previous value,
+//reusing the previous leading and trailing zeros count when the bits fit into them
+type xorEncoder struct {
+	prev     uint64
+	leading  int
+	trailing int
+	hasBits  bool
+}
+
+func (x *xorEncoder) write(w *bitWriter, value uint64) {
+	xor := value ^ x.prev
+	x.prev = value
+	if xor == 0 {
+		w.writeBit(false)
+		return
+	}
+	w.writeBit(true)
+	leading := bits.LeadingZeros64(xor)
+	trailing := bits.TrailingZeros64(xor)
+	if x.hasBits && (leading >= x.leading) && (trailing >= x.trailing) {
+		w.writeBit(false)
+		w.writeBits(xor>>uint(x.trailing), 64-x.leading-x.trailing)
+		return
+	}
+	w.writeBit(true)
+	significant := 64 - leading - trailing
+	w.writeBits(uint64(leading), 6)
+	w.writeBits(uint64(significant-1), 6)
+	w.writeBits(xor>>uint(trailing), significant)
+	x.leading, x.trailing, x.hasBits = leading, trailing, true
+}
+
+func (x *xorEncoder) read(r *bitReader) (uint64, error) {
+	changed, err := r.readBit()
+	if (err != nil) || !changed {
+		return x.prev, err
+	}
+	newWindow, err := r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if newWindow {
+		leading, err := r.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		significant, err := r.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		x.leading = int(leading)
+		x.trailing = 64 - x.leading - int(significant) - 1
+		if x.trailing < 0 {
+			return 0, fmt.Errorf("gorilla block is corrupted")
+		}
+	}
+	xor, err := r.readBits(64 - x.leading - x.trailing)
+	if err != nil {
+		return 0, err
+	}
+	x.prev ^= xor << uint(x.trailing)
+	return x.prev, nil
+}
+
+type bitWriter struct {
+	buf  []byte
+	free int
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.buf = append(w.buf, 0)
+		w.free = 8
+	}
+	w.free--
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << uint(w.free)
+	}
+}
+
+//writeBits writes the lowest n bits of the value, the most significant first
+func (w *bitWriter) writeBits(value uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit((value>>uint(i))&1 == 1)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.buf)*8 {
+		return false, fmt.Errorf("gorilla block is truncated")
+	}
+	bit := (r.buf[r.pos/8]>>uint(7-r.pos%8))&1 == 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	ans := uint64(0)
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		ans <<= 1
+		if bit {
+			ans |= 1
+		}
+	}
+	return ans, nil
+}
@@ -0,0 +1,168 @@
+package sst
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcutil/base58"
+	log "github.com/jeanphorn/log4go"
+	"github.com/nikita-tomilov/golsm/errs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//before the manifest was introduced, the files of the table were named after its base name, which the manager
+//made of the base58 of the tag: the whole-table file was named by the base name itself, and the segments as
+//base.id.sst when written before the time partitioning, or as base.partition.id.sst
+func legacySegmentFileName(base string, partition uint64, id uint64) string {
+	if partition == noPartition {
+		return fmt.Sprintf("%s.%06d.sst", base, id)
+	}
+	return fmt.Sprintf("%s.%d.%06d.sst", base, partition, id)
+}
+
+//parseLegacyFileName returns the partition and the id of the legacy file of the table, and whether the file is an unfinished one;
+//the whole-table file is the one with id 0
+func parseLegacyFileName(base string, name string) (uint64, uint64, bool, bool) {
+	if name == base {
+		return noPartition, 0, false, true
+	}
+	if !strings.HasPrefix(name, base+".") {
+		return 0, 0, false, false
+	}
+	suffix := strings.TrimPrefix(name, base+".")
+	var partition, id uint64
+	if n, _ := fmt.Sscanf(suffix, "%d.%d.sst", &partition, &id); n != 2 {
+		partition = noPartition
+		if n, _ := fmt.Sscanf(suffix, "%d.sst", &id); n != 1 {
+			return 0, 0, false, false
+		}
+	}
+	switch name {
+	case legacySegmentFileName(base, partition, id):
+		return partition, id, false, true
+	case legacySegmentFileName(base, partition, id) + ".tmp":
+		return partition, id, true, true
+	}
+	return 0, 0, false, false
+}
+
+//legacyTags returns the tags having the files named after the base58 of the tag in the directory or its quarantine
+func legacyTags(dir string) ([]string, error) {
+	ans := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, d := range []string{dir, filepath.Join(dir, quarantineDirName)} {
+		files, err := ioutil.ReadDir(d)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errs.IO("listing SST directory "+d, err)
+		}
+		for _, f := range files {
+			base := strings.SplitN(f.Name(), ".", 2)[0]
+			tag := string(base58.Decode(base))
+			if (len(tag) == 0) || (base58.Encode([]byte(tag)) != base) || f.IsDir() {
+				continue
+			}
+			if _, _, _, ok := parseLegacyFileName(base, f.Name()); ok && !seen[tag] {
+				seen[tag] = true
+				ans = append(ans, tag)
+			}
+		}
+	}
+	return ans, nil
+}
+
+type legacyFile struct {
+	fileName    string
+	partition   uint64
+	id          uint64
+	quarantined bool
+}
+
+//importLegacyFiles records the legacy files of the table in the manifest under the new file ids. The files are linked
+//under the new names first and unlinked once the manifest has them, so a crash leaves either the legacy files to be imported
+//again, or the imported ones; the legacy files having their partition and id already in the manifest are such leftovers
+func (st *SSTforTag) importLegacyFiles() error {
+	base := filepath.Base(st.FileName)
+	files := make([]legacyFile, 0)
+	for _, dir := range []string{st.dir(), st.quarantineDir()} {
+		listed, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return errs.IO("listing SST directory "+dir, err)
+		}
+		for _, f := range listed {
+			partition, id, unfinished, ok := parseLegacyFileName(base, f.Name())
+			fileName := filepath.Join(dir, f.Name())
+			switch {
+			case !ok || f.IsDir():
+			case unfinished:
+				log.Warn(fmt.Sprintf("Removing unfinished SST segment %s", fileName))
+				if err := os.Remove(fileName); err != nil {
+					return errs.IO("removing unfinished SST segment "+fileName, err)
+				}
+			default:
+				files = append(files, legacyFile{fileName: fileName, partition: partition, id: id, quarantined: dir == st.quarantineDir()})
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	imported := make(map[[2]uint64]bool)
+	for _, s := range st.manifest.segmentsOf(st.Tag) {
+		imported[[2]uint64{s.partition, s.id}] = true
+	}
+	ops := make([]manifestOp, 0)
+	linked := make([]string, 0)
+	for _, f := range files {
+		if imported[[2]uint64{f.partition, f.id}] {
+			continue
+		}
+		s := manifestSegment{fileId: st.manifest.newFileId(), partition: f.partition, id: f.id, quarantined: f.quarantined}
+		if !f.quarantined {
+			s = readManifestSegment(f.fileName, s)
+		}
+		kind := byte(opAddSegment)
+		target := segmentFileName(st.dir(), s.fileId)
+		if f.quarantined {
+			kind = opQuarantineSegment
+			target = segmentFileName(st.quarantineDir(), s.fileId)
+		}
+		err := os.Link(f.fileName, target)
+		if err == nil {
+			linked = append(linked, target)
+			err = syncDir(target)
+		}
+		if err == nil {
+			ops = append(ops, manifestOp{kind: kind, tag: st.Tag, segment: s})
+			continue
+		}
+		removeAll(linked)
+		return errs.IO("linking legacy SST file "+f.fileName, err)
+	}
+	if len(ops) > 0 {
+		if err := st.manifest.apply(ops...); err != nil {
+			removeAll(linked)
+			return err
+		}
+		log.Info(fmt.Sprintf("Imported %d legacy SST files of tag %s into the manifest", len(ops), st.Tag))
+	}
+	for _, f := range files {
+		if err := os.Remove(f.fileName); err != nil {
+			return errs.IO("removing legacy SST file "+f.fileName, err)
+		}
+	}
+	return syncDir(st.FileName)
+}
+
+func removeAll(fileNames []string) {
+	for _, fileName := range fileNames {
+		os.Remove(fileName)
+	}
+}
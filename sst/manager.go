@@ -3,26 +3,163 @@ package sst
 import (
 	"github.com/btcsuite/btcutil/base58"
 	"github.com/nikita-tomilov/golsm/commitlog"
-	"io/ioutil"
+	"github.com/nikita-tomilov/golsm/errs"
+	"github.com/nikita-tomilov/golsm/utils"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const DefaultPerformCompactionEvery = 10 * time.Minute
+
+//Manager keeps the SST of every tag under RootDir, opening the tags on the first access;
+//PartitionWindowPerTag and CodecPerTag override PartitionWindow and Codec for the given tags
 type Manager struct {
-	RootDir   string
-	sstForTag map[string]*SSTforTag
-	mutex     *sync.Mutex
+	RootDir                  string
+	PerformCompactionEvery   time.Duration
+	ExpiredFractionThreshold float64
+	PartitionWindow          time.Duration
+	PartitionWindowPerTag    map[string]time.Duration
+	Retention                time.Duration
+	Codec                    Codec
+	CodecPerTag              map[string]Codec
+	BlockSize                int
+	CompactionFanIn          int
+	MaxOpenFiles             int
+	MemoryMapped             bool
+	sstForTag                *utils.ShardedMap
+	manifest                 *manifest
+	files                    *fileCache
+	compactor                *compactor
+	closed                   int32
+	stop                     chan struct{}
+	workers                  *sync.WaitGroup
+}
+
+func (sm *Manager) InitStorage() error {
+	sm.sstForTag = utils.NewShardedMap()
+	if sm.PerformCompactionEvery == 0 {
+		sm.PerformCompactionEvery = DefaultPerformCompactionEvery
+	}
+	if sm.MaxOpenFiles == 0 {
+		sm.MaxOpenFiles = DefaultMaxOpenFiles
+	}
+	sm.files = newFileCache(sm.MaxOpenFiles)
+	sm.compactor = newCompactor()
+	sm.closed = 0
+	sm.stop = make(chan struct{})
+	sm.workers = &sync.WaitGroup{}
+	m, err := acquireManifest(sm.RootDir)
+	if err != nil {
+		return err
+	}
+	sm.manifest = m
+	legacy, err := legacyTags(sm.RootDir)
+	if err != nil {
+		m.release()
+		return err
+	}
+	for _, tag := range legacy {
+		sstForTag := SSTforTag{Tag: tag, FileName: sm.fileNameOf(tag), manifest: m}
+		if err := sstForTag.importLegacyFiles(); err != nil {
+			m.release()
+			return err
+		}
+	}
+
+	sm.workers.Add(2)
+	go func() {
+		defer sm.workers.Done()
+		sm.compactor.run()
+	}()
+	go func() {
+		defer sm.workers.Done()
+		utils.DoEvery(sm.PerformCompactionEvery, sm.stop, sm.scheduleCompactions)
+	}()
+	return nil
+}
+
+//CloseStorage stops the background compactions, waiting for the running one to finish;
+//the segments are synced as they are written, so there is nothing to flush
+func (sm *Manager) CloseStorage() error {
+	if !atomic.CompareAndSwapInt32(&sm.closed, 0, 1) {
+		return errs.Closed("SST manager")
+	}
+	close(sm.stop)
+	sm.compactor.stop()
+	sm.workers.Wait()
+	for _, sstForTag := range sm.allSstForTag() {
+		sstForTag.close()
+	}
+	sm.files.closeAll()
+	sm.manifest.release()
+	return nil
+}
+
+func (sm *Manager) scheduleCompactions() {
+	for _, sstForTag := range sm.allSstForTag() {
+		if sstForTag.needsCompaction() {
+			sm.compactor.request(sstForTag)
+		}
+	}
+}
+
+//Compact compacts every tag right away and returns the amount of bytes reclaimed on disk
+func (sm *Manager) Compact() (int64, error) {
+	if err := sm.checkOpen(); err != nil {
+		return 0, err
+	}
+	everySstForTag, err := sm.everySstForTag()
+	if err != nil {
+		return 0, err
+	}
+	reclaimed := int64(0)
+	for _, sstForTag := range everySstForTag {
+		r, compactionErr := sstForTag.Compact()
+		reclaimed += r
+		if (compactionErr != nil) && (err == nil) {
+			err = compactionErr
+		}
+	}
+	atomic.AddInt64(&sm.compactor.reclaimedBytes, reclaimed)
+	return reclaimed, err
+}
+
+//ReclaimedBytes returns the amount of bytes reclaimed on disk by the compactions since the start
+func (sm *Manager) ReclaimedBytes() int64 {
+	return atomic.LoadInt64(&sm.compactor.reclaimedBytes)
+}
+
+func (sm *Manager) checkOpen() error {
+	if atomic.LoadInt32(&sm.closed) != 0 {
+		return errs.Closed("SST manager")
+	}
+	return nil
+}
+
+//allSstForTag returns the opened tags
+func (sm *Manager) allSstForTag() []*SSTforTag {
+	ans := make([]*SSTforTag, 0)
+	sm.sstForTag.Range(func(_ string, sstForTag interface{}) {
+		ans = append(ans, sstForTag.(*SSTforTag))
+	})
+	return ans
 }
 
-func (sm *Manager) InitStorage() {
-	sm.sstForTag = make(map[string]*SSTforTag)
-	files, _ := ioutil.ReadDir(sm.RootDir)
-	for _, f := range files {
-		tag := string(base58.Decode(f.Name()))
-		sm.SstForTag(tag)
+//everySstForTag opens every tag on the disk
+func (sm *Manager) everySstForTag() ([]*SSTforTag, error) {
+	ans := make([]*SSTforTag, 0)
+	for _, tag := range sm.GetTags() {
+		sstForTag, err := sm.SstForTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, sstForTag)
 	}
+	return ans, nil
 }
 
-func (sm *Manager) MergeWithCommitlog(commitlogEntries []commitlog.Entry) {
+func (sm *Manager) MergeWithCommitlog(commitlogEntries []commitlog.Entry) error {
 	groupedByTag := make(map[string][]commitlog.Entry)
 	for _, entry := range commitlogEntries {
 		tag := string(entry.Key)
@@ -35,53 +172,156 @@ func (sm *Manager) MergeWithCommitlog(commitlogEntries []commitlog.Entry) {
 			groupedByTag[tag] = newGroup
 		}
 	}
+	//the segments written for every tag are added to the manifest with a single edit
+	written := make(map[*SSTforTag][]*segment)
+	ops := make([]manifestOp, 0)
 	for tag, values := range groupedByTag {
-		sstForTag := sm.SstForTag(tag)
-		sstForTag.MergeWithCommitlog(values)
+		values, dropped := commitlog.AfterLastDrop(values)
+		if dropped {
+			if err := sm.DropTag(tag); err != nil {
+				removeWritten(written)
+				return err
+			}
+		}
+		if len(values) > 0 {
+			sstForTag, err := sm.SstForTag(tag)
+			if err != nil {
+				removeWritten(written)
+				return err
+			}
+			segments, err := sstForTag.writeFromCommitlog(values)
+			if err != nil {
+				removeWritten(written)
+				return err
+			}
+			tagOps, err := sstForTag.installFiles(segments)
+			if err != nil {
+				removeWritten(written)
+				return err
+			}
+			written[sstForTag] = segments
+			ops = append(ops, tagOps...)
+		}
+	}
+	if len(ops) > 0 {
+		if err := sm.manifest.apply(ops...); err != nil {
+			removeWritten(written)
+			return err
+		}
+	}
+	for sstForTag, segments := range written {
+		sstForTag.publish(segments, nil)
+	}
+	for sstForTag := range written {
+		if err := sstForTag.afterFlush(); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (sm *Manager) Availability() (uint64, uint64) {
-	fromts := ^uint64(0)
-	tots := uint64(0)
+func removeWritten(written map[*SSTforTag][]*segment) {
+	for _, segments := range written {
+		removeSegments(segments)
+	}
+}
 
-	for _, sstft := range sm.sstForTag {
-		f, t := sstft.Availability()
-		if fromts > f {
-			fromts = f
-		}
-		if tots < t {
-			tots = t
+//DropTag removes all the segments of the tag, waiting for its compaction to finish
+func (sm *Manager) DropTag(tag string) error {
+	if err := sm.checkOpen(); err != nil {
+		return err
+	}
+	if sm.manifest.hasTag(tag) {
+		if _, err := sm.SstForTag(tag); err != nil {
+			return err
 		}
 	}
+	sstForTag, exists := sm.sstForTag.Load(tag)
+	if !exists {
+		return nil
+	}
+	//the drop is recorded in the manifest before the tag is forgotten, so that the tag opened again meanwhile has no dropped segments
+	if err := sstForTag.(*SSTforTag).Drop(); err != nil {
+		return err
+	}
+	sm.sstForTag.Delete(tag)
+	return nil
+}
 
-	if tots == uint64(0) {
-		return 0, 0
+//QuarantinedTags returns the tags having the files moved to the quarantine as unreadable, see Repair;
+//the files are checked as their blocks are read
+func (sm *Manager) QuarantinedTags() ([]string, error) {
+	if err := sm.checkOpen(); err != nil {
+		return nil, err
 	}
-	return fromts, tots
+	return sm.manifest.quarantinedTags(), nil
 }
 
-func (sm *Manager) SstForTag(tag string) *SSTforTag {
-	sstForTag, sstForTagExists := sm.sstForTag[tag]
-	if !sstForTagExists {
-		sstForTag = sm.createSstForTag(tag)
+//Repair salvages the quarantined files of the tag, see SSTforTag.Repair
+func (sm *Manager) Repair(tag string) (RepairReport, error) {
+	sstForTag, err := sm.SstForTag(tag)
+	if err != nil {
+		return RepairReport{}, err
 	}
-	return sstForTag
+	return sstForTag.Repair()
 }
 
-func (sm *Manager) createSstForTag(tag string) *SSTforTag {
-	sst := SSTforTag{Tag: tag, FileName: sm.RootDir + "/" + base58.Encode([]byte(tag))}
-	sst.InitStorage()
-	sm.sstForTag[tag] = &sst
-	return &sst
+//Availability returns the earliest and the latest timestamps stored, as recorded in the manifest, without opening the tags
+func (sm *Manager) Availability() (uint64, uint64, error) {
+	if err := sm.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+	from, to := sm.manifest.availability()
+	return from, to, nil
 }
 
+//SstForTag is safe for concurrent use; the existing tags are looked up under the read lock of their shard,
+//and a missing tag is opened once, blocking only the callers of the same tag
+func (sm *Manager) SstForTag(tag string) (*SSTforTag, error) {
+	if err := sm.checkOpen(); err != nil {
+		return nil, err
+	}
+	sstForTag, err := sm.sstForTag.LoadOrCreate(tag, func() (interface{}, error) {
+		return sm.createSstForTag(tag)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sstForTag.(*SSTforTag), nil
+}
+
+func (sm *Manager) createSstForTag(tag string) (*SSTforTag, error) {
+	window, overridden := sm.PartitionWindowPerTag[tag]
+	if !overridden {
+		window = sm.PartitionWindow
+	}
+	codec, overridden := sm.CodecPerTag[tag]
+	if !overridden {
+		codec = sm.Codec
+	}
+	sst := SSTforTag{Tag: tag, FileName: sm.fileNameOf(tag), PartitionWindow: window, Retention: sm.Retention, Codec: codec, ExpiredFractionThreshold: sm.ExpiredFractionThreshold, BlockSize: sm.BlockSize, CompactionFanIn: sm.CompactionFanIn, MemoryMapped: sm.MemoryMapped, manifest: sm.manifest, files: sm.files, compactionRequested: sm.compactor.request}
+	if err := sst.InitStorage(); err != nil {
+		return nil, err
+	}
+	return &sst, nil
+}
+
+//the files are named by the manifest, FileName only tells the legacy files of the tag to import
+func (sm *Manager) fileNameOf(tag string) string {
+	return sm.RootDir + "/" + base58.Encode([]byte(tag))
+}
+
+//GetTags returns the tags on the disk and the opened ones, without opening the tags
 func (sm *Manager) GetTags() []string {
-	keys := make([]string, len(sm.sstForTag))
-	i := 0
-	for k := range sm.sstForTag {
-		keys[i] = k
-		i++
-	}
-	return keys
-}
\ No newline at end of file
+	tags := sm.manifest.tagsList()
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		seen[tag] = true
+	}
+	for _, tag := range sm.sstForTag.Keys() {
+		if !seen[tag] {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
@@ -1,12 +1,24 @@
 package sst
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"github.com/btcsuite/btcutil/base58"
 	log "github.com/jeanphorn/log4go"
 	"github.com/nikita-tomilov/golsm/commitlog"
+	"github.com/nikita-tomilov/golsm/errs"
 	"github.com/nikita-tomilov/golsm/utils"
 	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSSTManager_SanityCheck(t *testing.T) {
@@ -19,18 +31,19 @@ func TestSSTManager_SanityCheck(t *testing.T) {
 	m.MergeWithCommitlog(actualEntries)
 
 	//then
-	assert.Equal(t, 2, len(m.sstForTag), "sst count mismatch")
+	assert.Equal(t, 2, len(m.GetTags()), "sst count mismatch")
 
-	st1 := m.sstForTag["tagZero"]
-	st2 := m.sstForTag["tagOne"]
+	st1, _ := m.SstForTag("tagZero")
+	st2, _ := m.SstForTag("tagOne")
 
-	st1e := st1.GetAllEntries()
-	st2e := st2.GetAllEntries()
+	st1e := must(st1.GetAllEntries())
+	st2e := must(st2.GetAllEntries())
 
 	assert.Equal(t, 3, len(st1e), "dto count in sst mismatch for tagZero")
 	assert.Equal(t, 2, len(st2e), "dto count in sst mismatch for tagOne")
 
 	//given
+	m.CloseStorage()
 	m = Manager{RootDir: m.RootDir}
 	m.InitStorage()
 
@@ -39,13 +52,13 @@ func TestSSTManager_SanityCheck(t *testing.T) {
 	m.MergeWithCommitlog(actualEntries2)
 
 	//then
-	assert.Equal(t, 2, len(m.sstForTag), "sst count mismatch")
+	assert.Equal(t, 2, len(m.GetTags()), "sst count mismatch")
 
-	st1 = m.sstForTag["tagZero"]
-	st2 = m.sstForTag["tagOne"]
+	st1, _ = m.SstForTag("tagZero")
+	st2, _ = m.SstForTag("tagOne")
 
-	st1e = st1.GetAllEntries()
-	st2e = st2.GetAllEntries()
+	st1e = must(st1.GetAllEntries())
+	st2e = must(st2.GetAllEntries())
 
 	assert.Equal(t, 4, len(st1e), "dto count in sst mismatch for tagZero after reopening")
 	assert.Equal(t, 3, len(st2e), "dto count in sst mismatch for tagOne after reopening")
@@ -53,6 +66,415 @@ func TestSSTManager_SanityCheck(t *testing.T) {
 	log.Close()
 }
 
+func TestSSTManager_ConcurrentTagsAreNotLost(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	m.InitStorage()
+
+	//when
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				tag := "tag" + strconv.Itoa(i)
+				e := commitlog.Entry{Key: []byte(tag), Timestamp: uint64(1337 + w), ExpiresAt: 0, Value: make([]byte, 4)}
+				assert.Nil(t, m.MergeWithCommitlog([]commitlog.Entry{e}), "merge failed")
+				m.GetTags()
+				m.Availability()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	//then
+	assert.Equal(t, 20, len(m.GetTags()), "tags were lost")
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, 8, len(must(mustSst(m.SstForTag("tag"+strconv.Itoa(i))).GetAllEntries())), "entries were lost")
+	}
+	m.CloseStorage()
+}
+
+func TestSSTManager_CompactsInBackground(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	m.InitStorage()
+
+	//when
+	for i := 0; i < DefaultCompactionFanIn; i++ {
+		m.MergeWithCommitlog(getBigBatchOfEntries(10, uint64(1000+i*10), 0))
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	//then
+	assert.Equal(t, 1, mustSst(m.SstForTag("tagZero")).SegmentsCount(), "segments were not compacted")
+	assert.Equal(t, 10*DefaultCompactionFanIn, len(must(mustSst(m.SstForTag("tagZero")).GetAllEntries())), "entries were lost during the compaction")
+}
+
+func TestSSTManager_PurgesExpiredEntriesInBackground(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()), PerformCompactionEvery: 100 * time.Millisecond}
+	m.InitStorage()
+	expiresAt := utils.GetNowMillis() + 200
+	partiallyExpiring := getBigBatchOfEntries(100, 1000, 0)
+	for i := 0; i < 60; i++ {
+		partiallyExpiring[i].ExpiresAt = expiresAt
+	}
+	expiring := getBigBatchOfEntries(100, 1000, 0)
+	for i := range expiring {
+		expiring[i].Key = []byte("tagOne")
+		expiring[i].ExpiresAt = expiresAt
+	}
+
+	//when
+	m.MergeWithCommitlog(append(partiallyExpiring, expiring...))
+	time.Sleep(600 * time.Millisecond)
+
+	//then
+	tagZero := mustSst(m.SstForTag("tagZero"))
+	assert.Equal(t, 1, tagZero.SegmentsCount(), "segment was not rewritten")
+	assert.Equal(t, 40, tagZero.version.segments[0].entriesInFile, "expired entries were not removed from disk")
+	assert.Equal(t, 40, len(must(tagZero.GetAllEntries())), "entries count is incorrect")
+	assert.Equal(t, 0, mustSst(m.SstForTag("tagOne")).SegmentsCount(), "expired segment was not deleted")
+	files, _ := filepath.Glob(filepath.Join(m.RootDir, "*.sst"))
+	assert.Equal(t, 1, len(files), "expired segment file was not deleted")
+	assert.Greater(t, m.ReclaimedBytes(), int64(0), "reclaimed bytes were not reported")
+}
+
+func TestSSTManager_QuarantinesAndRepairsCorruptedFiles(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()), BlockSize: 256}
+	m.InitStorage()
+	damaged := getBigBatchOfEntries(100, 1000, 0)
+	intact := getBigBatchOfEntries(100, 1000, 0)
+	for i := range intact {
+		intact[i].Key = []byte("tagOne")
+	}
+	m.MergeWithCommitlog(append(damaged, intact...))
+	written := mustSst(m.SstForTag("tagZero")).version.segments[0]
+	damagedBlock := written.indexEntries()[1]
+	data, err := ioutil.ReadFile(written.fileName)
+	assert.Nil(t, err)
+	data[damagedBlock.fileOffset+4+blockHeaderSize]++
+	assert.Nil(t, ioutil.WriteFile(written.fileName, data, 0644))
+	m.CloseStorage()
+
+	//when
+	m = Manager{RootDir: m.RootDir, BlockSize: 256}
+	errInit := m.InitStorage()
+	_, errRead := mustSst(m.SstForTag("tagZero")).GetAllEntries()
+	segmentsAfterRead := mustSst(m.SstForTag("tagZero")).SegmentsCount()
+	quarantined, errQuarantined := m.QuarantinedTags()
+	report, errRepair := m.Repair("tagZero")
+	quarantinedAfterRepair, _ := m.QuarantinedTags()
+
+	//then
+	assert.Nil(t, errInit, "storage did not start over the corrupted file")
+	assert.Nil(t, errQuarantined, "quarantine was not listed")
+	assert.Equal(t, []string{"tagZero"}, quarantined, "corrupted file was not quarantined")
+	assert.True(t, errors.Is(errRead, errs.ErrCorrupted), "corrupted block was not reported")
+	assert.Equal(t, 0, segmentsAfterRead, "corrupted segment was not quarantined on read")
+	assert.Equal(t, 100, len(must(mustSst(m.SstForTag("tagOne")).GetAllEntries())), "intact tag is not served")
+	assert.Nil(t, errRepair, "repair failed")
+	assert.Equal(t, 1, report.LostBlocks, "lost blocks count mismatch")
+	assert.Equal(t, damagedBlock.count, report.LostEntries, "lost entries count mismatch")
+	assert.Equal(t, 100-damagedBlock.count, report.SalvagedEntries, "salvaged entries count mismatch")
+	assert.Equal(t, 100-damagedBlock.count, len(must(mustSst(m.SstForTag("tagZero")).GetAllEntries())), "salvaged entries are not served")
+	assert.Equal(t, 0, len(quarantinedAfterRepair), "repaired file was left in quarantine")
+}
+
+func TestSSTManager_KeepsFilesInManifest(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	assert.Nil(t, os.MkdirAll(m.RootDir, os.ModePerm))
+	data, err := ioutil.ReadFile("test_3yYHfn")
+	assert.Nil(t, err)
+	legacyFileName := filepath.Join(m.RootDir, base58.Encode([]byte("legacyTag")))
+	assert.Nil(t, ioutil.WriteFile(legacyFileName, data, 0644))
+	orphanFileName := filepath.Join(m.RootDir, "000999.sst")
+	assert.Nil(t, ioutil.WriteFile(orphanFileName, data, 0644))
+	longTag := strings.Repeat("long", 100)
+	entries := getBigBatchOfEntries(10, 1000, 0)
+	for i := range entries {
+		entries[i].Key = []byte(longTag)
+	}
+
+	//when
+	errInit := m.InitStorage()
+	m.MergeWithCommitlog(entries)
+	m.CloseStorage()
+	logFile, err := os.OpenFile(filepath.Join(m.RootDir, manifestLogFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	logFile.Write([]byte{42, 0, 0})
+	logFile.Close()
+	m = Manager{RootDir: m.RootDir}
+	errReopen := m.InitStorage()
+	defer m.CloseStorage()
+
+	//then
+	assert.Nil(t, errInit, "storage did not start over the legacy files")
+	assert.Nil(t, errReopen, "storage did not start over the torn manifest log")
+	assert.ElementsMatch(t, []string{"legacyTag", longTag}, m.GetTags(), "tags were not restored from the manifest")
+	_, availableTo, _ := m.Availability()
+	assert.NotEqual(t, uint64(0), availableTo, "timestamps of the legacy file were not imported")
+	assert.Equal(t, 3600, len(must(mustSst(m.SstForTag("legacyTag")).GetAllEntries())), "legacy file was not imported")
+	assert.Equal(t, 10, len(must(mustSst(m.SstForTag(longTag)).GetAllEntries())), "long tag was not restored")
+	assert.False(t, utils.FileExists(legacyFileName), "legacy file was not removed after the import")
+	assert.False(t, utils.FileExists(orphanFileName), "orphan file was not collected")
+}
+
+func TestSSTManager_RefusesManifestLogDamagedBeforeItsEnd(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	m.InitStorage()
+	m.MergeWithCommitlog(getBigBatchOfEntries(10, 1000, 0))
+	m.MergeWithCommitlog(getBigBatchOfEntries(10, 5000, 0))
+	m.CloseStorage()
+	logFileName := filepath.Join(m.RootDir, manifestLogFileName)
+	data, err := ioutil.ReadFile(logFileName)
+	assert.Nil(t, err)
+	data[len(manifestLogMagic)+1+manifestRecordHeaderSize+2] ^= 0xFF
+	assert.Nil(t, ioutil.WriteFile(logFileName, data, 0644))
+	files, err := ioutil.ReadDir(m.RootDir)
+	assert.Nil(t, err)
+
+	//when
+	m = Manager{RootDir: m.RootDir}
+	errReopen := m.InitStorage()
+	filesAfter, err := ioutil.ReadDir(m.RootDir)
+	assert.Nil(t, err)
+
+	//then
+	assert.True(t, errors.Is(errReopen, errs.ErrCorrupted), "damaged manifest log was not reported")
+	assert.Equal(t, len(files), len(filesAfter), "files were collected after the damaged manifest log")
+}
+
+func TestSSTManager_UpgradesManifestOfFormatVersion1(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	m.InitStorage()
+	m.MergeWithCommitlog(getBigBatchOfEntries(10, 1000, 0))
+	segments := m.manifest.segmentsOf("tagZero")
+	m.CloseStorage()
+	ops := make([]manifestOp, 0)
+	for _, s := range segments {
+		ops = append(ops, manifestOp{kind: opAddSegment, tag: "tagZero", segment: s})
+	}
+	os.Remove(filepath.Join(m.RootDir, manifestFileName))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(m.RootDir, manifestLogFileName), encodeManifestRecordOfVersion1(1, ops), 0644))
+
+	//when
+	m = Manager{RootDir: m.RootDir}
+	errReopen := m.InitStorage()
+	defer m.CloseStorage()
+	from, to, _ := m.Availability()
+	snapshot, err := ioutil.ReadFile(filepath.Join(m.RootDir, manifestFileName))
+	assert.Nil(t, err)
+
+	//then
+	assert.Nil(t, errReopen, "storage did not start over the manifest of format version 1")
+	assert.Equal(t, []string{"tagZero"}, m.GetTags(), "tags were not restored from the manifest")
+	assert.Equal(t, 10, len(must(mustSst(m.SstForTag("tagZero")).GetAllEntries())), "entries were not restored")
+	assert.Equal(t, uint64(10000), from, "timestamps were not read from the segment files")
+	assert.Equal(t, uint64(10090), to, "timestamps were not read from the segment files")
+	assert.Equal(t, byte(manifestFormatVersion), snapshot[len(manifestMagic)], "manifest was not upgraded")
+}
+
+//encodeManifestRecordOfVersion1 encodes the record as the format version 1 did, with the ops having no timestamps
+func encodeManifestRecordOfVersion1(seq uint64, ops []manifestOp) []byte {
+	payload := make([]byte, 8+4)
+	binary.LittleEndian.PutUint64(payload, seq)
+	binary.LittleEndian.PutUint32(payload[8:], uint32(len(ops)))
+	for _, op := range ops {
+		arr := make([]byte, 1+4+len(op.tag)+8*3)
+		arr[0] = op.kind
+		binary.LittleEndian.PutUint32(arr[1:], uint32(len(op.tag)))
+		copy(arr[5:], op.tag)
+		binary.LittleEndian.PutUint64(arr[5+len(op.tag):], op.segment.fileId)
+		binary.LittleEndian.PutUint64(arr[13+len(op.tag):], op.segment.partition)
+		binary.LittleEndian.PutUint64(arr[21+len(op.tag):], op.segment.id)
+		payload = append(payload, arr...)
+	}
+	record := make([]byte, manifestRecordHeaderSize)
+	binary.LittleEndian.PutUint32(record, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+func TestSSTManager_FlushesTagsWithSingleManifestEdit(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	m.InitStorage()
+	defer m.CloseStorage()
+	entries := make([]commitlog.Entry, 0)
+	for tag := 0; tag < 10; tag++ {
+		batch := getBigBatchOfEntries(10, 1000, 0)
+		for i := range batch {
+			batch[i].Key = []byte("tag" + strconv.Itoa(tag))
+		}
+		entries = append(entries, batch...)
+	}
+	editsBefore := m.manifest.lastSeq
+
+	//when
+	err := m.MergeWithCommitlog(entries)
+
+	//then
+	assert.Nil(t, err, "merge failed")
+	assert.Equal(t, editsBefore+1, m.manifest.lastSeq, "tags were not added to the manifest with a single edit")
+	assert.Equal(t, 10, len(m.GetTags()), "tags count is incorrect")
+	for tag := 0; tag < 10; tag++ {
+		assert.Equal(t, 10, len(must(mustSst(m.SstForTag("tag" + strconv.Itoa(tag))).GetAllEntries())), "flushed entries are not served")
+	}
+}
+
+func TestSSTManager_AvailabilityDoesNotOpenTags(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	m.InitStorage()
+	early := getBigBatchOfEntries(10, 1000, 0)
+	late := getBigBatchOfEntries(10, 5000, 0)
+	for i := range late {
+		late[i].Key = []byte("tagOne")
+	}
+	m.MergeWithCommitlog(append(early, late...))
+	m.CloseStorage()
+
+	//when
+	m = Manager{RootDir: m.RootDir}
+	m.InitStorage()
+	defer m.CloseStorage()
+	from, to, err := m.Availability()
+
+	//then
+	assert.Nil(t, err, "availability failed")
+	assert.Equal(t, uint64(10000), from, "availability start is incorrect")
+	assert.Equal(t, uint64(50090), to, "availability end is incorrect")
+	assert.Equal(t, 0, len(m.sstForTag.Keys()), "tags were opened")
+}
+
+func TestSSTManager_AvailabilityLeavesOutExpiredAndDeletedEntries(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	m.InitStorage()
+	expiring := getBigBatchOfEntries(10, 1000, 0)
+	for i := range expiring {
+		expiring[i].ExpiresAt = utils.GetNowMillis() + 100
+	}
+	kept := getBigBatchOfEntries(10, 5000, 0)
+	for i := range kept {
+		kept[i].Key = []byte("tagOne")
+	}
+	deleted := getBigBatchOfEntries(10, 9000, 0)
+	for i := range deleted {
+		deleted[i].Key = []byte("tagTwo")
+	}
+	m.MergeWithCommitlog(append(append(expiring, kept...), deleted...))
+	m.MergeWithCommitlog([]commitlog.Entry{commitlog.NewTombstone([]byte("tagTwo"), 90000, 90090)})
+	m.CloseStorage()
+	time.Sleep(200 * time.Millisecond)
+
+	//when
+	m = Manager{RootDir: m.RootDir}
+	m.InitStorage()
+	defer m.CloseStorage()
+	from, to, err := m.Availability()
+
+	//then
+	assert.Nil(t, err, "availability failed")
+	assert.Equal(t, uint64(50000), from, "availability start includes the expired entries")
+	assert.Equal(t, uint64(50090), to, "availability end includes the deleted entries")
+}
+
+func TestSSTManager_CloseUnmapsSegmentsAndKeepsFiles(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()), MemoryMapped: true}
+	m.InitStorage()
+	m.MergeWithCommitlog(getBigBatchOfEntries(100, 1000, 0))
+	sstForTag := mustSst(m.SstForTag("tagZero"))
+	written := sstForTag.version.segments[0]
+	must(sstForTag.GetAllEntries())
+
+	//when
+	err := m.CloseStorage()
+	_, errAcquire := m.files.acquire(written.fileName)
+
+	//then
+	assert.Nil(t, err, "close failed")
+	assert.Nil(t, written.mapped, "segment was not unmapped")
+	assert.Equal(t, 0, m.files.openFiles(), "files were left open")
+	assert.True(t, errors.Is(errAcquire, errs.ErrClosed), "file was opened after close")
+	assert.True(t, utils.FileExists(written.fileName), "segment file was removed on close")
+	m = Manager{RootDir: m.RootDir, MemoryMapped: true}
+	m.InitStorage()
+	defer m.CloseStorage()
+	assert.Equal(t, 100, len(must(mustSst(m.SstForTag("tagZero")).GetAllEntries())), "entries were lost on close")
+}
+
+func TestSSTManager_OpensTagsLazilyWithinOpenFilesLimit(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()), MaxOpenFiles: 4}
+	m.InitStorage()
+	entries := make([]commitlog.Entry, 0)
+	for i := 0; i < 50; i++ {
+		batch := getBigBatchOfEntries(10, 1000, 0)
+		for j := range batch {
+			batch[j].Key = []byte("tag" + strconv.Itoa(i))
+		}
+		entries = append(entries, batch...)
+	}
+	m.MergeWithCommitlog(entries)
+	m.CloseStorage()
+
+	//when
+	m = Manager{RootDir: m.RootDir, MaxOpenFiles: 4}
+	m.InitStorage()
+	defer m.CloseStorage()
+	openedOnStart := len(m.allSstForTag())
+	tags := m.GetTags()
+	for _, tag := range tags {
+		assert.Equal(t, 10, len(must(mustSst(m.SstForTag(tag)).GetAllEntries())), "entries count is incorrect for "+tag)
+	}
+
+	//then
+	assert.Equal(t, 0, openedOnStart, "tags were opened on start")
+	assert.Equal(t, 50, len(tags), "tags on the disk were not listed")
+	assert.Equal(t, 4, m.files.openFiles(), "open files are not bounded")
+}
+
+func TestSSTManager_ConcurrentReadsShareFileHandles(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()), MaxOpenFiles: 1, BlockSize: 256}
+	m.InitStorage()
+	defer m.CloseStorage()
+	for i := 0; i < 3; i++ {
+		m.MergeWithCommitlog(getBigBatchOfEntries(100, uint64(1000+i*100000), 0))
+	}
+	sstForTag := mustSst(m.SstForTag("tagZero"))
+	expected := len(must(sstForTag.GetEntriesWithIndex(10000, 3000000)))
+
+	//when
+	counts := make(chan int, 64)
+	wg := sync.WaitGroup{}
+	for i := 0; i < cap(counts); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counts <- len(must(sstForTag.GetEntriesWithIndex(10000, 3000000)))
+		}()
+	}
+	wg.Wait()
+	close(counts)
+
+	//then
+	assert.Equal(t, 300, expected, "entries count is incorrect")
+	for count := range counts {
+		assert.Equal(t, expected, count, "concurrent read returned wrong entries")
+	}
+	assert.Equal(t, 1, m.files.openFiles(), "idle handles above the limit were not closed")
+}
+
 func getDummyCommitlogEntriesForMultipleTags() []commitlog.Entry {
 	ans := make([]commitlog.Entry, 5)
 	ans[0] = commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, ExpiresAt: 0, Value: make([]byte, 4)}
@@ -68,4 +490,11 @@ func getDummyCommitlogEntriesForMultipleTags2() []commitlog.Entry {
 	ans[0] = commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1339, ExpiresAt: 0, Value: make([]byte, 4)}
 	ans[1] = commitlog.Entry{Key: []byte("tagOne"), Timestamp: 1341, ExpiresAt: 0, Value: make([]byte, 2)}
 	return ans
-}
\ No newline at end of file
+}
+
+func mustSst(st *SSTforTag, err error) *SSTforTag {
+	if err != nil {
+		panic(err)
+	}
+	return st
+}
@@ -0,0 +1,631 @@
+package sst
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	log "github.com/jeanphorn/log4go"
+	"github.com/nikita-tomilov/golsm/errs"
+	"github.com/nikita-tomilov/golsm/utils"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+//the manifest of the directory maps the tags to the segment files, which are named by their numeric file ids.
+//Every change is appended to the edit log and synced before it takes effect; once the log has
+//manifestEditsPerSnapshot edits, the whole state is written as the snapshot, replacing the snapshot and the log.
+//Both files start with their magic and the format version; the log was written without the header by the format versions 1 and 2,
+//and the manifest of an older version is upgraded on load, reading the metadata it lacks from the segment files
+const manifestFileName = "MANIFEST"
+
+const manifestLogFileName = "MANIFEST.log"
+
+const manifestFormatVersion = 3
+
+//the ops of the format version 1 had no timestamps, and the ones of the version 2 had no expiration and tombstones
+const manifestTimestampsFormatVersion = 2
+
+const manifestExpirationFormatVersion = 3
+
+const manifestEditsPerSnapshot = 1000
+
+var manifestMagic = []byte("GLSMMANF")
+
+var manifestLogMagic = []byte("GLSMMLOG")
+
+//edit record: [u32 len][crc32][u64 seq][u32 ops count][ops], op: [kind][u32 tag len][tag][u64 file id][u64 partition][u64 id]
+//[u64 first ts][u64 last ts][u64 expires at][never expires][u32 tombstones count][tombstones], tombstone: [u64 from][u64 to]
+const manifestRecordHeaderSize = 4 + 4
+
+func manifestOpFixedSize(version byte) int {
+	switch {
+	case version < manifestTimestampsFormatVersion:
+		return 1 + 4 + 8*3
+	case version < manifestExpirationFormatVersion:
+		return 1 + 4 + 8*5
+	}
+	return 1 + 4 + 8*6 + 1 + 4
+}
+
+const (
+	opAddSegment        = 1
+	opRemoveSegment     = 2
+	opQuarantineSegment = 3
+	opDropTag           = 4
+)
+
+type manifestSegment struct {
+	fileId    uint64
+	partition uint64
+	id        uint64
+	//the timestamps of the entries of the segment, zero if it has none
+	firstTs      uint64
+	lastTs       uint64
+	expiresAt    uint64
+	neverExpires bool
+	tombstones   []tombstone
+	quarantined  bool
+}
+
+type manifestOp struct {
+	kind    byte
+	tag     string
+	segment manifestSegment
+}
+
+type manifest struct {
+	dir        string
+	mutex      *sync.Mutex
+	tags       map[string]map[uint64]manifestSegment
+	lastSeq    uint64
+	nextFileId uint64
+	logSize    int64
+	editsInLog int
+	//set when a failed edit could not be cut off the log, so that no edit is appended after the torn one
+	brokenErr error
+	refs      int
+}
+
+var manifests = make(map[string]*manifest)
+
+var manifestsMutex = &sync.Mutex{}
+
+//acquireManifest returns the manifest of the directory shared by all of its tags, loading it on the first use
+func acquireManifest(dir string) (*manifest, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errs.IO("resolving SST directory "+dir, err)
+	}
+	manifestsMutex.Lock()
+	defer manifestsMutex.Unlock()
+	m, exists := manifests[absDir]
+	if !exists {
+		m = &manifest{dir: absDir, mutex: &sync.Mutex{}, tags: make(map[string]map[uint64]manifestSegment), nextFileId: 1}
+		if err := m.load(); err != nil {
+			return nil, err
+		}
+		manifests[absDir] = m
+	}
+	m.refs++
+	return m, nil
+}
+
+//release forgets the manifest once it is not used, so that it is loaded from the disk again on the next acquire
+func (m *manifest) release() {
+	manifestsMutex.Lock()
+	defer manifestsMutex.Unlock()
+	m.refs--
+	if m.refs == 0 {
+		delete(manifests, m.dir)
+	}
+}
+
+func (m *manifest) load() error {
+	if err := os.MkdirAll(m.dir, os.ModePerm); err != nil {
+		return errs.IO("creating SST directory "+m.dir, err)
+	}
+	outdated := false
+	snapshotFileName := filepath.Join(m.dir, manifestFileName)
+	data, err := ioutil.ReadFile(snapshotFileName)
+	if (err != nil) && !os.IsNotExist(err) {
+		return errs.IO("reading SST manifest "+snapshotFileName, err)
+	}
+	if err == nil {
+		headerSize := len(manifestMagic) + 1
+		if (len(data) < headerSize) || !bytes.Equal(data[:len(manifestMagic)], manifestMagic) {
+			return errs.Corrupted("SST manifest %s has no header", snapshotFileName)
+		}
+		version := data[len(manifestMagic)]
+		if (version == 0) || (version > manifestFormatVersion) {
+			return errs.Corrupted("SST manifest %s has unknown format version %d", snapshotFileName, version)
+		}
+		seq, ops, n := decodeManifestRecord(data[headerSize:], version)
+		if n != len(data)-headerSize {
+			return errs.Corrupted("SST manifest %s is damaged", snapshotFileName)
+		}
+		m.applyOps(ops)
+		m.lastSeq = seq
+		outdated = version < manifestFormatVersion
+	}
+
+	logFileName := filepath.Join(m.dir, manifestLogFileName)
+	data, err = ioutil.ReadFile(logFileName)
+	if (err != nil) && !os.IsNotExist(err) {
+		return errs.IO("reading SST manifest log "+logFileName, err)
+	}
+	offset, version, err := checkLogHeader(logFileName, data)
+	if err != nil {
+		return err
+	}
+	if (version < manifestFormatVersion) && (len(data) > 0) {
+		outdated = true
+	}
+	for offset < len(data) {
+		seq, ops, n := decodeLogRecord(data[offset:], version)
+		if n == 0 {
+			//a torn append leaves no record after it, so the damaged record followed by a valid one is a corruption,
+			//and dropping the edits after it would lose the segments they added
+			if hasRecordAfter(data, offset, version) {
+				return errs.Corrupted("SST manifest log %s is damaged at offset %d", logFileName, offset)
+			}
+			break
+		}
+		//the edits older than the snapshot are left when the crash happened before the log was cleared
+		if seq > m.lastSeq {
+			m.applyOps(ops)
+			m.lastSeq = seq
+		}
+		m.editsInLog++
+		offset += n
+	}
+	if offset < len(data) {
+		log.Warn(fmt.Sprintf("SST manifest log %s has a torn tail; discarding %d bytes after %d edits", logFileName, len(data)-offset, m.editsInLog))
+		if err := os.Truncate(logFileName, int64(offset)); err != nil {
+			return errs.IO("truncating SST manifest log "+logFileName, err)
+		}
+	}
+	m.logSize = int64(offset)
+
+	for _, segments := range m.tags {
+		for fileId := range segments {
+			if fileId >= m.nextFileId {
+				m.nextFileId = fileId + 1
+			}
+		}
+	}
+	if err := m.collectGarbage(); err != nil {
+		return err
+	}
+	if outdated {
+		return m.upgrade()
+	}
+	return nil
+}
+
+//upgrade reads the metadata missing from the older format versions from the segment files,
+//and writes the snapshot, so that the log is continued in the current format
+func (m *manifest) upgrade() error {
+	for _, segments := range m.tags {
+		for fileId, s := range segments {
+			if !s.quarantined {
+				segments[fileId] = readManifestSegment(segmentFileName(m.dir, fileId), s)
+			}
+		}
+	}
+	log.Info(fmt.Sprintf("Upgrading SST manifest in %s to format version %d", m.dir, manifestFormatVersion))
+	return m.writeSnapshot()
+}
+
+//readManifestSegment returns the segment with the metadata read from its file; the unreadable file is left without it,
+//as it is quarantined once the tag is opened
+func readManifestSegment(fileName string, s manifestSegment) manifestSegment {
+	opened, err := openSegment(nil, false, fileName, s.fileId, s.partition, s.id)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Unable to read the metadata of SST segment %s: %s", fileName, err.Error()))
+		return s
+	}
+	ans := opened.manifestSegment()
+	ans.quarantined = s.quarantined
+	return ans
+}
+
+//checkLogHeader returns the offset of the first record of the log and its format version, which is zero for the log written without the header;
+//the empty log and the one left by a crash while its header was being written have no records
+func checkLogHeader(logFileName string, data []byte) (int, byte, error) {
+	headerSize := len(manifestLogMagic) + 1
+	switch {
+	case (len(data) < headerSize) && bytes.HasPrefix(manifestLogMagic, data):
+		return 0, manifestFormatVersion, nil
+	case (len(data) < headerSize) || !bytes.Equal(data[:len(manifestLogMagic)], manifestLogMagic):
+		return 0, 0, nil
+	case (data[len(manifestLogMagic)] == 0) || (data[len(manifestLogMagic)] > manifestFormatVersion):
+		return 0, 0, errs.Corrupted("SST manifest log %s has unknown format version %d", logFileName, data[len(manifestLogMagic)])
+	}
+	return headerSize, data[len(manifestLogMagic)], nil
+}
+
+//decodeLogRecord decodes the record of the log in the format version; the record of the log without the header
+//is in the format version 1 or 2, and as the ops fill the record exactly, it decodes in one of them only
+func decodeLogRecord(data []byte, version byte) (uint64, []manifestOp, int) {
+	if version != 0 {
+		return decodeManifestRecord(data, version)
+	}
+	if seq, ops, n := decodeManifestRecord(data, 1); n > 0 {
+		return seq, ops, n
+	}
+	return decodeManifestRecord(data, manifestTimestampsFormatVersion)
+}
+
+//hasRecordAfter tells whether a valid record starts anywhere after the damaged one at the offset
+func hasRecordAfter(data []byte, offset int, version byte) bool {
+	for i := offset + 1; i+manifestRecordHeaderSize <= len(data); i++ {
+		if _, _, n := decodeLogRecord(data[i:], version); n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//collectGarbage removes the segment files not referenced by the manifest, which are left by a crash
+//before the edit adding them or after the edit removing them, and finishes moving the quarantined files
+func (m *manifest) collectGarbage() error {
+	quarantineDir := filepath.Join(m.dir, quarantineDirName)
+	referenced := make(map[uint64]bool)
+	quarantined := make(map[uint64]bool)
+	for _, segments := range m.tags {
+		for fileId, s := range segments {
+			referenced[fileId] = true
+			quarantined[fileId] = s.quarantined
+		}
+	}
+	for _, dir := range []string{m.dir, quarantineDir} {
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return errs.IO("listing SST directory "+dir, err)
+		}
+		for _, f := range files {
+			fileName := filepath.Join(dir, f.Name())
+			fileId, unfinished, ok := parseSegmentFileName(f.Name())
+			if !ok && (f.Name() != manifestFileName+".tmp") {
+				continue
+			}
+			if ok && !unfinished && referenced[fileId] {
+				//the crash happened after the edit quarantining the file and before moving it
+				if quarantined[fileId] && (dir == m.dir) {
+					if err := moveToQuarantine(fileName); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			log.Warn(fmt.Sprintf("Removing SST file %s not referenced by the manifest", fileName))
+			if err := os.Remove(fileName); err != nil {
+				return errs.IO("removing SST file "+fileName, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *manifest) newFileId() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	id := m.nextFileId
+	m.nextFileId++
+	return id
+}
+
+//apply appends the edit to the log and syncs it before changing the state; after a crash, the edit is either applied as a whole or not at all
+func (m *manifest) apply(ops ...manifestOp) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.brokenErr != nil {
+		return m.brokenErr
+	}
+	record := encodeManifestRecord(m.lastSeq+1, ops)
+	if err := m.appendToLog(record); err != nil {
+		return err
+	}
+	m.lastSeq++
+	m.applyOps(ops)
+	m.editsInLog++
+	if m.editsInLog >= manifestEditsPerSnapshot {
+		//the edit is already durable in the log, so the snapshot is retried with the next edit
+		if err := m.writeSnapshot(); err != nil {
+			log.Warn(fmt.Sprintf("Unable to write SST manifest snapshot in %s: %s", m.dir, err.Error()))
+		}
+	}
+	return nil
+}
+
+func (m *manifest) appendToLog(record []byte) error {
+	logFileName := filepath.Join(m.dir, manifestLogFileName)
+	file, err := os.OpenFile(logFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errs.IO("opening SST manifest log "+logFileName, err)
+	}
+	if m.logSize == 0 {
+		record = append(append(append([]byte{}, manifestLogMagic...), manifestFormatVersion), record...)
+	}
+	_, err = file.Write(record)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if truncateErr := os.Truncate(logFileName, m.logSize); truncateErr != nil {
+			m.brokenErr = errs.IO("cutting failed edit off SST manifest log "+logFileName, truncateErr)
+		}
+		return errs.IO("appending to SST manifest log "+logFileName, err)
+	}
+	if m.logSize == 0 {
+		if err := syncDir(logFileName); err != nil {
+			return err
+		}
+	}
+	m.logSize += int64(len(record))
+	return nil
+}
+
+//writeSnapshot replaces the snapshot with the current state and clears the log; must be called under the mutex
+func (m *manifest) writeSnapshot() error {
+	ops := make([]manifestOp, 0)
+	for tag, segments := range m.tags {
+		for _, s := range segments {
+			kind := byte(opAddSegment)
+			if s.quarantined {
+				kind = opQuarantineSegment
+			}
+			ops = append(ops, manifestOp{kind: kind, tag: tag, segment: s})
+		}
+	}
+	data := append(append(append([]byte{}, manifestMagic...), manifestFormatVersion), encodeManifestRecord(m.lastSeq, ops)...)
+	snapshotFileName := filepath.Join(m.dir, manifestFileName)
+	tmpFileName := snapshotFileName + ".tmp"
+	file, err := os.OpenFile(tmpFileName, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errs.IO("creating SST manifest "+tmpFileName, err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFileName, snapshotFileName)
+	}
+	if err != nil {
+		os.Remove(tmpFileName)
+		return errs.IO("writing SST manifest "+snapshotFileName, err)
+	}
+	if err := syncDir(snapshotFileName); err != nil {
+		return err
+	}
+	logFileName := filepath.Join(m.dir, manifestLogFileName)
+	if err := os.Truncate(logFileName, 0); (err != nil) && !os.IsNotExist(err) {
+		return errs.IO("clearing SST manifest log "+logFileName, err)
+	}
+	m.logSize = 0
+	m.editsInLog = 0
+	return nil
+}
+
+func (m *manifest) applyOps(ops []manifestOp) {
+	for _, op := range ops {
+		switch op.kind {
+		case opAddSegment, opQuarantineSegment:
+			if _, exists := m.tags[op.tag]; !exists {
+				m.tags[op.tag] = make(map[uint64]manifestSegment)
+			}
+			s := op.segment
+			s.quarantined = op.kind == opQuarantineSegment
+			m.tags[op.tag][s.fileId] = s
+		case opRemoveSegment:
+			delete(m.tags[op.tag], op.segment.fileId)
+			if len(m.tags[op.tag]) == 0 {
+				delete(m.tags, op.tag)
+			}
+		case opDropTag:
+			delete(m.tags, op.tag)
+		}
+	}
+}
+
+//segmentsOf returns the segments of the tag, the quarantined ones included, ordered from the oldest to the newest
+func (m *manifest) segmentsOf(tag string) []manifestSegment {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ans := make([]manifestSegment, 0, len(m.tags[tag]))
+	for _, s := range m.tags[tag] {
+		ans = append(ans, s)
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		if ans[i].id == ans[j].id {
+			return ans[i].partition < ans[j].partition
+		}
+		return ans[i].id < ans[j].id
+	})
+	return ans
+}
+
+func (m *manifest) hasTag(tag string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, exists := m.tags[tag]
+	return exists
+}
+
+func (m *manifest) tagsList() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ans := make([]string, 0, len(m.tags))
+	for tag := range m.tags {
+		ans = append(ans, tag)
+	}
+	return ans
+}
+
+//availability returns the earliest and the latest timestamps of the entries of the segments not quarantined, leaving out
+//the segments having all of the entries expired or deleted by a tombstone of a newer segment
+func (m *manifest) availability() (uint64, uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := utils.GetNowMillis()
+	from, to := uint64(0), uint64(0)
+	for _, segments := range m.tags {
+		for _, s := range segments {
+			if s.quarantined || (s.lastTs == 0) || (!s.neverExpires && (s.expiresAt < now)) || isDeletedByNewer(s, segments) {
+				continue
+			}
+			if (from == 0) || (s.firstTs < from) {
+				from = s.firstTs
+			}
+			if s.lastTs > to {
+				to = s.lastTs
+			}
+		}
+	}
+	return from, to
+}
+
+func isDeletedByNewer(s manifestSegment, segments map[uint64]manifestSegment) bool {
+	for _, newer := range segments {
+		if newer.quarantined || (newer.id <= s.id) {
+			continue
+		}
+		for _, t := range newer.tombstones {
+			if (t.from <= s.firstTs) && (t.to >= s.lastTs) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *manifest) quarantinedTags() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ans := make([]string, 0)
+	for tag, segments := range m.tags {
+		for _, s := range segments {
+			if s.quarantined {
+				ans = append(ans, tag)
+				break
+			}
+		}
+	}
+	return ans
+}
+
+func encodeManifestRecord(seq uint64, ops []manifestOp) []byte {
+	payload := make([]byte, 8+4)
+	binary.LittleEndian.PutUint64(payload, seq)
+	binary.LittleEndian.PutUint32(payload[8:], uint32(len(ops)))
+	for _, op := range ops {
+		arr := make([]byte, manifestOpFixedSize(manifestFormatVersion)+len(op.tag))
+		arr[0] = op.kind
+		binary.LittleEndian.PutUint32(arr[1:], uint32(len(op.tag)))
+		copy(arr[5:], op.tag)
+		fields := arr[5+len(op.tag):]
+		binary.LittleEndian.PutUint64(fields, op.segment.fileId)
+		binary.LittleEndian.PutUint64(fields[8:], op.segment.partition)
+		binary.LittleEndian.PutUint64(fields[16:], op.segment.id)
+		binary.LittleEndian.PutUint64(fields[24:], op.segment.firstTs)
+		binary.LittleEndian.PutUint64(fields[32:], op.segment.lastTs)
+		binary.LittleEndian.PutUint64(fields[40:], op.segment.expiresAt)
+		if op.segment.neverExpires {
+			fields[48] = 1
+		}
+		binary.LittleEndian.PutUint32(fields[49:], uint32(len(op.segment.tombstones)))
+		for _, t := range op.segment.tombstones {
+			arr = append(arr, make([]byte, 16)...)
+			binary.LittleEndian.PutUint64(arr[len(arr)-16:], t.from)
+			binary.LittleEndian.PutUint64(arr[len(arr)-8:], t.to)
+		}
+		payload = append(payload, arr...)
+	}
+	record := make([]byte, manifestRecordHeaderSize, manifestRecordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+//decodeManifestRecord returns the seq and the ops of the record in the format version at the start of data, and the size of the record,
+//which is zero if the record is torn or corrupted
+func decodeManifestRecord(data []byte, version byte) (uint64, []manifestOp, int) {
+	if len(data) < manifestRecordHeaderSize {
+		return 0, nil, 0
+	}
+	payloadLen := uint64(binary.LittleEndian.Uint32(data))
+	if (payloadLen < 8+4) || (uint64(manifestRecordHeaderSize)+payloadLen > uint64(len(data))) {
+		return 0, nil, 0
+	}
+	payload := data[manifestRecordHeaderSize:(manifestRecordHeaderSize + payloadLen)]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[4:]) {
+		return 0, nil, 0
+	}
+	seq := binary.LittleEndian.Uint64(payload)
+	count := binary.LittleEndian.Uint32(payload[8:])
+	ops := make([]manifestOp, 0)
+	arr := payload[8+4:]
+	opFixedSize := uint64(manifestOpFixedSize(version))
+	for i := uint32(0); i < count; i++ {
+		if uint64(len(arr)) < opFixedSize {
+			return 0, nil, 0
+		}
+		tagLen := uint64(binary.LittleEndian.Uint32(arr[1:]))
+		if opFixedSize+tagLen > uint64(len(arr)) {
+			return 0, nil, 0
+		}
+		fields := arr[5+tagLen:]
+		s := manifestSegment{
+			fileId:    binary.LittleEndian.Uint64(fields),
+			partition: binary.LittleEndian.Uint64(fields[8:]),
+			id:        binary.LittleEndian.Uint64(fields[16:]),
+		}
+		if version >= manifestTimestampsFormatVersion {
+			s.firstTs = binary.LittleEndian.Uint64(fields[24:])
+			s.lastTs = binary.LittleEndian.Uint64(fields[32:])
+		}
+		opSize := opFixedSize + tagLen
+		if version >= manifestExpirationFormatVersion {
+			s.expiresAt = binary.LittleEndian.Uint64(fields[40:])
+			s.neverExpires = fields[48] == 1
+			tombstonesCount := uint64(binary.LittleEndian.Uint32(fields[49:]))
+			if opSize+tombstonesCount*16 > uint64(len(arr)) {
+				return 0, nil, 0
+			}
+			for j := uint64(0); j < tombstonesCount; j++ {
+				t := arr[(opSize + j*16):]
+				s.tombstones = append(s.tombstones, tombstone{from: binary.LittleEndian.Uint64(t), to: binary.LittleEndian.Uint64(t[8:])})
+			}
+			opSize += tombstonesCount * 16
+		}
+		ops = append(ops, manifestOp{kind: arr[0], tag: string(arr[5:(5 + tagLen)]), segment: s})
+		arr = arr[opSize:]
+	}
+	if len(arr) != 0 {
+		return 0, nil, 0
+	}
+	return seq, ops, manifestRecordHeaderSize + int(payloadLen)
+}
+
+func (s *segment) manifestSegment() manifestSegment {
+	ans := manifestSegment{fileId: s.fileId, partition: s.partition, id: s.id, tombstones: s.tombstones}
+	if s.entriesInFile > 0 {
+		ans.firstTs, ans.lastTs = s.firstTs, s.lastTs
+		ans.expiresAt, ans.neverExpires = s.expiresAt, s.neverExpires
+	}
+	return ans
+}
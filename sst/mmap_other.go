@@ -0,0 +1,15 @@
+// +build !linux
+
+package sst
+
+import (
+	"os"
+)
+
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
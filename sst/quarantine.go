@@ -0,0 +1,338 @@
+package sst
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/jeanphorn/log4go"
+	"github.com/nikita-tomilov/golsm/errs"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+//the unreadable SST files are moved to this directory next to them, to be salvaged by Repair
+const quarantineDirName = "quarantine"
+
+//RepairReport tells what Repair salvaged from the quarantined files of the tag and what was lost;
+//the entries of the lost blocks are only counted if the index of the file was readable
+type RepairReport struct {
+	Files           []string
+	SalvagedEntries int
+	LostEntries     int
+	LostBlocks      int
+	LostBytes       int64
+	LostTombstones  bool
+}
+
+type quarantinedFile struct {
+	fileName  string
+	fileId    uint64
+	partition uint64
+	id        uint64
+}
+
+func (st *SSTforTag) quarantineDir() string {
+	return filepath.Join(st.dir(), quarantineDirName)
+}
+
+//openOrQuarantine opens the segment; if it is corrupted, the file is moved to the quarantine and nil is returned,
+//so that the rest of the data stays available
+func (st *SSTforTag) openOrQuarantine(ms manifestSegment) (*segment, error) {
+	fileName := segmentFileName(st.dir(), ms.fileId)
+	s, err := openSegment(st.files, st.MemoryMapped, fileName, ms.fileId, ms.partition, ms.id)
+	if !errors.Is(err, errs.ErrCorrupted) {
+		return s, err
+	}
+	log.Error(fmt.Sprintf("Moving SST file %s of tag %s to quarantine: %s", fileName, st.Tag, err.Error()))
+	if err := st.manifest.apply(manifestOp{kind: opQuarantineSegment, tag: st.Tag, segment: ms}); err != nil {
+		return nil, err
+	}
+	st.files.evict(fileName)
+	return nil, moveToQuarantine(fileName)
+}
+
+//quarantine moves the segment found corrupted on read to the quarantine and out of the current version;
+//the readers still having the segment keep reading the moved file
+func (st *SSTforTag) quarantine(s *segment, cause error) {
+	st.compactionMutex.Lock()
+	defer st.compactionMutex.Unlock()
+	st.quarantineSegment(s, cause)
+}
+
+//must be called under the compaction mutex
+func (st *SSTforTag) quarantineSegment(s *segment, cause error) {
+	if !st.hasSegment(s) {
+		return
+	}
+	log.Error(fmt.Sprintf("Moving SST file %s of tag %s to quarantine: %s", s.fileName, st.Tag, cause.Error()))
+	if err := st.manifest.apply(manifestOp{kind: opQuarantineSegment, tag: st.Tag, segment: s.manifestSegment()}); err != nil {
+		log.Error(fmt.Sprintf("Unable to quarantine SST file %s: %s", s.fileName, err.Error()))
+		return
+	}
+	atomic.StoreInt32(&s.kept, 1)
+	st.setVersion(func(segments []*segment) []*segment {
+		ans := segments[:0]
+		for _, current := range segments {
+			if current != s {
+				ans = append(ans, current)
+			}
+		}
+		return ans
+	})
+	st.files.evict(s.fileName)
+	if err := moveToQuarantine(s.fileName); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+//hasSegment tells whether the segment is in the current version
+func (st *SSTforTag) hasSegment(s *segment) bool {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	for _, current := range st.version.segments {
+		if current == s {
+			return true
+		}
+	}
+	return false
+}
+
+//moveToQuarantine moves the file to the quarantine directory next to it
+func moveToQuarantine(fileName string) error {
+	dir := filepath.Join(filepath.Dir(fileName), quarantineDirName)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return errs.IO("creating quarantine directory "+dir, err)
+	}
+	if err := os.Rename(fileName, filepath.Join(dir, filepath.Base(fileName))); err != nil {
+		return errs.IO("moving SST file "+fileName+" to quarantine", err)
+	}
+	return syncDir(fileName)
+}
+
+//quarantinedFiles returns the quarantined files of the tag recorded in the manifest
+func (st *SSTforTag) quarantinedFiles() []quarantinedFile {
+	ans := make([]quarantinedFile, 0)
+	for _, s := range st.quarantinedSegments() {
+		ans = append(ans, quarantinedFile{fileName: segmentFileName(st.quarantineDir(), s.fileId), fileId: s.fileId, partition: s.partition, id: s.id})
+	}
+	return ans
+}
+
+func (st *SSTforTag) quarantinedSegments() []manifestSegment {
+	ans := make([]manifestSegment, 0)
+	for _, s := range st.manifest.segmentsOf(st.Tag) {
+		if s.quarantined {
+			ans = append(ans, s)
+		}
+	}
+	return ans
+}
+
+//quarantinedRanges returns the ranges of the entries of the quarantined segments older than the id; the tombstones overlapping them
+//are kept, as Repair brings the segments back. The segment without the timestamps in the manifest may hold any within its partition,
+//or any at all if written before the partitioning
+func (st *SSTforTag) quarantinedRanges(quarantined []manifestSegment, id uint64) []tombstone {
+	window := uint64(st.PartitionWindow.Milliseconds())
+	ans := make([]tombstone, 0)
+	for _, q := range quarantined {
+		switch {
+		case q.id >= id:
+		case q.lastTs != 0:
+			ans = append(ans, tombstone{from: q.firstTs, to: q.lastTs})
+		case q.partition != noPartition:
+			ans = append(ans, tombstone{from: q.partition, to: q.partition + window - 1})
+		default:
+			ans = append(ans, tombstone{from: 0, to: math.MaxUint64})
+		}
+	}
+	return ans
+}
+
+//Repair salvages every decodable entry of the quarantined files of the tag into a fresh segment taking the place
+//of the quarantined one, and removes the quarantined file
+func (st *SSTforTag) Repair() (RepairReport, error) {
+	st.compactionMutex.Lock()
+	defer st.compactionMutex.Unlock()
+	report := RepairReport{Files: make([]string, 0)}
+	for _, q := range st.quarantinedFiles() {
+		entries, tombstones, err := salvage(q.fileName, &report)
+		if err != nil {
+			return report, err
+		}
+		salvaged, err := st.restore(q, entries, tombstones)
+		if err != nil {
+			return report, err
+		}
+		report.Files = append(report.Files, q.fileName)
+		report.SalvagedEntries += salvaged
+		log.Info(fmt.Sprintf("Salvaged %d entries of tag %s from quarantined SST file %s", salvaged, st.Tag, q.fileName))
+	}
+	return report, nil
+}
+
+//restore writes the salvaged entries as the segment with the partition and the id of the quarantined one,
+//replacing the quarantined file in the manifest; returns the count of the entries written
+func (st *SSTforTag) restore(q quarantinedFile, entries []Entry, tombstones []tombstone) (int, error) {
+	s, err := writeSegment(st.files, st.MemoryMapped, st.dir(), st.manifest.newFileId(), q.partition, q.id, entries, tombstones, st.Codec, st.BlockSize)
+	if err != nil {
+		return 0, err
+	}
+	removed := manifestOp{kind: opRemoveSegment, tag: st.Tag, segment: manifestSegment{fileId: q.fileId}}
+	if (s.entriesInFile == 0) && (len(s.tombstones) == 0) {
+		if err := s.remove(); err != nil {
+			return 0, err
+		}
+		err = st.manifest.apply(removed)
+	} else {
+		err = s.install()
+		if err == nil {
+			if err = st.manifest.apply(manifestOp{kind: opAddSegment, tag: st.Tag, segment: s.manifestSegment()}, removed); err != nil {
+				s.remove()
+			}
+		}
+		if err == nil {
+			st.setVersion(func(segments []*segment) []*segment {
+				return append(segments, s)
+			})
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return s.entriesInFile, errs.IO("removing quarantined SST file "+q.fileName, os.Remove(q.fileName))
+}
+
+//salvage decodes whatever is readable in the file, adding the losses to the report
+func salvage(fileName string, report *RepairReport) ([]Entry, []tombstone, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, errs.IO("opening quarantined SST file "+fileName, err)
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, nil, errs.IO("reading quarantined SST file "+fileName, err)
+	}
+	version, dataOffset := byte(legacyFormatVersion), int64(0)
+	if (int64(len(data)) >= fileHeaderSize()) && bytes.Equal(data[:len(fileMagic)], fileMagic) {
+		version, dataOffset = data[len(fileMagic)], fileHeaderSize()
+	}
+	if (version > formatVersion) || (version < legacyFormatVersion) {
+		report.LostBytes += int64(len(data))
+		return []Entry{}, nil, nil
+	}
+	if version < blockFormatVersion {
+		return sortSalvaged(salvageEntries(data, dataOffset, version, report)), nil, nil
+	}
+	var tombstones []tombstone
+	if version >= tombstonesFormatVersion {
+		if tombstones, err = readTombstones(file, dataOffset, int64(len(data))); err != nil {
+			tombstones = nil
+			report.LostTombstones = true
+		}
+	}
+	entries := salvageBlocks(file, data, dataOffset, version, report)
+	return sortSalvaged(entries), tombstones, nil
+}
+
+//salvageEntries reads the entries of the file written before the blocks were introduced until the first one not fitting the file
+func salvageEntries(data []byte, dataOffset int64, version byte, report *RepairReport) []Entry {
+	ans := make([]Entry, 0)
+	prefixSize := int64(lengthPrefixSize(version))
+	size := int64(len(data))
+	for pos := dataOffset; pos+prefixSize <= size; {
+		if (pos+4 <= size) && isEndOfEntries(version, data[pos:]) {
+			break
+		}
+		entrySize := int64(readLengthPrefix(version, data[pos:]))
+		if (entrySize < 16) || (pos+prefixSize+entrySize > size) {
+			report.LostBytes += size - pos
+			break
+		}
+		ans = append(ans, FromByteArray(data[pos+prefixSize:pos+prefixSize+entrySize]))
+		pos += prefixSize + entrySize
+	}
+	return ans
+}
+
+//salvageBlocks decodes the blocks one after another, skipping the ones failing the checksum; with the index at hand,
+//a block not ending where the next one starts is skipped as well, otherwise the damaged length ends the salvage
+func salvageBlocks(file *os.File, data []byte, dataOffset int64, version byte, report *RepairReport) []Entry {
+	size := int64(len(data))
+	f, index, indexErr := readIndex(file, size, version)
+	countAt := make(map[int64]int)
+	boundaries := make([]int64, 0)
+	if indexErr == nil {
+		for _, e := range index {
+			countAt[e.fileOffset] = e.count
+			boundaries = append(boundaries, e.fileOffset)
+		}
+		boundaries = append(boundaries, f.indexOffset-4)
+		sort.Slice(boundaries, func(i, j int) bool {
+			return boundaries[i] < boundaries[j]
+		})
+	}
+	ans := make([]Entry, 0)
+	next := 0
+	for pos := dataOffset; pos+4 <= size; {
+		length := binary.LittleEndian.Uint32(data[pos:])
+		if (length == endOfEntriesMarker) && (indexErr != nil) {
+			break
+		}
+		end := pos + 4 + blockHeaderSize + int64(length)
+		if indexErr == nil {
+			for (next < len(boundaries)) && (boundaries[next] <= pos) {
+				next++
+			}
+			if next == len(boundaries) {
+				break
+			}
+			if end != boundaries[next] {
+				report.LostBlocks++
+				report.LostBytes += boundaries[next] - pos
+				report.LostEntries += countAt[pos]
+				pos = boundaries[next]
+				continue
+			}
+		} else if end > size {
+			report.LostBytes += size - pos
+			break
+		}
+		header := data[pos+4 : pos+4+blockHeaderSize]
+		if header[0] != tombstonesBlockId {
+			raw, err := decodeBlock(header, data[pos+4+blockHeaderSize:end])
+			var entries []Entry
+			if err == nil {
+				entries, err = decodeBlockEntries(raw, nil, FromByteArray)
+			}
+			if err != nil {
+				report.LostBlocks++
+				report.LostBytes += end - pos
+				report.LostEntries += countAt[pos]
+			}
+			ans = append(ans, entries...)
+		}
+		pos = end
+	}
+	return ans
+}
+
+//sortSalvaged sorts the entries, since their order can not be trusted in a damaged file; for equal timestamps the later entry wins
+func sortSalvaged(entries []Entry) []Entry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp < entries[j].Timestamp
+	})
+	ans := entries[:0]
+	for i, entry := range entries {
+		if (i+1 < len(entries)) && (entries[i+1].Timestamp == entry.Timestamp) {
+			continue
+		}
+		ans = append(ans, entry)
+	}
+	return ans
+}
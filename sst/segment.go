@@ -0,0 +1,718 @@
+package sst
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/google/btree"
+	log "github.com/jeanphorn/log4go"
+	"github.com/nikita-tomilov/golsm/errs"
+	"github.com/nikita-tomilov/golsm/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//noPartition marks the segments written before the time partitioning was introduced; they may span any timestamps
+const noPartition = ^uint64(0)
+
+//segment is an immutable sorted file holding a part of the tag data within a single time partition;
+//a segment with a greater id is newer and its entries win over the ones with equal timestamps in older segments.
+//The file of the segment is named by its file id, which the manifest maps to the tag, the partition and the id.
+//The index points to the blocks of the entries; the segments written before the blocks were introduced have a block per entry
+//The tombstones of a segment delete the entries within their ranges from the older segments
+type segment struct {
+	fileId        uint64
+	id            uint64
+	partition     uint64
+	fileName      string
+	formatVersion byte
+	dataOffset    int64
+	size          int64
+	entriesInFile int
+	blocksInFile  int
+	//the entries of the expired blocks removed from the index
+	droppedFromIndex int
+	lastBlock        IndexEntry
+	firstTs          uint64
+	lastTs           uint64
+	expiresAt        uint64
+	neverExpires     bool
+	tombstones       []tombstone
+	index            *btree.BTree
+	indexMutex       *sync.RWMutex
+	files            *fileCache
+	//the count of the versions having the segment, see version
+	versions int32
+	//the segment is read through the mapping of its file, made on the first read and kept until the segment is removed
+	memoryMapped bool
+	mapped       []byte
+	//set once the file is moved to the quarantine or the tag is closed, so that the file is not removed with the segment
+	kept int32
+}
+
+func segmentFileName(dir string, fileId uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.sst", fileId))
+}
+
+//parseSegmentFileName returns the file id of the segment stored in the file, and whether the file is an unfinished one
+func parseSegmentFileName(name string) (uint64, bool, bool) {
+	var fileId uint64
+	if n, _ := fmt.Sscanf(name, "%d.sst", &fileId); n != 1 {
+		return 0, false, false
+	}
+	switch name {
+	case filepath.Base(segmentFileName("", fileId)):
+		return fileId, false, true
+	case filepath.Base(segmentFileName("", fileId)) + ".tmp":
+		return fileId, true, true
+	}
+	return 0, false, false
+}
+
+//the blocks of the segment are checked as they are read, and the segment gets mapped on the first read, if memoryMapped
+func openSegment(files *fileCache, memoryMapped bool, fileName string, fileId uint64, partition uint64, id uint64) (*segment, error) {
+	s := &segment{fileId: fileId, id: id, partition: partition, fileName: fileName, index: btree.New(4), indexMutex: &sync.RWMutex{}, files: files}
+	h, err := files.acquire(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer files.release(h)
+	file := h.File
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errs.IO("opening SST segment "+fileName, err)
+	}
+	s.size = info.Size()
+	s.formatVersion, s.dataOffset, err = readFormatVersion(file)
+	if err != nil {
+		return nil, errs.IO("reading SST segment "+fileName, err)
+	}
+	if (s.formatVersion > formatVersion) || (s.formatVersion < legacyFormatVersion) {
+		return nil, errs.Corrupted("SST segment %s has unknown format version %d", fileName, s.formatVersion)
+	}
+	if s.formatVersion >= tombstonesFormatVersion {
+		if s.tombstones, err = readTombstones(file, s.dataOffset, s.size); err != nil {
+			return nil, errs.Corrupted("SST segment %s: %v", fileName, err)
+		}
+	}
+	if s.formatVersion >= indexedFormatVersion {
+		err = s.loadIndex(file)
+		if err == nil {
+			s.memoryMapped = memoryMapped
+			return s, nil
+		}
+		log.Warn(fmt.Sprintf("Unable to load the index of SST segment %s, scanning the entries: %s", fileName, err.Error()))
+		s.index.Clear(false)
+	}
+	if err := s.iterateOverAllEntries(s.track); err != nil {
+		return nil, err
+	}
+	s.memoryMapped = memoryMapped
+	return s, nil
+}
+
+//loadIndex restores the index and the bounds of the segment from its footer
+func (s *segment) loadIndex(file *os.File) error {
+	f, index, err := readIndex(file, s.size, s.formatVersion)
+	if err != nil {
+		return err
+	}
+	for _, e := range index {
+		s.index.ReplaceOrInsert(e)
+		s.entriesInFile += e.count
+	}
+	if uint64(s.index.Len()) != f.blocksCount {
+		return fmt.Errorf("index has %d distinct blocks instead of %d", s.index.Len(), f.blocksCount)
+	}
+	s.blocksInFile = int(f.blocksCount)
+	s.firstTs = f.firstTs
+	s.lastTs = f.lastTs
+	s.expiresAt = f.expiresAt
+	s.neverExpires = f.neverExpires
+	return nil
+}
+
+//writeSegment writes the sorted entries to a temporary file which becomes the segment after install;
+//the entries are grouped into the blocks of about blockSize bytes compressed with the codec, already expired entries are not written
+func writeSegment(files *fileCache, memoryMapped bool, dir string, fileId uint64, partition uint64, id uint64, entries []Entry, tombstones []tombstone, codec Codec, blockSize int) (*segment, error) {
+	tmpFileName := segmentFileName(dir, fileId) + ".tmp"
+	s := &segment{fileId: fileId, id: id, partition: partition, fileName: tmpFileName, formatVersion: formatVersion, dataOffset: fileHeaderSize(), index: btree.New(4), indexMutex: &sync.RWMutex{}, files: files, memoryMapped: memoryMapped}
+	file, err := os.OpenFile(tmpFileName, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errs.IO("creating SST segment "+tmpFileName, err)
+	}
+	err = s.writeTo(file, entries, tombstones, codec, blockSize)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFileName)
+		return nil, errs.IO("writing SST segment "+tmpFileName, err)
+	}
+	return s, nil
+}
+
+func (s *segment) writeTo(file *os.File, entries []Entry, tombstones []tombstone, codec Codec, blockSize int) error {
+	writer := bufio.NewWriter(file)
+	if _, err := writer.Write(fileHeader()); err != nil {
+		return err
+	}
+	offset := s.dataOffset
+	if len(tombstones) > 0 {
+		block := encodeTombstonesBlock(tombstones)
+		if _, err := writer.Write(block); err != nil {
+			return err
+		}
+		offset += int64(len(block))
+		s.tombstones = tombstones
+	}
+	now := utils.GetNowMillis()
+	raw := make([]byte, 0, blockSize)
+	blockEntries := make([]Entry, 0)
+	writeBlock := func() error {
+		if len(blockEntries) == 0 {
+			return nil
+		}
+		block, err := encodeBlock(codec, raw)
+		if err != nil {
+			return err
+		}
+		if _, err = writer.Write(block); err != nil {
+			return err
+		}
+		for _, entry := range blockEntries {
+			s.track(entry, offset)
+		}
+		offset += int64(len(block))
+		raw = raw[:0]
+		blockEntries = blockEntries[:0]
+		return nil
+	}
+	for _, entry := range entries {
+		if (entry.ExpiresAt != 0) && (entry.ExpiresAt < now) {
+			continue
+		}
+		raw = append(raw, entry.ToByteArrayWithLength()...)
+		blockEntries = append(blockEntries, entry)
+		if len(raw) >= blockSize {
+			if err := writeBlock(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := writeBlock(); err != nil {
+		return err
+	}
+	indexAndFooter := encodeIndex(s.indexEntries(), footer{
+		indexOffset:  offset + 4,
+		blocksCount:  uint64(s.blocksInFile),
+		firstTs:      s.firstTs,
+		lastTs:       s.lastTs,
+		expiresAt:    s.expiresAt,
+		neverExpires: s.neverExpires,
+	})
+	if _, err := writer.Write(indexAndFooter); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	s.size = offset + int64(len(indexAndFooter))
+	return file.Sync()
+}
+
+func (s *segment) indexEntries() []IndexEntry {
+	s.indexMutex.RLock()
+	defer s.indexMutex.RUnlock()
+	ans := make([]IndexEntry, 0, s.index.Len())
+	s.index.Ascend(func(i btree.Item) bool {
+		ans = append(ans, i.(IndexEntry))
+		return true
+	})
+	return ans
+}
+
+//track adds the entry stored in the block at the given offset to the index and to the bounds of the segment
+func (s *segment) track(e Entry, offset int64) {
+	block := s.lastBlock
+	if (s.blocksInFile > 0) && (block.fileOffset == offset) {
+		block.lastTs = e.Timestamp
+		block.count++
+		if (block.expiresAt != 0) && ((e.ExpiresAt == 0) || (e.ExpiresAt > block.expiresAt)) {
+			block.expiresAt = e.ExpiresAt
+		}
+		if (e.ExpiresAt != 0) && ((block.expiresFrom == 0) || (e.ExpiresAt < block.expiresFrom)) {
+			block.expiresFrom = e.ExpiresAt
+		}
+	} else {
+		block = IndexEntry{ts: e.Timestamp, lastTs: e.Timestamp, fileOffset: offset, expiresAt: e.ExpiresAt, expiresFrom: e.ExpiresAt, count: 1}
+		s.blocksInFile++
+	}
+	s.index.ReplaceOrInsert(block)
+	s.lastBlock = block
+	s.entriesInFile++
+	if (s.entriesInFile == 1) || (e.Timestamp < s.firstTs) {
+		s.firstTs = e.Timestamp
+	}
+	if e.Timestamp > s.lastTs {
+		s.lastTs = e.Timestamp
+	}
+	if e.ExpiresAt == 0 {
+		s.neverExpires = true
+	} else if e.ExpiresAt > s.expiresAt {
+		s.expiresAt = e.ExpiresAt
+	}
+}
+
+//overlaps tells whether the segment may hold the entries or the tombstones within [fromTs, toTs], expired entries included
+func (s *segment) overlaps(fromTs uint64, toTs uint64) bool {
+	if s.overlapsEntries(fromTs, toTs) {
+		return true
+	}
+	for _, t := range s.tombstones {
+		if t.overlaps(fromTs, toTs) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *segment) overlapsEntries(fromTs uint64, toTs uint64) bool {
+	return (s.entriesInFile > 0) && (s.firstTs <= toTs) && (s.lastTs >= fromTs)
+}
+
+//isOutdated tells whether the whole segment can be dropped, either because every entry in it is expired
+//and there are no tombstones to apply to the older segments, or because even its newest data is older than the retention
+func (s *segment) isOutdated(now uint64, retention time.Duration) bool {
+	if (len(s.tombstones) == 0) && ((s.entriesInFile == 0) || (!s.neverExpires && (s.expiresAt < now))) {
+		return true
+	}
+	newest := s.lastTs
+	for _, t := range s.tombstones {
+		if t.to > newest {
+			newest = t.to
+		}
+	}
+	return (retention > 0) && (now > uint64(retention.Milliseconds())) && (newest < now-uint64(retention.Milliseconds()))
+}
+
+//install atomically renames the written segment to its final name, replacing the previous file, if there was one
+func (s *segment) install() error {
+	fileName := strings.TrimSuffix(s.fileName, ".tmp")
+	if err := os.Rename(s.fileName, fileName); err != nil {
+		return errs.IO("installing SST segment "+fileName, err)
+	}
+	s.fileName = fileName
+	return syncDir(fileName)
+}
+
+func syncDir(fileName string) error {
+	dir, err := os.Open(filepath.Dir(fileName))
+	if err != nil {
+		return errs.IO("opening directory of "+fileName, err)
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		log.Warn(fmt.Sprintf("Unable to sync directory of %s: %s", fileName, err.Error()))
+	}
+	return nil
+}
+
+//errMmapUnsupported makes the segments be read from the files where the mapping is not available
+var errMmapUnsupported = errors.New("memory mapping is not supported")
+
+//mapping returns the contents of the file mapped to the memory
+func (s *segment) mapping() ([]byte, error) {
+	s.indexMutex.RLock()
+	mapped := s.mapped
+	s.indexMutex.RUnlock()
+	if mapped != nil {
+		return mapped, nil
+	}
+	s.indexMutex.Lock()
+	defer s.indexMutex.Unlock()
+	if s.mapped != nil {
+		return s.mapped, nil
+	}
+	h, err := s.files.acquire(s.fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer s.files.release(h)
+	data, err := mapFile(h.File, s.size)
+	if err == errMmapUnsupported {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errs.IO("mapping SST segment "+s.fileName, err)
+	}
+	s.mapped = data
+	return data, nil
+}
+
+//the segment is removed once it has no readers, so the mapping is no longer used
+func (s *segment) remove() error {
+	s.files.evict(s.fileName)
+	s.indexMutex.Lock()
+	if s.mapped != nil {
+		if err := unmapFile(s.mapped); err != nil {
+			log.Warn(fmt.Sprintf("Unable to unmap SST segment %s: %s", s.fileName, err.Error()))
+		}
+		s.mapped = nil
+	}
+	s.indexMutex.Unlock()
+	if atomic.LoadInt32(&s.kept) != 0 {
+		return nil
+	}
+	return errs.IO("removing SST segment "+s.fileName, os.Remove(s.fileName))
+}
+
+func (s *segment) iterateOverAllEntries(receiver func(Entry, int64)) error {
+	return s.iterateOverEntries(0, func(e Entry, o int64) bool {
+		receiver(e, o)
+		return true
+	})
+}
+
+//readError tells the truncated segment from the failed read
+func (s *segment) readError(err error) error {
+	if (err == io.EOF) || (err == io.ErrUnexpectedEOF) {
+		return errs.Corrupted("SST segment %s is truncated", s.fileName)
+	}
+	return errs.IO("reading SST segment "+s.fileName, err)
+}
+
+//iterateOverEntries reads the entries starting from the block at the given offset until the receiver returns false;
+//the receiver gets the offset of the block holding the entry. The entries of the uncompressed blocks of the mapped segment share its memory
+func (s *segment) iterateOverEntries(fileOffsetBytes int64, receiver func(Entry, int64) bool) error {
+	if fileOffsetBytes < s.dataOffset {
+		fileOffsetBytes = s.dataOffset
+	}
+	if s.memoryMapped {
+		data, err := s.mapping()
+		if err == nil {
+			return s.decodeEntries(&mappedSource{data: data, pos: fileOffsetBytes}, fromByteArrayInPlace, fileOffsetBytes, receiver)
+		}
+		if err != errMmapUnsupported {
+			return err
+		}
+	}
+
+	h, err := s.files.acquire(s.fileName)
+	if err != nil {
+		return err
+	}
+	defer s.files.release(h)
+	//the positional reads do not move the offset of the shared handle
+	reader := readerPool.Get().(*bufio.Reader)
+	reader.Reset(io.NewSectionReader(h, fileOffsetBytes, s.size-fileOffsetBytes))
+	defer putReader(reader)
+	return s.decodeEntries(&streamedSource{reader: reader, remaining: s.size - fileOffsetBytes}, FromByteArray, fileOffsetBytes, receiver)
+}
+
+//entriesSource gives the consecutive bytes of the segment
+type entriesSource interface {
+	//next returns the next n bytes, either read into buf or sliced out of the mapping
+	next(buf *[]byte, n int) ([]byte, error)
+}
+
+type streamedSource struct {
+	reader *bufio.Reader
+	//the bytes left in the file, so that a damaged length is not allocated
+	remaining int64
+}
+
+func (src *streamedSource) next(buf *[]byte, n int) ([]byte, error) {
+	if int64(n) > src.remaining {
+		src.remaining = 0
+		return nil, io.ErrUnexpectedEOF
+	}
+	src.remaining -= int64(n)
+	*buf = growBuffer(*buf, n)
+	_, err := io.ReadFull(src.reader, *buf)
+	return *buf, err
+}
+
+type mappedSource struct {
+	data []byte
+	pos  int64
+}
+
+func (src *mappedSource) next(_ *[]byte, n int) ([]byte, error) {
+	if src.pos+int64(n) > int64(len(src.data)) {
+		src.pos = int64(len(src.data))
+		return nil, io.ErrUnexpectedEOF
+	}
+	ans := src.data[src.pos : src.pos+int64(n) : src.pos+int64(n)]
+	src.pos += int64(n)
+	return ans, nil
+}
+
+//decodeEntries decodes the entries of the source, which starts at the given offset of the file; decode tells whether the values
+//are copied out of the bytes of the source or share them
+func (s *segment) decodeEntries(src entriesSource, decode func([]byte) Entry, fileOffsetBytes int64, receiver func(Entry, int64) bool) error {
+	scratch := blockPool.Get().(*[]byte)
+	defer blockPool.Put(scratch)
+	entries := entriesPool.Get().(*[]Entry)
+	defer putEntries(entries)
+
+	readerFileOffset := int64(fileOffsetBytes)
+	prevFileOffset := int64(fileOffsetBytes)
+	entriesParsed := 0
+	prevEntry := Entry{Timestamp: 0}
+	sizeBuf := make([]uint8, lengthPrefixSize(s.formatVersion))
+	blockHeader := make([]uint8, blockHeaderSize)
+	for {
+		size, err := src.next(&sizeBuf, len(sizeBuf))
+		if (err != nil) || isEndOfEntries(s.formatVersion, size) {
+			break
+		}
+		readerFileOffset += int64(len(size))
+		if s.formatVersion >= blockFormatVersion {
+			header, err := src.next(&blockHeader, blockHeaderSize)
+			if err != nil {
+				return s.readError(err)
+			}
+			compressed, err := src.next(scratch, readLengthPrefix(s.formatVersion, size))
+			if err != nil {
+				return s.readError(err)
+			}
+			readerFileOffset += int64(len(header) + len(compressed))
+			if header[0] == tombstonesBlockId {
+				prevFileOffset = readerFileOffset
+				continue
+			}
+			raw, err := decodeBlock(header, compressed)
+			if err != nil {
+				return errs.Corrupted("SST segment %s block at %d: %v", s.fileName, prevFileOffset, err)
+			}
+			*entries, err = decodeBlockEntries(raw, (*entries)[:0], decode)
+			if err != nil {
+				return errs.Corrupted("SST segment %s block at %d: %v", s.fileName, prevFileOffset, err)
+			}
+			for _, entry := range *entries {
+				if entry.Timestamp < prevEntry.Timestamp {
+					return errs.Corrupted("SST segment %s is not sorted: ts %d after %d", s.fileName, entry.Timestamp, prevEntry.Timestamp)
+				}
+				prevEntry = entry
+				entriesParsed += 1
+				if !receiver(entry, prevFileOffset) {
+					return nil
+				}
+			}
+			prevFileOffset = readerFileOffset
+			continue
+		}
+		entrySize := readLengthPrefix(s.formatVersion, size)
+		entryBytes, err := src.next(scratch, entrySize)
+		if err != nil {
+			return s.readError(err)
+		}
+		if entrySize < 16 {
+			return errs.Corrupted("SST segment %s has entry of size %d after %d entries", s.fileName, entrySize, entriesParsed)
+		}
+		readerFileOffset += int64(len(entryBytes))
+		entry := decode(entryBytes)
+		if entry.Timestamp < prevEntry.Timestamp {
+			return errs.Corrupted("SST segment %s is not sorted: ts %d after %d", s.fileName, entry.Timestamp, prevEntry.Timestamp)
+		}
+		prevEntry = entry
+		entriesParsed += 1
+		if !receiver(entry, prevFileOffset) {
+			break
+		}
+		prevFileOffset = readerFileOffset
+	}
+	return nil
+}
+
+//the buffers of the reads are reused by the following reads; the decoded entries copy their values out of them
+var readerPool = sync.Pool{New: func() interface{} {
+	return bufio.NewReader(nil)
+}}
+
+var blockPool = sync.Pool{New: func() interface{} {
+	buf := make([]byte, 0, DefaultBlockSize)
+	return &buf
+}}
+
+var entriesPool = sync.Pool{New: func() interface{} {
+	entries := make([]Entry, 0)
+	return &entries
+}}
+
+func putReader(reader *bufio.Reader) {
+	reader.Reset(nil)
+	readerPool.Put(reader)
+}
+
+func putEntries(entries *[]Entry) {
+	for i := range *entries {
+		(*entries)[i] = Entry{}
+	}
+	*entries = (*entries)[:0]
+	entriesPool.Put(entries)
+}
+
+func growBuffer(buf []byte, size int) []byte {
+	if cap(buf) < size {
+		return make([]byte, size)
+	}
+	return buf[:size]
+}
+
+func (s *segment) allEntries() ([]Entry, error) {
+	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
+	err := s.iterateOverAllEntries(func(e Entry, o int64) {
+		ans = append(ans, e)
+	})
+	return ans, err
+}
+
+func (s *segment) entriesWithoutIndex(fromTs uint64, toTs uint64, now uint64) ([]Entry, error) {
+	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
+	err := s.iterateOverAllEntries(func(e Entry, o int64) {
+		if (e.Timestamp > 0) && (e.Timestamp >= fromTs) && (e.Timestamp <= toTs) && ((e.ExpiresAt == 0) || (e.ExpiresAt >= now)) {
+			ans = append(ans, e)
+		}
+	})
+	return ans, err
+}
+
+//entriesWithIndex reads the blocks starting from the first non-expired one overlapping the range until the range ends
+func (s *segment) entriesWithIndex(fromTs uint64, toTs uint64, now uint64) ([]Entry, error) {
+	firstOffset := int64(-1)
+	s.indexMutex.RLock()
+	s.index.DescendLessOrEqual(IndexEntry{ts: fromTs}, func(i btree.Item) bool {
+		oe := i.(IndexEntry)
+		if (oe.lastTs >= fromTs) && !oe.isExpired(now) {
+			firstOffset = oe.fileOffset
+		}
+		return false
+	})
+	s.index.AscendRange(IndexEntry{ts: fromTs}, IndexEntry{ts: toTs + 1}, func(i btree.Item) bool {
+		if firstOffset != -1 {
+			return false
+		}
+		oe := i.(IndexEntry)
+		if oe.isExpired(now) {
+			return true
+		}
+		//log.Debug(fmt.Sprintf("ascendRange on segment %s entry ts %d offset %d", s.fileName, oe.ts, oe.fileOffset))
+		firstOffset = oe.fileOffset
+		return false
+	})
+	s.indexMutex.RUnlock()
+	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
+	if firstOffset == -1 {
+		return ans, nil
+	}
+	err := s.iterateOverEntries(firstOffset, func(e Entry, i int64) bool {
+		if e.Timestamp > toTs {
+			return false
+		}
+		if (e.Timestamp > 0) && (e.Timestamp >= fromTs) && ((e.ExpiresAt == 0) || (e.ExpiresAt >= now)) {
+			ans = append(ans, e)
+		}
+		return true
+	})
+	return ans, err
+}
+
+func (s *segment) minTimestamp() uint64 {
+	min := s.boundary((*btree.BTree).Min)
+	if min == nil {
+		return 0
+	}
+	return min.(IndexEntry).ts
+}
+
+func (s *segment) maxTimestamp() uint64 {
+	max := s.boundary((*btree.BTree).Max)
+	if max == nil {
+		return 0
+	}
+	return max.(IndexEntry).lastTs
+}
+
+//boundary returns the first or the last block of the index; the expired blocks are dropped from the index
+//under the write lock only once the boundary one is found expired under the read lock
+func (s *segment) boundary(of func(*btree.BTree) btree.Item) btree.Item {
+	s.indexMutex.RLock()
+	block := of(s.index)
+	s.indexMutex.RUnlock()
+	if (block == nil) || !block.(IndexEntry).isExpired(utils.GetNowMillis()) {
+		return block
+	}
+	s.indexMutex.Lock()
+	defer s.indexMutex.Unlock()
+	s.performExpirationWithinIndex()
+	return of(s.index)
+}
+
+//must be called under the write lock of the index
+func (s *segment) performExpirationWithinIndex() {
+	toBeDeleted := make([]IndexEntry, 0, DefaultSlicePreassignedMem)
+	now := utils.GetNowMillis()
+	s.index.Ascend(func(i btree.Item) bool {
+		oe := i.(IndexEntry)
+		if oe.isExpired(now) {
+			toBeDeleted = append(toBeDeleted, oe)
+		}
+		return true
+	})
+	for _, i := range toBeDeleted {
+		s.index.Delete(i)
+		s.droppedFromIndex += i.count
+	}
+}
+
+//expiredFraction estimates the part of the entries in the file that are expired; within a block that is expired only partially,
+//the expiration times are assumed to be spread evenly between the earliest and the latest of them
+func (s *segment) expiredFraction(now uint64) float64 {
+	s.indexMutex.RLock()
+	defer s.indexMutex.RUnlock()
+	if s.entriesInFile == 0 {
+		return 0
+	}
+	expired := float64(s.droppedFromIndex)
+	s.index.Ascend(func(i btree.Item) bool {
+		oe := i.(IndexEntry)
+		switch {
+		case oe.isExpired(now):
+			expired += float64(oe.count)
+		case (oe.expiresFrom == 0) || (oe.expiresFrom >= now):
+		case oe.expiresAt == 0:
+			expired += float64(oe.count) / 2
+		default:
+			expired += float64(oe.count) * float64(now-oe.expiresFrom) / float64(oe.expiresAt-oe.expiresFrom)
+		}
+		return true
+	})
+	return expired / float64(s.entriesInFile)
+}
+
+//IndexEntry points to the block holding the entries from ts to lastTs
+type IndexEntry struct {
+	ts          uint64
+	lastTs      uint64
+	fileOffset  int64
+	expiresAt   uint64 //when the whole block expires, 0 if some of the entries never do
+	expiresFrom uint64 //when the first of the entries of the block expires, 0 if none of them do
+	count       int
+}
+
+//isExpired tells whether all the entries of the block are expired
+func (e IndexEntry) isExpired(now uint64) bool {
+	return (e.expiresAt != 0) && (e.expiresAt < now)
+}
+
+func (e IndexEntry) Less(than btree.Item) bool {
+	oe := than.(IndexEntry)
+	return e.ts < oe.ts
+}
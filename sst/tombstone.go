@@ -0,0 +1,133 @@
+package sst
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/nikita-tomilov/golsm/commitlog"
+	"hash/crc32"
+	"os"
+)
+
+//tombstone deletes the entries within [from, to] of the segments older than the one it is stored in
+type tombstone struct {
+	from uint64
+	to   uint64
+}
+
+func (t tombstone) covers(ts uint64) bool {
+	return (ts >= t.from) && (ts <= t.to)
+}
+
+func (t tombstone) overlaps(fromTs uint64, toTs uint64) bool {
+	return (t.from <= toTs) && (t.to >= fromTs)
+}
+
+//clip narrows the tombstone down to [fromTs, toTs], which it must overlap
+func (t tombstone) clip(fromTs uint64, toTs uint64) tombstone {
+	if t.from < fromTs {
+		t.from = fromTs
+	}
+	if t.to > toTs {
+		t.to = toTs
+	}
+	return t
+}
+
+func applyTombstones(entries []Entry, tombstones []tombstone) []Entry {
+	if len(tombstones) == 0 {
+		return entries
+	}
+	ans := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		deleted := false
+		for _, t := range tombstones {
+			if t.covers(e.Timestamp) {
+				deleted = true
+				break
+			}
+		}
+		if !deleted {
+			ans = append(ans, e)
+		}
+	}
+	return ans
+}
+
+//resolveSegments merges the entries of the segments ordered from the oldest to the newest:
+//the tombstones of a segment hide the entries of the older ones, and the newer entries win over the ones with equal timestamps
+func resolveSegments(lists [][]Entry, tombstones [][]tombstone) []Entry {
+	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
+	for i, list := range lists {
+		ans = mergeSorted([][]Entry{applyTombstones(ans, tombstones[i]), list})
+	}
+	return ans
+}
+
+//resolveCommitlog returns the entries left after applying the tombstones to the ones that came before them in the commitlog,
+//sorted and deduplicated, and the tombstones themselves, which are still to be applied to the data already in SST
+func resolveCommitlog(commitlogEntries []commitlog.Entry) ([]commitlog.Entry, []tombstone) {
+	tombstones := make([]tombstone, 0)
+	puts := make([]commitlog.Entry, 0, len(commitlogEntries))
+	for i := len(commitlogEntries) - 1; i >= 0; i-- {
+		entry := commitlogEntries[i]
+		if entry.IsTombstone() {
+			from, to := entry.TombstoneRange()
+			tombstones = append(tombstones, tombstone{from: from, to: to})
+			continue
+		}
+		deleted := false
+		for _, t := range tombstones {
+			if t.covers(entry.Timestamp) {
+				deleted = true
+				break
+			}
+		}
+		if !deleted {
+			puts = append(puts, entry)
+		}
+	}
+	for i, j := 0, len(puts)-1; i < j; i, j = i+1, j-1 {
+		puts[i], puts[j] = puts[j], puts[i]
+	}
+	return sortAndDeduplicate(puts), tombstones
+}
+
+//encodeTombstonesBlock returns the block of the tombstones: [u32 len][tombstonesBlockId][crc32][from and to pairs]
+func encodeTombstonesBlock(tombstones []tombstone) []byte {
+	payload := make([]byte, 16*len(tombstones))
+	for i, t := range tombstones {
+		binary.LittleEndian.PutUint64(payload[i*16:], t.from)
+		binary.LittleEndian.PutUint64(payload[i*16+8:], t.to)
+	}
+	block := make([]byte, 4+blockHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(block, uint32(len(payload)))
+	block[4] = tombstonesBlockId
+	binary.LittleEndian.PutUint32(block[5:], crc32.ChecksumIEEE(payload))
+	copy(block[4+blockHeaderSize:], payload)
+	return block
+}
+
+//readTombstones reads the tombstones block if the segment of the given size starts with it
+func readTombstones(file *os.File, dataOffset int64, size int64) ([]tombstone, error) {
+	header := make([]byte, 4+blockHeaderSize)
+	n, _ := file.ReadAt(header, dataOffset)
+	if (n < len(header)) || isEndOfEntries(formatVersion, header) || (header[4] != tombstonesBlockId) {
+		return nil, nil
+	}
+	length := int64(binary.LittleEndian.Uint32(header))
+	if length > size-dataOffset-int64(len(header)) {
+		return nil, fmt.Errorf("tombstones block of %d bytes does not fit the file", length)
+	}
+	payload := make([]byte, length)
+	if _, err := file.ReadAt(payload, dataOffset+int64(len(header))); err != nil {
+		return nil, err
+	}
+	if (crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[5:])) || (len(payload)%16 != 0) {
+		return nil, fmt.Errorf("tombstones block is corrupted")
+	}
+	ans := make([]tombstone, len(payload)/16)
+	for i := range ans {
+		ans[i] = tombstone{from: binary.LittleEndian.Uint64(payload[i*16:]), to: binary.LittleEndian.Uint64(payload[i*16+8:])}
+	}
+	return ans, nil
+}
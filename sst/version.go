@@ -0,0 +1,160 @@
+package sst
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/jeanphorn/log4go"
+	"github.com/nikita-tomilov/golsm/errs"
+	"github.com/nikita-tomilov/golsm/utils"
+	"sync/atomic"
+)
+
+//version is an immutable set of the segments of the tag. The readers pin the current version for the whole read,
+//so that the segments replaced meanwhile by a flush or a compaction stay readable; the file of a segment is removed
+//once no version has it, that is after the last reader of the versions having it is done
+type version struct {
+	segments []*segment
+	//the tag holds its current version, and every reader the version it has pinned
+	refs int32
+}
+
+//newVersion makes the current version of the segments, which are not to be changed afterwards
+func newVersion(segments []*segment) *version {
+	for _, s := range segments {
+		atomic.AddInt32(&s.versions, 1)
+	}
+	return &version{segments: segments, refs: 1}
+}
+
+func (v *version) ref() {
+	atomic.AddInt32(&v.refs, 1)
+}
+
+func (v *version) release() {
+	if atomic.AddInt32(&v.refs, -1) != 0 {
+		return
+	}
+	for _, s := range v.segments {
+		if atomic.AddInt32(&s.versions, -1) != 0 {
+			continue
+		}
+		if err := s.remove(); err != nil {
+			log.Error(fmt.Sprintf("Unable to remove replaced SST segment %s: %s", s.fileName, err.Error()))
+		}
+	}
+}
+
+//pin returns the current version, which stays readable until released
+func (st *SSTforTag) pin() *version {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	st.version.ref()
+	return st.version
+}
+
+//setVersion makes the segments the current version and releases the previous one;
+//the mutex is only held for the swap, the files of the replaced segments are removed after it
+func (st *SSTforTag) setVersion(update func(segments []*segment) []*segment) {
+	st.mutex.Lock()
+	previous := st.version
+	segments := update(append(make([]*segment, 0, len(previous.segments)), previous.segments...))
+	sortSegments(segments)
+	st.version = newVersion(segments)
+	st.mutex.Unlock()
+	previous.release()
+}
+
+//close releases the current version keeping the files, so that the segments are unmapped once their last reader is done,
+//and the manifest acquired by the table opened by itself
+func (st *SSTforTag) close() {
+	st.mutex.Lock()
+	current := st.version
+	for _, s := range current.segments {
+		atomic.StoreInt32(&s.kept, 1)
+	}
+	st.version = newVersion(make([]*segment, 0))
+	st.mutex.Unlock()
+	current.release()
+	st.releaseManifest()
+}
+
+//Snapshot is the data of the tag as of its creation, unaffected by the flushes, compactions and drops
+//that happen meanwhile; it is to be released once read. The values read from the memory mapped segments
+//are only valid until Release, see Detached; only the blocks written with CodecNone are read without copying,
+//the compressed ones are decompressed into the memory of the read
+type Snapshot struct {
+	tag          *SSTforTag
+	version      *version
+	memoryMapped bool
+}
+
+func (st *SSTforTag) Snapshot() *Snapshot {
+	return &Snapshot{tag: st, version: st.pin(), memoryMapped: st.MemoryMapped}
+}
+
+//readError quarantines the segment found corrupted, so that only the read that found it fails
+func (sn *Snapshot) readError(s *segment, err error) error {
+	if errors.Is(err, errs.ErrCorrupted) {
+		sn.tag.quarantine(s, err)
+	}
+	return err
+}
+
+//Detached returns the value read from the snapshot that stays valid after Release
+func (sn *Snapshot) Detached(value []byte) []byte {
+	if !sn.memoryMapped {
+		return value
+	}
+	return append(make([]byte, 0, len(value)), value...)
+}
+
+//detachAll makes the values of the entries valid after Release
+func (sn *Snapshot) detachAll(entries []Entry, err error) ([]Entry, error) {
+	for i := range entries {
+		entries[i].Value = sn.Detached(entries[i].Value)
+	}
+	return entries, err
+}
+
+func (sn *Snapshot) Release() {
+	sn.version.release()
+}
+
+func (sn *Snapshot) GetAllEntries() ([]Entry, error) {
+	lists := make([][]Entry, len(sn.version.segments))
+	tombstones := make([][]tombstone, len(sn.version.segments))
+	for i, s := range sn.version.segments {
+		entries, err := s.allEntries()
+		if err != nil {
+			return nil, sn.readError(s, err)
+		}
+		lists[i] = entries
+		tombstones[i] = s.tombstones
+	}
+	return resolveSegments(lists, tombstones), nil
+}
+
+func (sn *Snapshot) GetEntriesWithoutIndex(fromTs uint64, toTs uint64) ([]Entry, error) {
+	return sn.getEntries(fromTs, toTs, (*segment).entriesWithoutIndex)
+}
+
+func (sn *Snapshot) GetEntriesWithIndex(fromTs uint64, toTs uint64) ([]Entry, error) {
+	return sn.getEntries(fromTs, toTs, (*segment).entriesWithIndex)
+}
+
+func (sn *Snapshot) getEntries(fromTs uint64, toTs uint64, read func(s *segment, fromTs uint64, toTs uint64, now uint64) ([]Entry, error)) ([]Entry, error) {
+	now := utils.GetNowMillis()
+	lists := make([][]Entry, 0, len(sn.version.segments))
+	tombstones := make([][]tombstone, 0, len(sn.version.segments))
+	for _, s := range sn.version.segments {
+		if s.overlaps(fromTs, toTs) {
+			entries, err := read(s, fromTs, toTs, now)
+			if err != nil {
+				return nil, sn.readError(s, err)
+			}
+			lists = append(lists, entries)
+			tombstones = append(tombstones, s.tombstones)
+		}
+	}
+	return resolveSegments(lists, tombstones), nil
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"sync"
+)
+
+const shardsCount = 32
+
+//ShardedMap is a map of string keys safe for concurrent use. The keys are written once and read many times,
+//so every shard keeps them in a sync.Map, which the reads never lock; the keys are spread over the shards by hash,
+//so the writers only contend within a shard
+type ShardedMap struct {
+	shards []*mapShard
+}
+
+type mapShard struct {
+	items *sync.Map
+	//guards creating, the keys being created, so that create runs once per key without holding the mutex
+	mutex    *sync.Mutex
+	creating map[string]*creation
+}
+
+type creation struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+func NewShardedMap() *ShardedMap {
+	m := ShardedMap{shards: make([]*mapShard, shardsCount)}
+	for i := range m.shards {
+		m.shards[i] = &mapShard{items: &sync.Map{}, mutex: &sync.Mutex{}, creating: make(map[string]*creation)}
+	}
+	return &m
+}
+
+//fnv-1a, inlined to avoid allocating a hasher on every read
+func (m *ShardedMap) shard(key string) *mapShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return m.shards[hash%shardsCount]
+}
+
+func (m *ShardedMap) Load(key string) (interface{}, bool) {
+	return m.shard(key).items.Load(key)
+}
+
+//LoadOrCreate returns the value of the key, creating it if missing; create is called at most once at a time per key,
+//without holding the shard, and the concurrent callers for the same key wait for its result
+func (m *ShardedMap) LoadOrCreate(key string, create func() (interface{}, error)) (interface{}, error) {
+	shard := m.shard(key)
+	if value, exists := shard.items.Load(key); exists {
+		return value, nil
+	}
+	shard.mutex.Lock()
+	if value, exists := shard.items.Load(key); exists {
+		shard.mutex.Unlock()
+		return value, nil
+	}
+	if running, exists := shard.creating[key]; exists {
+		shard.mutex.Unlock()
+		<-running.done
+		return running.value, running.err
+	}
+	c := &creation{done: make(chan struct{})}
+	shard.creating[key] = c
+	shard.mutex.Unlock()
+
+	c.value, c.err = create()
+	shard.mutex.Lock()
+	delete(shard.creating, key)
+	if c.err == nil {
+		shard.items.Store(key, c.value)
+	}
+	shard.mutex.Unlock()
+	close(c.done)
+	return c.value, c.err
+}
+
+func (m *ShardedMap) Delete(key string) (interface{}, bool) {
+	shard := m.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	return shard.items.LoadAndDelete(key)
+}
+
+//Range calls f for every key present when the shard is visited; the changes made meanwhile may be missed
+func (m *ShardedMap) Range(f func(key string, value interface{})) {
+	for _, shard := range m.shards {
+		shard.items.Range(func(k interface{}, v interface{}) bool {
+			f(k.(string), v)
+			return true
+		})
+	}
+}
+
+func (m *ShardedMap) Keys() []string {
+	keys := make([]string, 0)
+	m.Range(func(key string, _ interface{}) {
+		keys = append(keys, key)
+	})
+	return keys
+}
@@ -46,13 +46,6 @@ func FromNetworkByteArray(arr []byte, x interface{}) (interface{}, error) {
 	return x, nil
 }
 
-func Check(e error) {
-	if e != nil {
-		log.Error(e)
-		panic(e)
-	}
-}
-
 func FileExists(filename string) bool {
 	info, err := os.Stat(filename)
 	if os.IsNotExist(err) {
@@ -65,9 +58,17 @@ func GetNowMillis() uint64 {
 	return uint64(time.Now().UnixNano() / 1000000)
 }
 
-func DoEvery(d time.Duration, f func()) {
-	for range time.Tick(d) {
-		f()
+//DoEvery calls f every d until the stop channel is closed
+func DoEvery(d time.Duration, stop <-chan struct{}, f func()) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			f()
+		}
 	}
 }
 
@@ -4,65 +4,350 @@ import (
 	"fmt"
 	log "github.com/jeanphorn/log4go"
 	"github.com/nikita-tomilov/golsm/commitlog"
+	"github.com/nikita-tomilov/golsm/errs"
+	"github.com/nikita-tomilov/golsm/memt"
 	"github.com/nikita-tomilov/golsm/sst"
 	"github.com/nikita-tomilov/golsm/utils"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const DefaultMaxPendingSegments = 4
+
+const DefaultEntriesPerCommitlog = 10000
+
+const DefaultPeriodBetweenFlushes = 10 * time.Second
+
+var errDiskWriterClosed = errs.Closed("disk writer")
+
 type DiskWriter struct {
 	SstManager           *sst.Manager
 	ClManager            *commitlog.Manager
+	MemTable             *memt.Manager
 	EntriesPerCommitlog  int
 	PeriodBetweenFlushes time.Duration
-	currentEntries       int
-	mutex                *sync.Mutex
+	MaxPendingSegments   int
+	currentEntries       int64
+	mutex                *sync.RWMutex
+	flushRequests        chan struct{}
+	flushed              *sync.Cond
+	flushErr             error
+	//counts the finished flushes, so that the waiters only take the error of a flush finished after they started waiting
+	flushGeneration uint64
+	flusherStopped  bool
+	closed          bool
+	stop            chan struct{}
+	workers         *sync.WaitGroup
 }
 
-func (dbw *DiskWriter) Init() {
-	dbw.SstManager.InitStorage()
-	dbw.ClManager.Init()
+func (dbw *DiskWriter) Init() error {
+	if err := dbw.SstManager.InitStorage(); err != nil {
+		return err
+	}
+	if err := dbw.ClManager.Init(); err != nil {
+		dbw.SstManager.CloseStorage()
+		return err
+	}
+	if dbw.EntriesPerCommitlog == 0 {
+		dbw.EntriesPerCommitlog = DefaultEntriesPerCommitlog
+	}
+	if dbw.PeriodBetweenFlushes == 0 {
+		dbw.PeriodBetweenFlushes = DefaultPeriodBetweenFlushes
+	}
+	if dbw.MaxPendingSegments == 0 {
+		dbw.MaxPendingSegments = DefaultMaxPendingSegments
+	}
 	dbw.currentEntries = 0
-	dbw.mutex = &sync.Mutex{}
+	dbw.mutex = &sync.RWMutex{}
+	dbw.flushRequests = make(chan struct{}, 1)
+	dbw.flushed = sync.NewCond(&sync.Mutex{})
+	dbw.closed = false
+	dbw.flusherStopped = false
+	dbw.stop = make(chan struct{})
+	dbw.workers = &sync.WaitGroup{}
+	if err := dbw.replayCommitlogs(); err != nil {
+		dbw.ClManager.Close()
+		dbw.SstManager.CloseStorage()
+		return err
+	}
+
+	dbw.workers.Add(2)
+	go func() {
+		defer dbw.workers.Done()
+		dbw.runFlusher()
+	}()
+	go func() {
+		defer dbw.workers.Done()
+		utils.DoEvery(dbw.PeriodBetweenFlushes, dbw.stop, dbw.trySwitchCommitlog)
+	}()
+	return nil
+}
+
+func (dbw *DiskWriter) replayCommitlogs() error {
+	segments := dbw.ClManager.SealedSegments()
+	entriesPerSegment, err := retrieveWithoutDroppedTags(segments)
+	if err != nil {
+		return err
+	}
+	for i, segment := range segments {
+		entries := entriesPerSegment[i]
+		log.Info(fmt.Sprintf("Replaying %d entries left in commitlog segment %d", len(entries), segment.Id))
+		if dbw.MemTable != nil {
+			if err := dbw.MemTable.MergeWithCommitlog(entries); err != nil {
+				return err
+			}
+		}
+		if err := dbw.flushSegment(segment, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dbw *DiskWriter) Store(e commitlog.Entry) error {
+	return dbw.StoreMultiple([]commitlog.Entry{e})
+}
 
-	go utils.DoEvery(dbw.PeriodBetweenFlushes, func() {
+//StoreMultiple returns once the entries are durable according to the commitlog SyncPolicy;
+//concurrent callers only share the read lock so that their batches get group-committed by the commitlog,
+//and the lock is not held while waiting for the periodic sync
+func (dbw *DiskWriter) StoreMultiple(e []commitlog.Entry) error {
+	if err := dbw.waitForPendingFlushes(); err != nil {
+		return err
+	}
+	dbw.mutex.RLock()
+	if dbw.closed {
+		dbw.mutex.RUnlock()
+		return errDiskWriterClosed
+	}
+	seq, err := dbw.ClManager.Append(e)
+	if err != nil {
+		dbw.mutex.RUnlock()
+		return err
+	}
+	shouldSwitch := atomic.AddInt64(&dbw.currentEntries, int64(len(e))) >= int64(dbw.EntriesPerCommitlog)
+	dbw.mutex.RUnlock()
+
+	err = dbw.ClManager.AwaitDurable(seq)
+	if shouldSwitch {
 		dbw.trySwitchCommitlog()
-	})
+	}
+	return err
 }
 
-func (dbw *DiskWriter) Store(e commitlog.Entry) {
+//trySwitchCommitlog only seals the active commitlog segment; merging it to SST is up to the flusher
+func (dbw *DiskWriter) trySwitchCommitlog() {
 	dbw.mutex.Lock()
-	dbw.ClManager.Store(e)
-	dbw.currentEntries++
+	if dbw.closed {
+		dbw.mutex.Unlock()
+		return
+	}
+	if _, err := dbw.sealActiveSegment(); err != nil {
+		log.Error(fmt.Sprintf("Could not seal the active commitlog segment: %s", err.Error()))
+	}
 	dbw.mutex.Unlock()
-	if dbw.currentEntries >= dbw.EntriesPerCommitlog {
-		dbw.trySwitchCommitlog()
-		dbw.currentEntries = 0
+	dbw.requestFlush()
+}
+
+func (dbw *DiskWriter) requestFlush() {
+	select {
+	case dbw.flushRequests <- struct{}{}:
+	default:
 	}
 }
 
-func (dbw *DiskWriter) StoreMultiple(e []commitlog.Entry) {
-	dbw.mutex.Lock()
-	dbw.ClManager.StoreMultiple(e)
-	dbw.currentEntries += len(e)
+//waitForPendingFlushes applies the backpressure when the flusher is behind by too many sealed segments;
+//if the flusher is failing, the writes are rejected with its error instead of piling up in the commitlog
+func (dbw *DiskWriter) waitForPendingFlushes() error {
+	dbw.flushed.L.Lock()
+	defer dbw.flushed.L.Unlock()
+	for dbw.ClManager.SealedSegmentsCount() >= dbw.MaxPendingSegments {
+		if dbw.flusherStopped {
+			return errDiskWriterClosed
+		}
+		if dbw.flushErr != nil {
+			return dbw.flushErr
+		}
+		dbw.requestFlush()
+		dbw.flushed.Wait()
+	}
+	return nil
+}
+
+func (dbw *DiskWriter) runFlusher() {
+	for {
+		select {
+		case <-dbw.stop:
+			return
+		case <-dbw.flushRequests:
+			dbw.flushSealedSegments()
+		}
+	}
+}
 
+//flushSealedSegments stops at the first segment that fails to flush, so that the segments are still flushed in order
+func (dbw *DiskWriter) flushSealedSegments() {
+	segments := dbw.ClManager.SealedSegments()
+	entriesPerSegment, err := retrieveWithoutDroppedTags(segments)
+	for i := 0; (err == nil) && (i < len(segments)); i++ {
+		err = dbw.flushSegment(segments[i], entriesPerSegment[i])
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("Flushing commitlog to SST failed: %s", err.Error()))
+	}
+	dbw.flushed.L.Lock()
+	dbw.flushErr = err
+	dbw.flushGeneration++
+	dbw.flushed.Broadcast()
+	dbw.flushed.L.Unlock()
+}
+
+//retrieveWithoutDroppedTags reads the entries of the segments, leaving out the ones of the tags dropped later;
+//the drop records themselves are kept so that the tags get dropped from SST as well
+func retrieveWithoutDroppedTags(segments []*commitlog.OverFile) ([][]commitlog.Entry, error) {
+	entriesPerSegment := make([][]commitlog.Entry, len(segments))
+	dropped := make(map[string]bool)
+	for i := len(segments) - 1; i >= 0; i-- {
+		entries, err := segments[i].RetrieveAll()
+		if err != nil {
+			return nil, err
+		}
+		kept := make([]commitlog.Entry, 0, len(entries))
+		for j := len(entries) - 1; j >= 0; j-- {
+			tag := string(entries[j].Key)
+			if entries[j].IsDropRecord() {
+				dropped[tag] = true
+			} else if dropped[tag] {
+				continue
+			}
+			kept = append(kept, entries[j])
+		}
+		for l, r := 0, len(kept)-1; l < r; l, r = l+1, r-1 {
+			kept[l], kept[r] = kept[r], kept[l]
+		}
+		entriesPerSegment[i] = kept
+	}
+	return entriesPerSegment, nil
+}
+
+//DropTag writes the drop record to the commitlog and returns once it is flushed, so that SST no longer has the tag
+//and the older commitlog entries of the tag can not bring it back
+func (dbw *DiskWriter) DropTag(tag string) error {
+	if err := dbw.waitForPendingFlushes(); err != nil {
+		return err
+	}
+	dbw.mutex.Lock()
+	if dbw.closed {
+		dbw.mutex.Unlock()
+		return errDiskWriterClosed
+	}
+	seq, err := dbw.ClManager.Append([]commitlog.Entry{commitlog.NewDropRecord([]byte(tag))})
+	activeId := uint64(0)
+	if err == nil {
+		activeId, err = dbw.sealActiveSegment()
+	}
 	dbw.mutex.Unlock()
-	if dbw.currentEntries >= dbw.EntriesPerCommitlog {
-		dbw.trySwitchCommitlog()
-		dbw.currentEntries = 0
+	if err != nil {
+		return err
+	}
+	if err := dbw.ClManager.AwaitDurable(seq); err != nil {
+		return err
 	}
+	return dbw.awaitFlushBefore(activeId)
 }
 
-func (dbw *DiskWriter) trySwitchCommitlog() {
+//awaitFlushBefore waits for the sealed segments older than the given one to be flushed
+func (dbw *DiskWriter) awaitFlushBefore(segmentId uint64) error {
+	dbw.requestFlush()
+	dbw.flushed.L.Lock()
+	defer dbw.flushed.L.Unlock()
+	generation := dbw.flushGeneration
+	for {
+		sealed := dbw.ClManager.SealedSegments()
+		if (len(sealed) == 0) || (sealed[0].Id >= segmentId) {
+			return nil
+		}
+		if dbw.flusherStopped {
+			return errDiskWriterClosed
+		}
+		dbw.flushed.Wait()
+		if (dbw.flushGeneration != generation) && (dbw.flushErr != nil) {
+			return dbw.flushErr
+		}
+	}
+}
+
+//Flush seals the active commitlog segment and returns once every entry stored before the call is flushed to SST
+func (dbw *DiskWriter) Flush() error {
 	dbw.mutex.Lock()
-	currentEntries := dbw.ClManager.RetrieveAll()
-	if len(currentEntries) > 0 {
-		log.Debug("Switching commitlogs")
-		dbw.ClManager.SwapCommitlogs()
-		dbw.ClManager.ClearPrevious()
-		dbw.SstManager.MergeWithCommitlog(currentEntries)
+	if dbw.closed {
+		dbw.mutex.Unlock()
+		return errDiskWriterClosed
+	}
+	activeId, err := dbw.sealActiveSegment()
+	dbw.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return dbw.awaitFlushBefore(activeId)
+}
 
-		log.Debug(fmt.Sprintf("%d entries sent to SST", len(currentEntries)))
+//sealActiveSegment is to be called under the exclusive lock; it returns the id of the new active segment
+func (dbw *DiskWriter) sealActiveSegment() (uint64, error) {
+	err := dbw.ClManager.Rollover()
+	atomic.StoreInt64(&dbw.currentEntries, 0)
+	return dbw.ClManager.ActiveSegmentId(), err
+}
+
+//Close rejects the new writes, flushes the stored entries to SST, stops the background workers
+//and closes the commitlog and SST; the writes in progress are completed first
+func (dbw *DiskWriter) Close() error {
+	dbw.mutex.Lock()
+	if dbw.closed {
+		dbw.mutex.Unlock()
+		return errDiskWriterClosed
 	}
+	dbw.closed = true
+	activeId, err := dbw.sealActiveSegment()
 	dbw.mutex.Unlock()
+	if err == nil {
+		err = dbw.awaitFlushBefore(activeId)
+	}
+
+	close(dbw.stop)
+	dbw.workers.Wait()
+	dbw.flushed.L.Lock()
+	dbw.flusherStopped = true
+	dbw.flushed.Broadcast()
+	dbw.flushed.L.Unlock()
+
+	if closeErr := dbw.ClManager.Close(); (closeErr != nil) && (err == nil) {
+		err = closeErr
+	}
+	if closeErr := dbw.SstManager.CloseStorage(); (closeErr != nil) && (err == nil) {
+		err = closeErr
+	}
+	return err
+}
+
+//the segment is removed only after SST has durably stored its entries; on failure it is kept to be flushed again
+func (dbw *DiskWriter) flushSegment(segment *commitlog.OverFile, entries []commitlog.Entry) error {
+	if len(entries) > 0 {
+		if err := dbw.SstManager.MergeWithCommitlog(entries); err != nil {
+			return err
+		}
+		if dbw.MemTable != nil {
+			dbw.MemTable.ReleaseTombstones(entries)
+		}
+	}
+	if err := dbw.ClManager.RemoveSegment(segment); err != nil {
+		return err
+	}
+	log.Debug(fmt.Sprintf("%d entries of commitlog segment %d sent to SST", len(entries), segment.Id))
+
+	dbw.flushed.L.Lock()
+	dbw.flushed.Broadcast()
+	dbw.flushed.L.Unlock()
+	return nil
 }
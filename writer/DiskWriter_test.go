@@ -1,11 +1,16 @@
 package writer
 
 import (
+	"errors"
 	"fmt"
 	"github.com/nikita-tomilov/golsm/commitlog"
+	"github.com/nikita-tomilov/golsm/errs"
+	"github.com/nikita-tomilov/golsm/memt"
 	"github.com/nikita-tomilov/golsm/sst"
 	"github.com/nikita-tomilov/golsm/utils"
 	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -35,7 +40,7 @@ func TestDiskWriter_DataIsNotLost(t *testing.T) {
 		diskWriter.Store(dummyData[i])
 	}
 	time.Sleep(10 * time.Second)
-	writtenData := sstm.SstForTag("whatever").GetAllEntries()
+	writtenData := entriesOnDisk(&sstm, "whatever")
 
 	//then
 	assert.Equal(t, len(dummyData), len(writtenData), "some dto was lost")
@@ -44,3 +49,171 @@ func TestDiskWriter_DataIsNotLost(t *testing.T) {
 		assert.Equal(t, dummyData[i].Value, writtenData[i].Value, "entry value incorrect")
 	}
 }
+
+func TestDiskWriter_ReplaysCommitlogsOnStartup(t *testing.T) {
+	//given
+	clPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	sstPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	clm := commitlog.Manager{Path: clPath}
+	clm.Init()
+
+	dummyData := make([]commitlog.Entry, 5)
+	for i := 0; i < 5; i++ {
+		dummyData[i] = commitlog.Entry{Key: []byte("whatever"), Timestamp: 1337 + uint64(i), ExpiresAt: 0, Value: make([]byte, 4)}
+	}
+	clm.StoreMultiple(dummyData)
+
+	//when
+	sstm := sst.Manager{RootDir: sstPath}
+	memtm := memt.Manager{MaxEntriesPerTag: 9999}
+	memtm.InitStorage()
+	diskWriter := DiskWriter{SstManager: &sstm, ClManager: &commitlog.Manager{Path: clPath}, MemTable: &memtm, EntriesPerCommitlog: 10, PeriodBetweenFlushes: 5 * time.Second}
+	diskWriter.Init()
+
+	writtenData := entriesOnDisk(&sstm, "whatever")
+	dataInMemT := memtm.MemTableForTag("whatever").RetrieveAll()
+
+	//then
+	assert.Equal(t, len(dummyData), len(writtenData), "commitlog was not replayed to SST")
+	assert.Equal(t, len(dummyData), len(dataInMemT), "commitlog was not replayed to MemT")
+	assert.Equal(t, 0, len(unflushed(diskWriter.ClManager)), "commitlogs were not cleared after replay")
+}
+
+func TestDiskWriter_ReplaysDropRecordOnStartup(t *testing.T) {
+	//given
+	clPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	sstPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	sstm := sst.Manager{RootDir: sstPath}
+	sstm.InitStorage()
+	sstm.MergeWithCommitlog([]commitlog.Entry{{Key: []byte("whatever"), Timestamp: 1000, Value: make([]byte, 4)}})
+	clm := commitlog.Manager{Path: clPath}
+	clm.Init()
+	clm.StoreMultiple([]commitlog.Entry{
+		{Key: []byte("whatever"), Timestamp: 1337, Value: make([]byte, 4)},
+		{Key: []byte("kept"), Timestamp: 1337, Value: make([]byte, 4)},
+	})
+	clm.Rollover()
+	clm.StoreMultiple([]commitlog.Entry{commitlog.NewDropRecord([]byte("whatever"))})
+	clm.Close()
+	sstm.CloseStorage()
+
+	//when
+	restartedSstm := sst.Manager{RootDir: sstPath}
+	memtm := memt.Manager{MaxEntriesPerTag: 9999}
+	memtm.InitStorage()
+	diskWriter := DiskWriter{SstManager: &restartedSstm, ClManager: &commitlog.Manager{Path: clPath}, MemTable: &memtm, EntriesPerCommitlog: 10, PeriodBetweenFlushes: 5 * time.Second}
+	diskWriter.Init()
+
+	//then
+	assert.Equal(t, []string{"kept"}, restartedSstm.GetTags(), "dropped tag was brought back to SST")
+	assert.Equal(t, []string{"kept"}, memtm.GetTags(), "dropped tag was brought back to MemT")
+	assert.Equal(t, 0, len(unflushed(diskWriter.ClManager)), "commitlogs were not cleared after replay")
+}
+
+func TestDiskWriter_ConcurrentWritersAreNotLost(t *testing.T) {
+	//given
+	clm := commitlog.Manager{Path: fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	sstm := sst.Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	diskWriter := DiskWriter{SstManager: &sstm, ClManager: &clm, EntriesPerCommitlog: 100, PeriodBetweenFlushes: 1 * time.Second}
+	diskWriter.Init()
+
+	//when
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				e := commitlog.Entry{Key: []byte("whatever"), Timestamp: uint64(1337 + w*50 + i), ExpiresAt: 0, Value: make([]byte, 4)}
+				assert.Nil(t, diskWriter.StoreMultiple([]commitlog.Entry{e}), "store failed")
+			}
+		}(w)
+	}
+	wg.Wait()
+	time.Sleep(3 * time.Second)
+	writtenData := entriesOnDisk(&sstm, "whatever")
+
+	//then
+	assert.Equal(t, 16*50, len(writtenData), "some dto was lost")
+}
+
+func TestDiskWriter_BackpressureDoesNotLoseData(t *testing.T) {
+	//given
+	clm := commitlog.Manager{Path: fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	sstm := sst.Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	diskWriter := DiskWriter{SstManager: &sstm, ClManager: &clm, EntriesPerCommitlog: 2, PeriodBetweenFlushes: 5 * time.Second, MaxPendingSegments: 1}
+	diskWriter.Init()
+
+	//when
+	for i := 0; i < 100; i++ {
+		e := commitlog.Entry{Key: []byte("whatever"), Timestamp: uint64(1337 + i), ExpiresAt: 0, Value: make([]byte, 4)}
+		assert.Nil(t, diskWriter.Store(e), "store failed")
+		assert.LessOrEqual(t, clm.SealedSegmentsCount(), 1, "too many sealed segments pending")
+	}
+	time.Sleep(1 * time.Second)
+	writtenData := entriesOnDisk(&sstm, "whatever")
+
+	//then
+	assert.Equal(t, 100, len(writtenData), "some dto was lost")
+}
+
+func TestDiskWriter_FlushWritesActiveCommitlogToSST(t *testing.T) {
+	//given
+	clm := commitlog.Manager{Path: fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	sstm := sst.Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	diskWriter := DiskWriter{SstManager: &sstm, ClManager: &clm, EntriesPerCommitlog: 100, PeriodBetweenFlushes: 5 * time.Second}
+	diskWriter.Init()
+	for i := 0; i < 5; i++ {
+		diskWriter.Store(commitlog.Entry{Key: []byte("whatever"), Timestamp: uint64(1337 + i), ExpiresAt: 0, Value: make([]byte, 4)})
+	}
+
+	//when
+	err := diskWriter.Flush()
+	writtenData := entriesOnDisk(&sstm, "whatever")
+	pending := unflushed(&clm)
+	closeErr := diskWriter.Close()
+	storeErr := diskWriter.Store(commitlog.Entry{Key: []byte("whatever"), Timestamp: 1400, ExpiresAt: 0, Value: make([]byte, 4)})
+
+	//then
+	assert.Nil(t, err, "flush failed")
+	assert.Equal(t, 5, len(writtenData), "flushed entries are not in SST")
+	assert.Equal(t, 0, len(pending), "commitlog was not cleared after flush")
+	assert.Nil(t, closeErr, "disk writer was not closed")
+	assert.True(t, errors.Is(storeErr, errs.ErrClosed), "store into closed disk writer was not rejected")
+}
+
+func BenchmarkDiskWriter_ConcurrentStore(b *testing.B) {
+	clm := commitlog.Manager{Path: fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	sstm := sst.Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	diskWriter := DiskWriter{SstManager: &sstm, ClManager: &clm, EntriesPerCommitlog: 100000, PeriodBetweenFlushes: 5 * time.Second}
+	diskWriter.Init()
+
+	var ts uint64
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			e := commitlog.Entry{Key: []byte("whatever"), Timestamp: atomic.AddUint64(&ts, 1), ExpiresAt: 0, Value: make([]byte, 4)}
+			diskWriter.StoreMultiple([]commitlog.Entry{e})
+		}
+	})
+}
+
+func entriesOnDisk(sstm *sst.Manager, tag string) []sst.Entry {
+	st, err := sstm.SstForTag(tag)
+	if err != nil {
+		panic(err)
+	}
+	entries, err := st.GetAllEntries()
+	if err != nil {
+		panic(err)
+	}
+	return entries
+}
+
+func unflushed(clm *commitlog.Manager) []commitlog.Entry {
+	entries, err := clm.RetrieveUnflushed()
+	if err != nil {
+		panic(err)
+	}
+	return entries
+}